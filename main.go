@@ -13,144 +13,371 @@
 //   - Test concurrent request handling
 //
 // Behavior:
-//   - Response headers (200 OK, Content-Type: application/json) are sent immediately
+//   - Response headers (200 OK unless configured otherwise) are sent immediately
 //   - Response body is held until Enter is pressed in the server terminal
 //   - Each request is numbered and tracked
 //   - A single Enter press releases ALL pending requests simultaneously
-//   - Response body is JSON format: {"timestamp":"2025-12-15T12:34:56Z"}
+//   - Commands typed into the terminal inspect and manipulate the queue
+//   - Response body is JSON format by default: {"timestamp":"2025-12-15T12:34:56Z"}
 //   - Timestamp is the current time in ISO-8601 format (UTC) when the response is sent
 //
 // Usage:
-//   go run main.go              # Starts server on port 8080
-//   PORT=3000 go run main.go    # Starts server on custom port
+//   go run .                    # Starts server on port 8080
+//   PORT=3000 go run .          # Starts server on custom port
+//   go run . -port 3000 -auto-release 30s  # Every option is also a flag
+//                               # (see -h); flags override the environment
+//   go run . -config debug.json # Reads options missing from flags and the
+//                               # environment from a JSON file, e.g.
+//                               # {"port": 3000, "hold-rules": "POST /api"}
+//                               # Edits to status, auto-release, profile, body,
+//                               # body-file, hold-rules, body-rules and routes
+//                               # (or to the files they name) apply without a
+//                               # restart
+//   ADMIN_PORT=9090 go run .    # Also starts the admin API on port 9090
+//   HOLD_TIMEOUT=30 go run .    # Auto-releases each request after 30 seconds
+//   LATENCY_PROFILE=fixed:2s go run .  # Auto-releases each request after a
+//                               # delay drawn from a profile: fixed:2s,
+//                               # uniform:100ms-2s, normal:500ms±200ms or
+//                               # pareto[:100ms[,1.16]]
+//   STATUS=503 go run .         # Responds with 503 instead of 200
+//   LOG_FORMAT=json go run .    # Logs one JSON record per request event
+//   go run . -output ndjson     # Same, and keeps stdout to those records by
+//                               # sending command output to stderr (OUTPUT)
+//   QUIET=1 go run .            # Prints only warnings and command output
+//   go run . -quiet -output ndjson  # Prints only warnings and errors, as JSON
+//   NOTIFY=bell go run .        # Rings the terminal bell for each held request;
+//                               # NOTIFY=desktop shows a desktop notification
+//   WEBHOOK_URL=https://hooks.example.com/x go run .  # POSTs a JSON event
+//                               # (received, passed, released, abandoned or
+//                               # dropped) for every request to the URL
+//   OTEL_EXPORTER_OTLP_ENDPOINT=http://localhost:4318 go run .  # Exports a
+//                               # span per held request (its hold time) over
+//                               # OTLP/HTTP JSON, parented to any traceparent
+//   STATUS_LINE=1 go run .      # Keeps a live line at the bottom showing the
+//                               # pending count, oldest hold and total served
+//   COLOR=never go run .        # Turns off the colors of console output; by
+//                               # default a terminal gets them unless NO_COLOR
+//                               # is set (COLOR=always forces them)
+//   TUI=1 go run .              # Shows a full-screen live table of pending
+//                               # requests above the console output; arrows
+//                               # select, Enter releases, a releases all, d
+//                               # drops, t toggles releasing requests as they
+//                               # arrive, : runs a command and q quits
+//   HOLD_RULES="POST /api/orders, /users/*" go run .
+//                               # Holds only matching requests and answers all
+//                               # others immediately
+//   HOLD_PERCENT=20 go run .    # Holds a random 20% of (matching) requests and
+//                               # answers the rest immediately
+//   HOLD_EVERY=5 go run .       # Holds only every 5th (matching) request;
+//                               # HOLD_FIRST=3 holds only the first 3 and
+//                               # answers all later ones immediately
+//   BYPASS_PATHS=/ping,/status go run .
+//                               # Paths answered immediately with {"status":"ok"}
+//                               # (default /healthz,/readyz; empty to disable)
+//   BODY_SIZE=10MB go run .     # Sends a generated 10MB body on release (or per
+//                               # request with ?size=10MB); BODY_PATTERN=random
+//                               # makes it random bytes instead of repeated text
+//   CORS_ORIGINS='*' go run .   # Sends Access-Control-* headers to these
+//                               # origins and answers OPTIONS preflights at once
+//                               # (CORS_PREFLIGHT=hold holds them); see also
+//                               # CORS_METHODS, CORS_HEADERS, CORS_MAX_AGE,
+//                               # CORS_EXPOSE_HEADERS and CORS_CREDENTIALS=1
+//   AUTH=basic:user:pass,bearer:s3cret go run .  # Requires one of these
+//                               # credentials: 401 without any, 403 if wrong;
+//                               # AUTH_FAILURE=hold holds failures too, and
+//                               # AUTH_EXPIRE_FIRST=1 answers each client's
+//                               # first valid request with an expired-token 401
+//   EXPECT_CONTINUE=hold go run .  # Holds "Expect: 100-continue" requests
+//                               # before 100 Continue is sent, then again for
+//                               # the response; "refuse" answers 417 instead
+//   HOLD_BODY_READ=before go run . # Holds requests before reading their body,
+//                               # then again for the response; HOLD_BODY_READ=64K
+//                               # reads the first 64K of the body first
+//   UPLOAD_PROGRESS=1s go run . # Prints each upload's progress every second
+//                               # while the body streams in; UPLOAD_DIR=uploads
+//                               # saves every request body there in full
+//   MULTIPART_DIR=uploads go run . # Saves the files of multipart/form-data
+//                               # uploads there ("show <n>" lists all parts)
+//   PROTO_DESCRIPTORS=api.pb go run . # Decodes protobuf, gRPC and gRPC-Web
+//                               # bodies in "show <n>" as JSON, using a
+//                               # descriptor set from protoc --include_imports
+//                               # --descriptor_set_out=api.pb; without one,
+//                               # fields are shown by number
+//   CONNECTION_CLOSE=1 go run . # Sends Connection: close with every response;
+//                               # MAX_CONN_REQUESTS=3 only after 3 requests on a
+//                               # connection, and KEEP_ALIVE=0 disables
+//                               # keep-alives on the listener altogether
+//   READ_HEADER_TIMEOUT=5s go run . # Drops clients that take longer than 5s
+//                               # to send their headers; IDLE_TIMEOUT closes
+//                               # idle keep-alive connections and
+//                               # MAX_HEADER_BYTES=16K caps the header size
+//   RATE_LIMIT=20% go run .     # Answers a random 20% of requests with 429
+//                               # at once and holds the rest; RATE_LIMIT=10/1m
+//                               # throttles beyond 10 requests a minute instead.
+//                               # RETRY_AFTER=30 fixes the Retry-After hint
+//   REDIRECT_DEPTH=3 go run .   # Answers with 3 redirects back to the same
+//                               # path before the real response, each hop held
+//                               # (REDIRECT_STATUS=301|302|303|307|308, default
+//                               # 302; per request with ?redirects=3)
+//   MALFORMED=truncate go run . # Deliberately breaks released responses:
+//                               # content-length (claims too many bytes),
+//                               # chunking (bad chunk framing), garbage (junk
+//                               # before the status line) or truncate (body cut
+//                               # in half); nothing is sent while held
+//   COMPRESSION=auto go run .   # Compresses released bodies as the client's
+//                               # Accept-Encoding allows (gzip or deflate), or
+//                               # always with COMPRESSION=gzip|deflate;
+//                               # CONTENT_ENCODING=br announces a different,
+//                               # deliberately mismatched encoding
+//   TRAILERS='Grpc-Status=0,X-Checksum={{.BodySHA256}}' go run .
+//                               # Sends trailers after the body; values are
+//                               # templates with .ID, .Status, .BodyLength,
+//                               # .BodySHA256, .BodyMD5 and .BodyCRC32
+//   DRIP_RATE=1KB go run .      # Streams released bodies at 1KB per second
+//   HOLD_HEADERS=1 go run .     # Holds the status line and headers too, so
+//                               # nothing reaches the client before release
+//   PARTIAL_BYTES=10 go run .   # Sends only the first 10 bytes on release, then
+//                               # hangs until the request is released again
+//   CHUNK_SIZE=16 go run .      # Sends one 16-byte chunk per release (ENTER),
+//                               # holding in between; "end" sends the rest
+//   HISTORY_SIZE=500 go run .   # Keeps the last 500 completed requests (default
+//                               # 100, 0 disables); REPLAY_UPSTREAM sets where
+//                               # "replay" sends them (defaults to UPSTREAM)
+//   HISTORY_FILE=debug.jsonl go run .  # Saves the history to this file and
+//                               # reloads it on restart; "export sql" turns all
+//                               # of it, beyond HISTORY_SIZE, into SQL for
+//                               # sqlite3 (there is no SQLite file of its own)
+//   ACCESS_LOG=access.log go run .  # Appends an Apache combined log line per
+//                               # request, followed by held=<seconds>,
+//                               # outcome=<released|dropped|...> and the
+//                               # request ID;
+//                               # ACCESS_LOG_FORMAT=json writes JSON lines.
+//                               # ACCESS_LOG_MAX_SIZE=10MB or
+//                               # ACCESS_LOG_ROTATE=24h moves a full or old
+//                               # file aside to access.log.<timestamp>
+//   DUPLICATE_WINDOW=5m go run .  # Flags requests with the same method, path,
+//                               # query and body as one still pending or
+//                               # answered in the last 5 minutes, to spot
+//                               # client retries (off by default)
+//   IDEMPOTENCY=replay go run . # Answers a repeated Idempotency-Key at once
+//                               # with the first request's response, 409 while
+//                               # that is still held, or 422 if the method, path
+//                               # or body differ. By default (warn) repeats are
+//                               # only flagged, and mismatches warned about;
+//                               # off disables tracking
+//   PORTS=8080,8081,8443 go run .  # Listens on several ports, each with its
+//                               # own queue; "release :8081" releases one
+//   go run . -listen unix:/tmp/debug.sock  # Listens on a Unix domain socket
+//                               # (repeatable; also LISTEN=8080,unix:/tmp/x)
+//   CLIENT_HEADER=X-Client-Id go run .  # Groups clients by this header instead
+//                               # of their IP address
+//   SESSION_COOKIE=sid go run . # Groups clients (e.g. browser sessions) by this
+//                               # cookie, setting it on responses that lack it;
+//                               # SET_COOKIE='a=1; Path=/|b=2' sets more cookies
+//   RELEASE_TRIGGER=/tmp/release go run .  # Releases all pending requests
+//                               # whenever the file is touched or created
+//   RELEASE_ORDER=lifo go run . # Releases batches newest first (fifo, lifo or
+//                               # random); "release --order" overrides it
+//   MAX_PENDING=100 go run .    # Answers requests beyond 100 pending with 503
+//                               # and Retry-After instead of holding them
+//   NO_STDIN=1 go run .         # Ignores stdin (e.g. under docker run -d); use
+//                               # ctl, ADMIN_PORT, signals or HOLD_TIMEOUT instead
+//   go run . ctl release all    # Runs a command on the server running on PORT
+//                               # from another terminal, through a Unix socket
+//                               # in the temporary directory (CONTROL_SOCKET
+//                               # sets its path, or off); without a command,
+//                               # runs each line of stdin
+//   go run . ctl -addr host:9090 release 3  # Controls a remote or containerized
+//                               # server through its admin API instead:
+//                               # pending [<n>], release [<target>], drop <n>
+//                               # or reset <n> ("client" works as "ctl")
+//   go run . -v                 # Prints all request headers on arrival (or VERBOSE=1);
+//                               # VERBOSE_BODY=1 adds the body, MASK_SECRETS=1
+//                               # hides Authorization and Cookie values
+//   TLS=1 go run .              # Serves HTTPS with a generated self-signed cert
+//   TLS_CERT=c.pem TLS_KEY=k.pem go run .  # Serves HTTPS with the given cert
+//   TLS=1 TLS_CLIENT_CA=ca.pem go run .    # Requires client certs signed by ca.pem
+//                                          # (TLS_CLIENT_AUTH=optional to allow none)
+//
+// Signals (Unix only):
+//   kill -USR1 <pid>            # Releases all pending requests
+//   kill -USR2 <pid>            # Prints the pending list
+//
+// On SIGINT/SIGTERM all held requests are released and the server shuts down
+// gracefully. SHUTDOWN_MODE=drop closes their connections instead;
+// SHUTDOWN_STATUS=503 answers requests whose status line is still held
+// (e.g. in proxy mode) with that status; SHUTDOWN_TIMEOUT bounds the wait.
+//
+// Proxy mode:
+//   UPSTREAM=http://localhost:3000 go run .
+//
+// Each request is held without sending anything. On release it is forwarded
+// to the upstream and the upstream's real response is relayed to the client.
+// With PROXY_HOLD=response the request is forwarded immediately instead, the
+// upstream's status and headers are relayed, and only the body is held.
+//
+// With VCR_DIR=recordings each upstream response is also saved to a JSON file
+// keyed by method, path, query and a hash of the request body. Running with
+// VCR_MODE=replay (no UPSTREAM needed) then answers requests from those files,
+// still holding each one until release; unrecorded requests get 404.
+//
+// WebSocket upgrade requests are held too. By default the handshake completes
+// and the first server message (the response body) is held; with
+// WEBSOCKET_HOLD=handshake the 101 response itself is held. After release the
+// server echoes client messages back.
+//
+// With SSE=1, GET /sse opens a Server-Sent Events stream. Instead of holding
+// it, every Enter press (or "emit <data>" command) sends one event to all
+// connected streams.
+//
+// Raw TCP mode:
+//   TCP_PORT=6380 go run .                    # Also accepts raw TCP clients
+//   TCP_PORT=6380 TCP_REPLY='+OK\r\n' go run .
+//
+// Every chunk of data a TCP client sends is logged and queued as a request
+// with method TCP and path "tcp:<port>". On release the TCP_REPLY bytes (Go
+// string escapes allowed) are written back, or the chunk is echoed if no
+// reply is set, and the server waits for the next chunk.
+//
+// Clients can also control each request with headers:
+//   X-Debug-Status: 502         # Answers with this status (or ?status=502)
+//   X-Debug-Delay: 5s           # Auto-releases this request after 5 seconds
+//   X-Debug-Body: {"ok":false}  # Answers with this body
+//   X-Debug-Malformed: garbage  # Answers with a malformed response (as MALFORMED)
+// CONTROL_HEADERS=0 ignores them, e.g. when serving untrusted traffic.
+//
+// DECIDE_SCRIPT=./decide.py runs a command for each request to decide how to
+// handle it. The request arrives as JSON on stdin (method, path, query,
+// headers, body, remote_addr, pending and params, the path parameters of its
+// route) and the command prints a JSON decision, any part of which may be
+// omitted:
+//   {"action": "hold|delay|respond|drop|reset", "delay": "2s",
+//    "status": 503, "body": "...", "drip_rate": "1KB"}
+// Empty output or a failing script keeps the default behavior.
+//
+// SCENARIO_FILE=incident.json plays back an ordered list of such decisions,
+// each for a number of requests (see the scenarioStep type), e.g. hold the
+// first 3 requests, answer the next 2 with 500 after 1s, then pass the rest
+// through. The "scenario" command shows the current step.
+//
+// BODY_RULES decides by the content of JSON request bodies instead, without
+// a script. Rules are tried in order after the scenario and before the
+// script, and the first match wins:
+//   BODY_RULES='.amount > 1000 => hold; .currency == "XXX" => fail 422; * => pass'
+// A condition compares a field (a path as for "show <n> --jq") with ==, !=,
+// <, <=, >, >= or =~ (a regular expression), tests it with "exists", or is *
+// to match any request. Actions are hold, pass (answer at once), fail
+// [status] (at once, default 500), delay <duration>, drop and reset.
+//
+// CHAOS makes the server a general chaos backend: every request draws a fault
+// at random from a weighted mix, after the body rules and before the script,
+// and the console shows which one it drew:
+//   CHAOS='hold=10,delay:2s=20,500=10,reset=5,slow-body=10,pass=45' go run .
+// Faults are hold, delay[:<duration>] (default 1s), any status code (answered
+// at once), reset, drop, slow-body[:<bytes per second>] (answered at once at
+// 10 bytes per second by default) and pass. Weights are relative.
+//
+// Response body (default: {"timestamp":"2025-12-15T12:34:56Z"}):
+//   BODY_TEMPLATE='{"id":{{.ID}},"path":"{{.Path}}"}' go run .
+//   BODY_TEMPLATE_FILE=body.tmpl CONTENT_TYPE=application/json go run .
+//
+// Templates use Go text/template syntax and can reference .ID, .Method,
+// .Path, .Segments, .Params, .Query, .RemoteAddr, .ReceivedAt, .HeldFor and
+// .Timestamp. They can also generate data with {{uuid}}, {{randInt 1 100}},
+// {{randChoice "a" "b"}}, {{now.Unix}} and .Fake: {{.Fake.Name}}, .Email,
+// .FirstName, .LastName, .Company, .City, .Phone, .Word and .Sentence.
+//
+// ROUTES_FILE=routes.json gives matching paths their own status, headers and
+// body (see the route type for the file format).
+//
+// FIXTURES_DIR=./responses answers other requests with files from that
+// directory, read when the request is released: GET /users/42 gets
+// responses/users/42.json (or users/42, users/42.GET.json, ...) with a
+// Content-Type from the extension, and requests without a fixture get 404.
+//
+// MIDDLEWARE=log,capture:/tmp/captures,delay:1s wraps every request in these
+// built-in middlewares, in order: log, capture:<dir>, auth:basic:<user>:<pw>,
+// auth:bearer:<token> and delay:<duration>. Routes can add their own, and
+// embedding code can register any http.Handler middleware with Server.Use.
+//
+// With ECHO=1 the body is instead a JSON description of the original request
+// (method, path, query, headers and body), like a delayed httpbin.
+//
+// Every request gets an ID: the X-Request-Id it arrived with, or a generated
+// UUID. It is sent back in the X-Request-Id response header, forwarded to
+// UPSTREAM, and shown in console and JSON log lines, the pending list, the
+// admin API, the history and the access log.
+//
+// Commands (type "help" in the server terminal, or run them with ctl):
+//   list                        # Lists pending requests
+//   count                       # Shows the number of pending requests
+//   release all                 # Same as pressing Enter
+//   release <n>                 # Releases request #n only (or just type "<n>")
+//   release :8081               # Releases requests received on port 8081
+//   release client 10.0.0.5     # Releases requests from one client, identified
+//                               # by IP, the CLIENT_HEADER header value or the
+//                               # SESSION_COOKIE cookie (as sid=<value>)
+//   clients                     # Lists pending requests grouped by client
+//   release trace 4bf92f...     # Releases requests of one distributed trace
+//                               # (traceparent or B3 headers; prefix match)
+//   release group checkout      # Releases requests tagged ?group=checkout or
+//                               # X-Debug-Group: checkout
+//   release op CreateOrder      # Releases GraphQL requests running the
+//                               # CreateOrder operation
+//   release route /payments     # Releases requests answered by the ROUTES_FILE
+//                               # route with that path; list shows one queue
+//                               # per route
+//   release /api/orders         # Releases requests whose path has that prefix;
+//                               # patterns with *, ? or [ are matched as globs
+//   release --stagger 500ms     # Releases one request every 500ms
+//   release --jitter 100ms-2s   # Releases each request after a random delay
+//   order 4 2 7                 # Makes the next release that includes these
+//                               # requests send their responses in this order,
+//                               # each after the previous one has finished
+//   end [<n>]                   # Sends the rest of a CHUNK_SIZE body at once
+//   show <n>                    # Shows request #n's headers and body (JSON and
+//                               # XML indented), and the parts of a form upload
+//   show <n> --jq .items[0].id  # Shows only that part of a JSON body
+//   diff <n> <m>                # Shows how two pending or completed requests
+//                               # differ in query, headers and JSON body
+//   drop <n>                    # Closes request #n's connection without a body
+//   reset <n>                   # Aborts request #n's connection with a TCP RST
+//   scenario                    # Shows the current scenario step
+//   history                     # Lists recently completed requests
+//   stats                       # Shows totals, min/avg/p95/max hold times,
+//                               # counts per path and the peak number pending;
+//                               # also printed on exit unless STATS_ON_EXIT=0
+//   replay <n>                  # Re-sends completed request #n to the upstream
+//   export har <file>           # Writes the history to file in HAR format
+//   export sql <file>           # Writes the history as SQL (sqlite3 db < file)
+//   emit [data]                 # Sends an event to all SSE streams (SSE=1)
+//
+// Admin API (only when ADMIN_PORT is set):
+//   GET  /pending               # Lists pending requests as JSON
+//   GET  /pending/<n>           # Shows request #n including headers and body
+//   GET  /                      # Web dashboard with live queue and buttons
+//   POST /release               # Releases all pending requests
+//        ?id=<n>, ?port=<p>,    #   ...or only the matching ones,
+//        ?client=<c>, ?trace=<t>, ?group=<g>,
+//        ?operation=<name>, ?route=<r>
+//        or ?path=<p>
+//        &stagger=<d>&jitter=<r>#   ...optionally staggered or jittered
+//        &order=lifo|random     #   ...and in that order
+//   POST /drop?id=<n>           # Closes request #n's connection without a body
+//   POST /reset?id=<n>          # Aborts request #n's connection with a TCP RST
+//   GET  /debug/stats           # Goroutines, memory and queue statistics
+//   GET  /debug/pprof/          # Go runtime profiles (net/http/pprof)
+//   GET  /events                # Streams request events as SSE, or as JSON
+//                               # messages to WebSocket clients
+//   GET  /history               # Lists recently completed requests
+//   GET  /history/<n>           # Shows completed request #n including its body
+//   GET  /history/export?format=har  # Downloads the history as a HAR file
+//                                    # (format=sql: SQL statements for sqlite3)
 
 package main
 
-import (
-	"bufio"
-	"encoding/json"
-	"fmt"
-	"log"
-	"net/http"
-	"os"
-	"sync"
-	"time"
-)
-
-type pendingRequest struct {
-	requestTime  time.Time
-	responseChan chan struct{}
-	remoteAddr   string
-	path         string
-	method       string
-}
-
-type Server struct {
-	mu              sync.Mutex
-	pendingRequests []*pendingRequest
-	requestCounter  int
-}
-
-func NewServer() *Server {
-	return &Server{
-		pendingRequests: make([]*pendingRequest, 0),
-	}
-}
-
-func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
-	requestTime := time.Now()
-
-	// Create a pending request
-	req := &pendingRequest{
-		requestTime:  requestTime,
-		responseChan: make(chan struct{}),
-		remoteAddr:   r.RemoteAddr,
-		path:         r.URL.Path,
-		method:       r.Method,
-	}
-
-	// Add to pending requests
-	s.mu.Lock()
-	s.pendingRequests = append(s.pendingRequests, req)
-	s.requestCounter++
-	requestNum := s.requestCounter
-	pendingCount := len(s.pendingRequests)
-	s.mu.Unlock()
-
-	fmt.Printf("\n[%s] Request #%d: %s %s from %s\n",
-		requestTime.Format("15:04:05"), requestNum, r.Method, r.URL.Path, r.RemoteAddr)
-	fmt.Printf("Pending requests: %d (Press ENTER to release all)\n", pendingCount)
-
-	// Send response headers immediaapplication/jso
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-
-	// Flush headers if possible
-	if flusher, ok := w.(http.Flusher); ok {
-		flusher.Flush()
-	}
-
-	// Wait for the signal to send response
-	<-req.responseChan
-
-	responseTime := time.Now()
-	duration := responseTime.Sub(requestTime)
-
-	fmt.Printf("[%s] Request #%d: Response body sent after waiting %s\n",
-		responseTime.Format("15:04:05"), requestNum, duration)
-
-	// Write the current timestamp in ISO-8601 format (UTC) as JSON
-	timestamp := time.Now().UTC().Format(time.RFC3339)
-	response := map[string]string{
-		"timestamp": timestamp,
-	}
-	json.NewEncoder(w).Encode(response)
-}
-
-func (s *Server) waitForEnter() {
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		// Get all pending requests
-		s.mu.Lock()
-		pendingRequests := s.pendingRequests
-		count := len(pendingRequests)
-		s.pendingRequests = make([]*pendingRequest, 0)
-		s.mu.Unlock()
-
-		if count == 0 {
-			fmt.Println("No pending requests")
-			continue
-		}
-
-		fmt.Printf("\nReleasing %d pending request(s)...\n", count)
-
-		// Signal all pending requests to send their responses
-		for _, req := range pendingRequests {
-			close(req.responseChan)
-		}
-	}
-}
+import "variable-debug-web-server/server"
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-
-	server := NewServer()
-
-	// Start the goroutine that waits for enter key
-	go server.waitForEnter()
-
-	http.HandleFunc("/", server.handleRequest)
-
-	addr := fmt.Sprintf(":%s", port)
-	fmt.Printf("Starting server on http://localhost%s\n", addr)
-	fmt.Println("The server can hold multiple requests.")
-	fmt.Println("Press ENTER to release ALL pending requests at once.")
-	fmt.Println()
-
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
-	}
+	server.Main()
 }
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// accessLog writes one line per request to ACCESS_LOG, in the Apache
+// combined format or as JSON, with how long the request was held. The file
+// is rotated when it grows past maxSize bytes or is older than maxAge: it is
+// renamed with a timestamp suffix and a new one is started.
+type accessLog struct {
+	path    string
+	json    bool
+	maxSize int64
+	maxAge  time.Duration
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	opened  time.Time
+	warnf   func(format string, args ...interface{})
+	rotated int
+}
+
+// accessRecord collects what handling a request learned about it for its
+// access log line.
+type accessRecord struct {
+	mu      sync.Mutex
+	id      int
+	held    time.Duration
+	outcome string
+}
+
+type accessRecordKey struct{}
+
+// openAccessLog opens (or appends to) the access log at path. format is
+// combined (the default) or json.
+func openAccessLog(path, format string, maxSize int64, maxAge time.Duration, warnf func(string, ...interface{})) (*accessLog, error) {
+	l := &accessLog{path: path, maxSize: maxSize, maxAge: maxAge, warnf: warnf}
+	switch format {
+	case "", "combined":
+	case "json":
+		l.json = true
+	default:
+		return nil, fmt.Errorf("invalid ACCESS_LOG_FORMAT %q (want combined or json)", format)
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the log file for appending. l.mu must be held, or l not yet
+// shared.
+func (l *accessLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size, l.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// rotateLocked renames the current file aside and starts a new one. l.mu
+// must be held.
+func (l *accessLog) rotateLocked() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.rotated++
+	aside := fmt.Sprintf("%s.%s", l.path, time.Now().Format("20060102-150405"))
+	if _, err := os.Stat(aside); err == nil {
+		aside = fmt.Sprintf("%s-%d", aside, l.rotated)
+	}
+	if err := os.Rename(l.path, aside); err != nil {
+		// Keep logging to the old file rather than losing lines
+		l.open()
+		return err
+	}
+	return l.open()
+}
+
+// write appends line, rotating first if the file is due.
+func (l *accessLog) write(line []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && (l.maxSize > 0 && l.size+int64(len(line)) > l.maxSize || l.maxAge > 0 && time.Since(l.opened) >= l.maxAge) {
+		if err := l.rotateLocked(); err != nil {
+			l.warnf("Failed to rotate ACCESS_LOG: %v", err)
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		l.warnf("Failed to write ACCESS_LOG: %v", err)
+	}
+}
+
+func (l *accessLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// accessEntry is an access log line in JSON form.
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	ID         int       `json:"id,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	User       string    `json:"user,omitempty"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status,omitempty"`
+	Bytes      int64     `json:"bytes"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	DurationMS float64   `json:"duration_ms"`
+	HeldMS     float64   `json:"held_ms"`
+	Outcome    string    `json:"outcome,omitempty"`
+	RequestID  string    `json:"request_id"`
+}
+
+// log writes the line for r, which started at start and was answered through
+// rec.
+func (l *accessLog) log(r *http.Request, start time.Time, rec *statusRecorder, record *accessRecord) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	user, _, _ := r.BasicAuth()
+	record.mu.Lock()
+	defer record.mu.Unlock()
+	entry := accessEntry{
+		Time:       start,
+		ID:         record.id,
+		RemoteAddr: host,
+		User:       user,
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		Proto:      r.Proto,
+		Status:     rec.code,
+		Bytes:      rec.bytes,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		DurationMS: float64(time.Since(start)) / float64(time.Millisecond),
+		HeldMS:     float64(record.held) / float64(time.Millisecond),
+		Outcome:    record.outcome,
+		RequestID:  requestID(r),
+	}
+
+	if l.json {
+		line, _ := json.Marshal(entry)
+		l.write(append(line, '\n'))
+		return
+	}
+
+	// Combined format, followed by the hold time in seconds, what happened
+	// to the request and its ID
+	status, bytes := "-", "-"
+	if entry.Status != 0 {
+		status = strconv.Itoa(entry.Status)
+	}
+	if entry.Bytes > 0 {
+		bytes = strconv.FormatInt(entry.Bytes, 10)
+	}
+	outcome := entry.Outcome
+	if outcome == "" {
+		outcome = "-"
+	}
+	l.write([]byte(fmt.Sprintf("%s - %s [%s] %q %s %s %q %q held=%.3f outcome=%s request_id=%s\n",
+		host, dash(user), start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.RequestURI+" "+r.Proto, status, bytes, dash(entry.Referer), dash(entry.UserAgent),
+		record.held.Seconds(), outcome, dash(entry.RequestID))))
+}
+
+// dash returns value, or "-" for an empty one, as access logs show them.
+func dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// withAccessRecord attaches a new accessRecord to r when an access log is
+// kept.
+func (s *Server) withAccessRecord(r *http.Request) (*http.Request, *accessRecord) {
+	if s.accessLog == nil {
+		return r, nil
+	}
+	record := &accessRecord{}
+	return r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, record)), record
+}
+
+// set records the outcome of the request numbered id after it was held for
+// held.
+func (a *accessRecord) set(id int, held time.Duration, outcome string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.id, a.held, a.outcome = id, held, outcome
+}
+
+// requestAccessRecord returns the accessRecord attached to r, if any.
+func requestAccessRecord(r *http.Request) *accessRecord {
+	record, _ := r.Context().Value(accessRecordKey{}).(*accessRecord)
+	return record
+}
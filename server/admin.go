@@ -0,0 +1,319 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pendingInfo is the JSON representation of a held request in the admin API.
+type pendingInfo struct {
+	ID             int                `json:"id"`
+	Method         string             `json:"method"`
+	Path           string             `json:"path"`
+	RemoteAddr     string             `json:"remote_addr"`
+	ClientCert     string             `json:"client_cert,omitempty"`
+	ReceivedAt     time.Time          `json:"received_at"`
+	HeldFor        string             `json:"held_for"`
+	Partial        bool               `json:"partial,omitempty"`
+	Continue       bool               `json:"awaiting_continue,omitempty"`
+	BodyRead       *int64             `json:"awaiting_body_after,omitempty"`
+	Port           string             `json:"port,omitempty"`
+	Client         string             `json:"client"`
+	TraceID        string             `json:"trace_id,omitempty"`
+	Group          string             `json:"group,omitempty"`
+	RequestID      string             `json:"request_id,omitempty"`
+	Route          string             `json:"route,omitempty"`
+	GraphQL        []graphQLOperation `json:"graphql,omitempty"`
+	SOAPAction     string             `json:"soap_action,omitempty"`
+	DuplicateOf    int                `json:"duplicate_of,omitempty"`
+	IdempotencyKey string             `json:"idempotency_key,omitempty"`
+}
+
+func newPendingInfo(req *pendingRequest, now time.Time) pendingInfo {
+	info := pendingInfo{
+		ID:             req.id,
+		Method:         req.method,
+		Path:           req.path,
+		RemoteAddr:     req.remoteAddr,
+		ClientCert:     req.clientCert,
+		ReceivedAt:     req.requestTime.UTC(),
+		HeldFor:        now.Sub(req.requestTime).Round(time.Millisecond).String(),
+		Partial:        req.partial,
+		Continue:       req.awaitingContinue,
+		Port:           req.port,
+		Client:         req.client,
+		TraceID:        req.traceID,
+		Group:          req.group,
+		RequestID:      req.requestID,
+		Route:          routePath(req.route),
+		GraphQL:        req.graphQL,
+		SOAPAction:     req.soapAction,
+		DuplicateOf:    req.duplicateOf,
+		IdempotencyKey: req.idempotencyKey,
+	}
+	if req.awaitingBody {
+		bodyRead := req.bodyRead
+		info.BodyRead = &bodyRead
+	}
+	return info
+}
+
+// adminHandler returns the handler for the admin listener, which lets scripts
+// inspect and release pending requests without touching the terminal.
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pending", s.handlePending)
+	mux.HandleFunc("/pending/", s.handlePendingRequest)
+	mux.HandleFunc("/release", s.handleRelease)
+	mux.HandleFunc("/drop", s.handleDrop)
+	mux.HandleFunc("/reset", s.handleDrop)
+	mux.HandleFunc("/events", s.handleEvents)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/stats", s.handleStats)
+	mux.HandleFunc("/history", s.handleHistory)
+	mux.HandleFunc("/history/", s.handleHistoryEntry)
+	mux.HandleFunc("/history/export", s.handleHistoryExport)
+	mux.HandleFunc("/dashboard/stream", s.handleDashboardStream)
+	mux.HandleFunc("/", s.handleDashboard)
+	return mux
+}
+
+func (s *Server) handlePending(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	pending := make([]pendingInfo, 0)
+	for _, req := range s.snapshot() {
+		pending = append(pending, newPendingInfo(req, now))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"count":   len(pending),
+		"pending": pending,
+	})
+}
+
+// pendingDetail is the JSON representation of a single held request,
+// including everything captured from it.
+type pendingDetail struct {
+	pendingInfo
+	Headers       http.Header `json:"headers"`
+	Body          string      `json:"body"`
+	BodySize      int64       `json:"body_size"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+	Parts         []formPart  `json:"parts,omitempty"`
+	Protobuf      *protoBody  `json:"protobuf,omitempty"`
+}
+
+// handlePendingRequest serves GET /pending/<n>.
+func (s *Server) handlePendingRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/pending/"))
+	if err != nil {
+		http.Error(w, "expected /pending/<request number>", http.StatusBadRequest)
+		return
+	}
+	req := s.findPending(id)
+	if req == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("request #%d is not pending", id)})
+		return
+	}
+
+	parts, _ := req.formParts()
+	protobuf, _ := s.decodeProtoBody(req)
+	writeJSON(w, http.StatusOK, pendingDetail{
+		pendingInfo:   newPendingInfo(req, time.Now()),
+		Headers:       s.maskedHeaders(req.header),
+		Body:          string(req.body),
+		BodySize:      req.bodySize,
+		BodyTruncated: int64(len(req.body)) < req.bodySize,
+		Parts:         parts,
+		Protobuf:      protobuf,
+	})
+}
+
+func (s *Server) handleRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The query parameters mirror the console's release command
+	query := r.URL.Query()
+	var args []string
+	for _, option := range []string{"stagger", "jitter", "order"} {
+		if value := query.Get(option); value != "" {
+			args = append(args, "--"+option, value)
+		}
+	}
+	if id := query.Get("id"); id != "" {
+		args = append(args, id)
+	} else if port := query.Get("port"); port != "" {
+		args = append(args, ":"+port)
+	} else if client := query.Get("client"); client != "" {
+		args = append(args, "client", client)
+	} else if trace := query.Get("trace"); trace != "" {
+		args = append(args, "trace", trace)
+	} else if group := query.Get("group"); group != "" {
+		args = append(args, "group", group)
+	} else if operation := query.Get("operation"); operation != "" {
+		args = append(args, "op", operation)
+	} else if route := query.Get("route"); route != "" {
+		args = append(args, "route", route)
+	} else if path := query.Get("path"); path != "" {
+		args = append(args, path)
+	}
+
+	match, opts, err := parseReleaseArgs(args)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	released := s.releaseMatching(match, opts)
+	writeJSON(w, http.StatusOK, map[string]int{"released": released})
+}
+
+// handleDrop closes the connection of the request given by the id query
+// parameter without writing a response body. Served at /reset, it closes
+// the connection with a TCP RST instead.
+func (s *Server) handleDrop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "id query parameter must be a request number", http.StatusBadRequest)
+		return
+	}
+	if s.dropMatching(matchID(id), r.URL.Path == "/reset") == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("request #%d is not pending", id)})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"dropped": 1})
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	entries := make([]*historyEntry, 0)
+	if s.history != nil {
+		entries = append(entries, s.history.list()...)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"count":   len(entries),
+		"history": entries,
+	})
+}
+
+// handleHistoryEntry serves GET /history/<n>, including the request body.
+func (s *Server) handleHistoryEntry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/history/"))
+	if err != nil {
+		http.Error(w, "expected /history/<request number>", http.StatusBadRequest)
+		return
+	}
+	var entry *historyEntry
+	if s.history != nil {
+		entry = s.history.find(id)
+	}
+	if entry == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("request #%d is not in the history", id)})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		*historyEntry
+		Headers http.Header `json:"headers"`
+		Body    string      `json:"body"`
+	}{entry, s.maskedHeaders(entry.Header), string(entry.Body)})
+}
+
+// handleHistoryExport serves GET /history/export?format=har, the history as
+// a HAR file for browser dev tools, or ?format=sql, as SQL for sqlite3.
+func (s *Server) handleHistoryExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "har":
+	case "sql":
+		if s.history == nil {
+			http.Error(w, "history is disabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/sql")
+		w.Header().Set("Content-Disposition", `attachment; filename="history.sql"`)
+		s.writeSQL(w)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("unsupported export format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", `attachment; filename="history.har"`)
+	writeJSON(w, http.StatusOK, s.buildHAR())
+}
+
+// handleStats reports runtime statistics alongside the queue size, to spot
+// goroutine or memory leaks from abandoned requests.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"goroutines":       runtime.NumGoroutine(),
+		"pending":          len(s.snapshot()),
+		"served":           s.served.Load(),
+		"uptime":           time.Since(s.startTime).Round(time.Second).String(),
+		"heap_alloc_bytes": mem.HeapAlloc,
+		"heap_objects":     mem.HeapObjects,
+		"sys_bytes":        mem.Sys,
+		"num_gc":           mem.NumGC,
+		"session":          s.stats.summary(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const adminCtlHelp = `Commands (ctl -addr <admin address>):
+  pending                  List pending requests
+  pending <n>              Show request #n with its headers and body as JSON
+  release [<target>]       Release all pending requests, or only the target:
+                           <n>, :<port>, client <c>, trace <id>, group <g>,
+                           op <name>, route <route> or a path
+      --stagger <d>        ...one at a time, <d> apart
+      --jitter <min>-<max> ...each after a random delay in the range
+      --order lifo|random  ...newest first or shuffled
+  drop <n>                 Close request #n's connection without a body
+  reset <n>                Abort request #n's connection with a TCP RST`
+
+// adminClient calls the admin API of a server that may be remote or in a
+// container, for the ctl subcommand.
+type adminClient struct {
+	base   string
+	client *http.Client
+}
+
+// newAdminClient returns a client for the admin API at addr: a port
+// (":9090"), host:port or a URL.
+func newAdminClient(addr string) (*adminClient, error) {
+	base := addr
+	if !strings.Contains(base, "://") {
+		if strings.HasPrefix(base, ":") {
+			base = "localhost" + base
+		}
+		base = "http://" + base
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid admin address %q", addr)
+	}
+	return &adminClient{
+		base:   strings.TrimSuffix(u.String(), "/"),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// call sends a request to the admin API and decodes its JSON response into
+// v. Error responses are returned as errors.
+func (c *adminClient) call(method, path string, query url.Values, v interface{}) error {
+	target := c.base + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &failure) == nil && failure.Error != "" {
+			return fmt.Errorf("%s", failure.Error)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// runAdminCtl runs one ctl command against the admin API at addr and returns
+// the process exit code.
+func runAdminCtl(addr string, args []string) int {
+	if len(args) == 0 || args[0] == "help" {
+		fmt.Println(adminCtlHelp)
+		if len(args) == 0 {
+			return 2
+		}
+		return 0
+	}
+	client, err := newAdminClient(addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ctl: %v\n", err)
+		return 2
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "pending", "list":
+		err = client.pending(os.Stdout, args)
+	case "release":
+		err = client.release(os.Stdout, args)
+	case "drop", "reset":
+		err = client.drop(os.Stdout, cmd, args)
+	default:
+		fmt.Fprintf(os.Stderr, "ctl: unknown command %q\n%s\n", cmd, adminCtlHelp)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ctl: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// pending lists pending requests, or shows one as indented JSON.
+func (c *adminClient) pending(out io.Writer, args []string) error {
+	switch len(args) {
+	case 0:
+	case 1:
+		id, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+		if err != nil {
+			return fmt.Errorf("invalid request number %q", args[0])
+		}
+		var detail json.RawMessage
+		if err := c.call(http.MethodGet, "/pending/"+strconv.Itoa(id), nil, &detail); err != nil {
+			return err
+		}
+		var indented bytes.Buffer
+		json.Indent(&indented, detail, "", "  ")
+		fmt.Fprintln(out, indented.String())
+		return nil
+	default:
+		return fmt.Errorf("expected pending [<n>]")
+	}
+
+	var list struct {
+		Count   int           `json:"count"`
+		Pending []pendingInfo `json:"pending"`
+	}
+	if err := c.call(http.MethodGet, "/pending", nil, &list); err != nil {
+		return err
+	}
+	if list.Count == 0 {
+		fmt.Fprintln(out, "No pending requests")
+		return nil
+	}
+	fmt.Fprintf(out, "Pending requests: %d\n", list.Count)
+	fmt.Fprintf(out, "  %-5s %6s %-7s %-30s %s\n", "#", "AGE", "METHOD", "PATH", "CLIENT")
+	for _, info := range list.Pending {
+		var port string
+		if info.Port != "" {
+			port = " on :" + info.Port
+		}
+		heldFor, _ := time.ParseDuration(info.HeldFor)
+		fmt.Fprintf(out, "  %-5s %6s %-7s %-30s from %s%s\n",
+			"#"+strconv.Itoa(info.ID), heldFor.Round(time.Second), info.Method, info.Path, info.RemoteAddr, port)
+		if info.Route != "" {
+			fmt.Fprintf(out, "        route %s\n", info.Route)
+		}
+	}
+	return nil
+}
+
+// release releases pending requests, taking the arguments of the console's
+// release command and sending them as the admin API's query parameters.
+func (c *adminClient) release(out io.Writer, args []string) error {
+	query := url.Values{}
+	var targets []string
+	for i := 0; i < len(args); i++ {
+		switch option := strings.TrimPrefix(args[i], "--"); {
+		case option != args[i] && (option == "stagger" || option == "jitter" || option == "order"):
+			if i+1 >= len(args) {
+				return fmt.Errorf("--%s requires a value", option)
+			}
+			i++
+			query.Set(option, args[i])
+		default:
+			targets = append(targets, args[i])
+		}
+	}
+
+	params := map[string]string{"client": "client", "trace": "trace", "group": "group", "op": "operation", "route": "route"}
+	switch {
+	case len(targets) == 0 || len(targets) == 1 && targets[0] == "all":
+	case len(targets) == 2 && params[targets[0]] != "":
+		query.Set(params[targets[0]], targets[1])
+	case len(targets) == 1:
+		target := strings.TrimPrefix(targets[0], "#")
+		if _, err := strconv.Atoi(target); err == nil {
+			query.Set("id", target)
+		} else if strings.HasPrefix(target, ":") {
+			query.Set("port", target[1:])
+		} else {
+			query.Set("path", target)
+		}
+	default:
+		return fmt.Errorf("expected at most one target, got %q", strings.Join(targets, " "))
+	}
+
+	var result struct {
+		Released int `json:"released"`
+	}
+	if err := c.call(http.MethodPost, "/release", query, &result); err != nil {
+		return err
+	}
+	if result.Released == 0 {
+		fmt.Fprintln(out, "No matching pending requests")
+	} else {
+		fmt.Fprintf(out, "Released %d request(s)\n", result.Released)
+	}
+	return nil
+}
+
+// drop closes (cmd "drop") or resets (cmd "reset") a pending request's
+// connection.
+func (c *adminClient) drop(out io.Writer, cmd string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected %s <n>", cmd)
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	if err != nil {
+		return fmt.Errorf("invalid request number %q", args[0])
+	}
+	var result map[string]int
+	if err := c.call(http.MethodPost, "/"+cmd, url.Values{"id": {strconv.Itoa(id)}}, &result); err != nil {
+		return err
+	}
+	if cmd == "reset" {
+		fmt.Fprintf(out, "Reset request #%d\n", id)
+	} else {
+		fmt.Fprintf(out, "Dropped request #%d\n", id)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// HeldRequest describes a request the server is holding. It is passed to
+// Server.OnHold and returned by Server.Pending so that embedding code (such
+// as an integration test) can implement its own gating policy, e.g. "release
+// request 3 only after request 5 has arrived".
+type HeldRequest struct {
+	ID         int
+	Method     string
+	Path       string
+	RemoteAddr string
+	Header     http.Header
+	Body       []byte
+	ReceivedAt time.Time
+}
+
+func newHeldRequest(req *pendingRequest) HeldRequest {
+	return HeldRequest{
+		ID:         req.id,
+		Method:     req.method,
+		Path:       req.path,
+		RemoteAddr: req.remoteAddr,
+		Header:     req.header,
+		Body:       req.body,
+		ReceivedAt: req.requestTime,
+	}
+}
+
+// Release releases the held request with the given ID, reporting whether it
+// was pending.
+func (s *Server) Release(id int) bool {
+	return s.releaseByID(id)
+}
+
+// ReleaseAll releases every held request and returns how many there were.
+func (s *Server) ReleaseAll() int {
+	return s.releaseAll()
+}
+
+// Drop closes the connection of the held request with the given ID without
+// sending a response body, reporting whether it was pending.
+func (s *Server) Drop(id int) bool {
+	return s.dropByID(id)
+}
+
+// Pending returns the currently held requests in arrival order.
+func (s *Server) Pending() []HeldRequest {
+	pending := s.snapshot()
+	held := make([]HeldRequest, len(pending))
+	for i, req := range pending {
+		held[i] = newHeldRequest(req)
+	}
+	return held
+}
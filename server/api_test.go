@@ -0,0 +1,78 @@
+package server_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"variable-debug-web-server/server"
+)
+
+// TestOnHoldGating releases the third request only once the fifth has
+// arrived, the kind of policy OnHold is for.
+func TestOnHoldGating(t *testing.T) {
+	s := server.NewServer()
+	held := make(chan int, 5)
+	s.OnHold = func(req server.HeldRequest) {
+		if req.ID == 5 && !s.Release(3) {
+			t.Error("request #3 was not pending when #5 arrived")
+		}
+		held <- req.ID
+	}
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	defer s.ReleaseAll()
+
+	answered := make(chan string, 5)
+	for i := 1; i <= 5; i++ {
+		path := fmt.Sprintf("/request/%d", i)
+		go func() {
+			// Headers are sent at once; the body waits for the release
+			resp, err := http.Get(ts.URL + path)
+			if err == nil {
+				_, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			if err != nil {
+				t.Error(err)
+			}
+			answered <- path
+		}()
+
+		// One at a time, so that the requests are numbered in order
+		select {
+		case id := <-held:
+			if id != i {
+				t.Fatalf("%s was held as #%d", path, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was not held", path)
+		}
+	}
+
+	select {
+	case path := <-answered:
+		if path != "/request/3" {
+			t.Fatalf("%s was answered first, want /request/3", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request was answered after #5 arrived")
+	}
+	if pending := s.Pending(); len(pending) != 4 {
+		t.Fatalf("%d requests pending after releasing #3, want 4", len(pending))
+	}
+
+	if n := s.ReleaseAll(); n != 4 {
+		t.Fatalf("ReleaseAll released %d requests, want 4", n)
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-answered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("not every request was answered after ReleaseAll")
+		}
+	}
+}
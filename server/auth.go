@@ -0,0 +1,158 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// authSeenLimit is how many clients expireFirst remembers; the oldest are
+// forgotten first, and get an expired token again on their next request.
+const authSeenLimit = 1000
+
+// credential is one accepted Basic or Bearer credential.
+type credential struct {
+	scheme   string // "basic" or "bearer"
+	user     string
+	password string
+	token    string
+}
+
+// authConfig checks requests against the AUTH credentials. Requests without
+// credentials get 401 and a WWW-Authenticate challenge; requests with wrong
+// ones get 403.
+type authConfig struct {
+	credentials []credential
+
+	// hold makes failures wait for release like any other response instead
+	// of being answered at once.
+	hold bool
+
+	// expireFirst answers each client's first correctly authenticated
+	// request with an expired-token 401, so that it has to refresh and retry.
+	expireFirst bool
+
+	mu    sync.Mutex
+	seen  map[string]bool
+	order []string
+}
+
+// authFailure is the response to a request that failed authentication.
+type authFailure struct {
+	status    int
+	challenge string
+	message   string
+}
+
+// parseAuth parses AUTH, a comma-separated list of "basic:user:password" and
+// "bearer:token" credentials.
+func parseAuth(spec string) (*authConfig, error) {
+	auth := &authConfig{seen: make(map[string]bool)}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		scheme, rest, _ := strings.Cut(entry, ":")
+		switch strings.ToLower(scheme) {
+		case "basic":
+			user, password, ok := strings.Cut(rest, ":")
+			if !ok || user == "" {
+				return nil, fmt.Errorf("invalid AUTH entry %q (want basic:user:password)", entry)
+			}
+			auth.credentials = append(auth.credentials, credential{scheme: "basic", user: user, password: password})
+		case "bearer":
+			if rest == "" {
+				return nil, fmt.Errorf("invalid AUTH entry %q (want bearer:token)", entry)
+			}
+			auth.credentials = append(auth.credentials, credential{scheme: "bearer", token: rest})
+		default:
+			return nil, fmt.Errorf("invalid AUTH entry %q (want basic:user:password or bearer:token)", entry)
+		}
+	}
+	if len(auth.credentials) == 0 {
+		return nil, fmt.Errorf("AUTH has no credentials")
+	}
+	return auth, nil
+}
+
+// challenge is the WWW-Authenticate header for the configured schemes.
+func (a *authConfig) challenge() string {
+	var basic, bearer bool
+	for _, c := range a.credentials {
+		basic = basic || c.scheme == "basic"
+		bearer = bearer || c.scheme == "bearer"
+	}
+	var challenges []string
+	if basic {
+		challenges = append(challenges, `Basic realm="variable-debug-web-server"`)
+	}
+	if bearer {
+		challenges = append(challenges, `Bearer realm="variable-debug-web-server"`)
+	}
+	return strings.Join(challenges, ", ")
+}
+
+// check authenticates r from client, returning nil if it may proceed.
+func (a *authConfig) check(r *http.Request, client string) *authFailure {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return &authFailure{http.StatusUnauthorized, a.challenge(), "authentication required"}
+	}
+
+	scheme, _, _ := strings.Cut(header, " ")
+	if !a.valid(r) {
+		if strings.EqualFold(scheme, "bearer") {
+			return &authFailure{http.StatusForbidden, `Bearer error="invalid_token"`, "invalid token"}
+		}
+		return &authFailure{http.StatusForbidden, "", "invalid credentials"}
+	}
+
+	if a.expireFirst {
+		a.mu.Lock()
+		first := !a.seen[client]
+		if first {
+			a.seen[client] = true
+			a.order = append(a.order, client)
+			if len(a.order) > authSeenLimit {
+				delete(a.seen, a.order[0])
+				a.order = a.order[1:]
+			}
+		}
+		a.mu.Unlock()
+		if first {
+			return &authFailure{http.StatusUnauthorized,
+				`Bearer error="invalid_token", error_description="The access token expired"`, "token expired"}
+		}
+	}
+	return nil
+}
+
+// valid reports whether r carries one of the configured credentials.
+func (a *authConfig) valid(r *http.Request) bool {
+	user, password, hasBasic := r.BasicAuth()
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	hasBearer := strings.EqualFold(scheme, "bearer")
+
+	for _, c := range a.credentials {
+		switch {
+		case c.scheme == "basic" && hasBasic:
+			if subtle.ConstantTimeCompare([]byte(user), []byte(c.user)) == 1 &&
+				subtle.ConstantTimeCompare([]byte(password), []byte(c.password)) == 1 {
+				return true
+			}
+		case c.scheme == "bearer" && hasBearer:
+			if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(c.token)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// body is the JSON error body sent with the failure.
+func (f *authFailure) body() []byte {
+	return []byte(fmt.Sprintf("{\"error\":%q}\n", f.message))
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// parseBodyHold parses HOLD_BODY_READ: "before" holds requests before any of
+// their body is read, and a size such as 64K holds them once that much has
+// been read. It returns the number of bytes to read first, or -1 if body
+// reads are not held.
+func parseBodyHold(value string) (int64, error) {
+	switch value {
+	case "":
+		return -1, nil
+	case "before":
+		return 0, nil
+	}
+	size, err := parseByteSize(value)
+	if err != nil || size <= 0 {
+		return -1, fmt.Errorf("invalid HOLD_BODY_READ %q (want before or a size such as 64K)", value)
+	}
+	return size, nil
+}
+
+// holdBodyRead holds req part-way into reading body, after the first
+// s.holdBodyAfter bytes, so that the client's upload stalls once the
+// connection's buffers are full. On release it returns the whole body for
+// reading and the request goes on to be held again for its response; if the
+// release drops or answers it instead, it reports false and the response has
+// been written.
+func (s *Server) holdBodyRead(w http.ResponseWriter, r *http.Request, req *pendingRequest, body io.Reader) (io.Reader, bool) {
+	var prefix []byte
+	if s.holdBodyAfter > 0 {
+		var err error
+		prefix, err = io.ReadAll(io.LimitReader(body, s.holdBodyAfter))
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+
+	req.awaitingBody = true
+	req.bodyRead = int64(len(prefix))
+	stopTimeout := s.hold(req)
+	released := s.waitForRelease(r.Context(), req)
+	stopTimeout()
+	req.awaitingBody = false
+	if !released {
+		return nil, false
+	}
+	if req.dropped {
+		s.abortResponse(w, req)
+		return nil, false
+	}
+	if req.releaseStatus != 0 {
+		req.status = req.releaseStatus
+		s.logReleased(req, fmt.Sprintf("Answered with %d before reading the body", req.releaseStatus))
+		w.Header().Set("Connection", "close")
+		s.answerStatus(w, req)
+		return nil, false
+	}
+
+	s.logRequest(req, "body", "Reading the rest of the body after waiting %s", time.Since(req.requestTime))
+	req.responseChan = make(chan struct{})
+	req.releaseCause = ""
+	return io.MultiReader(bytes.NewReader(prefix), body), true
+}
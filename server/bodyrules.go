@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// bodyRule decides how to handle requests by the content of their JSON body,
+// e.g. ".amount > 1000 => hold". The first matching BODY_RULES entry wins.
+type bodyRule struct {
+	spec string
+
+	// path is the jq-like path of the field tested (see queryJSON), or ""
+	// for the catch-all "*".
+	path  string
+	op    string
+	value interface{}
+	re    *regexp.Regexp
+
+	decision scriptDecision
+}
+
+// bodyCondition splits a condition into path, operator and value.
+var bodyCondition = regexp.MustCompile(`^(\.[^\s=!<>~]*)\s*(==|!=|>=|<=|>|<|=~|exists)\s*(.*)$`)
+
+// parseBodyRules parses a semicolon-separated BODY_RULES list. Each entry is
+// "<condition> => <action>", where the condition compares a field of the JSON
+// body with ==, !=, <, <=, >, >= or =~ (a regular expression), tests it with
+// "exists", or is "*" to match any request. Values are JSON literals; bare
+// words are strings. Actions are hold, pass, fail [status] (default 500),
+// delay <duration>, drop and reset:
+//
+//	.amount > 1000 => hold; .currency == "XXX" => fail 422; * => pass
+func parseBodyRules(spec string) ([]bodyRule, error) {
+	var rules []bodyRule
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		condition, action, ok := strings.Cut(entry, "=>")
+		if !ok {
+			return nil, fmt.Errorf("invalid body rule %q (want \"<condition> => <action>\")", entry)
+		}
+		rule := bodyRule{spec: entry}
+		if err := rule.parseCondition(strings.TrimSpace(condition)); err != nil {
+			return nil, fmt.Errorf("invalid body rule %q: %v", entry, err)
+		}
+		if err := rule.parseAction(strings.Fields(action)); err != nil {
+			return nil, fmt.Errorf("invalid body rule %q: %v", entry, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule *bodyRule) parseCondition(condition string) error {
+	if condition == "*" {
+		return nil
+	}
+	m := bodyCondition.FindStringSubmatch(condition)
+	if m == nil {
+		return fmt.Errorf("condition %q must be *, or a path such as .amount, an operator and a value", condition)
+	}
+	rule.path, rule.op = m[1], m[2]
+	literal := strings.TrimSpace(m[3])
+	switch rule.op {
+	case "exists":
+		if literal != "" {
+			return fmt.Errorf("exists takes no value")
+		}
+		return nil
+	case "=~":
+		pattern := literal
+		if unquoted, err := strconv.Unquote(literal); err == nil {
+			pattern = unquoted
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		rule.re = re
+		return nil
+	}
+	if literal == "" {
+		return fmt.Errorf("missing value after %s", rule.op)
+	}
+	if err := json.Unmarshal([]byte(literal), &rule.value); err != nil {
+		rule.value = literal
+	}
+	if number, ok := rule.value.(float64); ok {
+		rule.value = json.Number(strconv.FormatFloat(number, 'f', -1, 64))
+	}
+	return nil
+}
+
+func (rule *bodyRule) parseAction(fields []string) error {
+	if len(fields) == 0 {
+		return fmt.Errorf("missing action")
+	}
+	action, args := fields[0], fields[1:]
+	switch action {
+	case "hold", "drop", "reset":
+		rule.decision.Action = action
+	case "pass":
+		rule.decision.Action = "respond"
+	case "fail":
+		rule.decision.Action = "respond"
+		rule.decision.Status = 500
+		if len(args) > 0 {
+			status, err := parseStatus(args[0])
+			if err != nil {
+				return err
+			}
+			rule.decision.Status = status
+			args = args[1:]
+		}
+	case "delay":
+		if len(args) == 0 {
+			return fmt.Errorf("delay needs a duration such as 2s")
+		}
+		if _, err := parseDelay(args[0]); err != nil {
+			return err
+		}
+		rule.decision.Action, rule.decision.Delay = "delay", args[0]
+		args = args[1:]
+	default:
+		return fmt.Errorf("unknown action %q (want hold, pass, fail, delay, drop or reset)", action)
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected %q after %s", strings.Join(args, " "), action)
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to a body decoded as doc. Only
+// the catch-all matches bodies that are not JSON (isJSON false).
+func (rule bodyRule) matches(doc interface{}, isJSON bool) bool {
+	if rule.path == "" {
+		return true
+	}
+	if !isJSON {
+		return false
+	}
+	value, err := queryJSON(doc, rule.path)
+	if err != nil {
+		return false
+	}
+	switch rule.op {
+	case "exists":
+		return true
+	case "=~":
+		text, ok := value.(string)
+		if !ok {
+			data, _ := json.Marshal(value)
+			text = string(data)
+		}
+		return rule.re.MatchString(text)
+	case "==":
+		return compareJSON(value, rule.value) == 0
+	case "!=":
+		return compareJSON(value, rule.value) != 0
+	}
+
+	// Ordering only applies to two numbers or two strings
+	_, number := value.(json.Number)
+	_, wantNumber := rule.value.(json.Number)
+	_, text := value.(string)
+	_, wantText := rule.value.(string)
+	if !(number && wantNumber || text && wantText) {
+		return false
+	}
+	c := compareJSON(value, rule.value)
+	switch rule.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+// compareJSON orders two decoded JSON values: numerically for numbers,
+// lexically for strings, and otherwise only by equality (0 or 1).
+func compareJSON(a, b interface{}) int {
+	if x, ok := a.(json.Number); ok {
+		if y, ok := b.(json.Number); ok {
+			fx, _ := x.Float64()
+			fy, _ := y.Float64()
+			switch {
+			case fx < fy:
+				return -1
+			case fx > fy:
+				return 1
+			}
+			return 0
+		}
+	}
+	if x, ok := a.(string); ok {
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y)
+		}
+	}
+	da, _ := json.Marshal(a)
+	db, _ := json.Marshal(b)
+	if bytes.Equal(da, db) {
+		return 0
+	}
+	return 1
+}
+
+// matchBodyRule returns the first BODY_RULES entry that applies to req.
+func (s *Server) matchBodyRule(req *pendingRequest) (bodyRule, bool) {
+	s.configMu.RLock()
+	rules := s.bodyRules
+	s.configMu.RUnlock()
+	if len(rules) == 0 {
+		return bodyRule{}, false
+	}
+
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(req.body))
+	decoder.UseNumber()
+	isJSON := int64(len(req.body)) == req.bodySize && decoder.Decode(&doc) == nil
+	for _, rule := range rules {
+		if rule.matches(doc, isJSON) {
+			return rule, true
+		}
+	}
+	return bodyRule{}, false
+}
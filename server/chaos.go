@@ -0,0 +1,122 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// chaosFault is one outcome of the CHAOS mix with its relative weight.
+type chaosFault struct {
+	name     string
+	weight   float64
+	decision scriptDecision
+}
+
+// chaosMix draws a fault for each request at random, in proportion to the
+// weights, turning the server into a general chaos backend.
+type chaosMix struct {
+	faults []chaosFault
+	total  float64
+}
+
+// Defaults for faults given without an argument.
+const (
+	defaultChaosDelay    = "1s"
+	defaultChaosDripRate = "10"
+)
+
+// parseChaos parses CHAOS, a comma-separated list of fault=weight entries.
+// Faults are hold, delay[:<duration>], a status code such as 500, reset, drop,
+// slow-body[:<bytes per second>] and pass; weights are relative:
+//
+//	hold=10,delay:2s=20,500=10,reset=5,slow-body=10,pass=45
+func parseChaos(spec string) (*chaosMix, error) {
+	mix := &chaosMix{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid CHAOS entry %q (want fault=weight)", entry)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "%")), 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid CHAOS weight in %q", entry)
+		}
+		fault, err := parseChaosFault(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		fault.weight = weight
+		mix.faults = append(mix.faults, fault)
+		mix.total += weight
+	}
+	if mix.total <= 0 {
+		return nil, fmt.Errorf("invalid CHAOS %q: no fault has a weight", spec)
+	}
+	return mix, nil
+}
+
+func parseChaosFault(name string) (chaosFault, error) {
+	fault := chaosFault{name: name}
+	kind, arg, hasArg := strings.Cut(name, ":")
+	switch kind {
+	case "hold", "reset", "drop":
+		fault.decision.Action = kind
+	case "pass":
+		fault.decision.Action = "respond"
+	case "delay":
+		if !hasArg {
+			arg, fault.name = defaultChaosDelay, "delay:"+defaultChaosDelay
+		}
+		if _, err := parseDelay(arg); err != nil {
+			return fault, fmt.Errorf("invalid CHAOS delay %q", arg)
+		}
+		fault.decision.Action, fault.decision.Delay = "delay", arg
+		return fault, nil
+	case "slow-body":
+		if !hasArg {
+			arg, fault.name = defaultChaosDripRate, "slow-body:"+defaultChaosDripRate
+		}
+		if rate, err := parseByteSize(arg); err != nil || rate <= 0 {
+			return fault, fmt.Errorf("invalid CHAOS slow-body rate %q", arg)
+		}
+		fault.decision.Action, fault.decision.DripRate = "respond", arg
+		return fault, nil
+	default:
+		status, err := parseStatus(kind)
+		if err != nil {
+			return fault, fmt.Errorf("unknown CHAOS fault %q (want hold, delay, a status, reset, drop, slow-body or pass)", name)
+		}
+		fault.decision.Action, fault.decision.Status = "respond", status
+	}
+	if hasArg {
+		return fault, fmt.Errorf("CHAOS fault %q takes no argument", kind)
+	}
+	return fault, nil
+}
+
+// draw picks a fault at random by weight.
+func (mix *chaosMix) draw() chaosFault {
+	n := rand.Float64() * mix.total
+	for _, fault := range mix.faults {
+		if n < fault.weight {
+			return fault
+		}
+		n -= fault.weight
+	}
+	return mix.faults[len(mix.faults)-1]
+}
+
+// String describes the mix as percentages, for the startup banner.
+func (mix *chaosMix) String() string {
+	parts := make([]string, 0, len(mix.faults))
+	for _, fault := range mix.faults {
+		parts = append(parts, fmt.Sprintf("%s %.3g%%", fault.name, fault.weight/mix.total*100))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,497 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const commandHelp = `Commands:
+  <ENTER>                  Release all pending requests (and emit an SSE event)
+  <n>                      Release pending request #n
+  list [<target>]          List pending requests (targets as for release)
+  count [<target>]         Show the number of pending requests
+  clients                  List pending requests grouped by client
+  release all              Release all pending requests
+  release <n>              Release pending request #n
+  release :<port>          Release requests received on a port (PORTS)
+  release client <c>       Release requests from one client (IP, CLIENT_HEADER
+                           or SESSION_COOKIE name=value)
+  release trace <id>       Release requests of a trace (ID prefix)
+  release group <name>     Release requests tagged ?group=<name> or X-Debug-Group
+  release op <name>        Release GraphQL requests running this operation
+  release route <route>    Release requests answered by a ROUTES_FILE route,
+                           e.g. release route /payments
+  release <path>           Release requests matching a path prefix or glob
+      --stagger <d>        ...one at a time, <d> apart
+      --jitter <min>-<max> ...each after a random delay in the range
+      --order lifo|random  ...newest first or shuffled (default RELEASE_ORDER)
+  order <n> <m> ...        Send the responses of the next release including
+                           these requests in this order, one after another
+  order clear              Forget the order
+  end [<target>]           Send the rest of chunked bodies (CHUNK_SIZE) and finish
+  show <n>                 Show request #n's headers, form parts and body
+      --jq <path>          ...or only this part of its JSON body, e.g.
+                           .items[0].id
+  diff <n> <m>             Compare the query, headers and body of two requests
+  drop <n>                 Close request #n's connection without a body
+  reset <n>                Abort request #n's connection with a TCP RST
+  emit [data]              Send an event to all SSE streams (SSE=1)
+  scenario                 Show the current scenario step
+  history                  List recently completed requests
+  stats                    Show totals, hold times, paths and peak pending
+  replay <n>               Re-send completed request #n to the upstream
+  export har <file>        Write the history to file in HAR format
+  export sql <file>        Write the history as SQL statements for sqlite3
+  help                     Show this help`
+
+// execute runs a single line of console input.
+func (s *Server) execute(out io.Writer, line string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		released := s.releaseAll()
+		if s.sse != nil {
+			s.emitEvent(out, "")
+		} else if released == 0 {
+			fmt.Fprintln(out, "No pending requests")
+		}
+		return
+	}
+
+	switch cmd, args := fields[0], fields[1:]; cmd {
+	case "list", "ls":
+		match, err := parseTargetArgs(args)
+		if err != nil {
+			fmt.Fprintf(out, "Invalid list command: %v\n", err)
+			return
+		}
+		s.printPending(out, match)
+	case "count":
+		match, err := parseTargetArgs(args)
+		if err != nil {
+			fmt.Fprintf(out, "Invalid count command: %v\n", err)
+			return
+		}
+		fmt.Fprintf(out, "Pending requests: %d\n", s.countPending(match))
+	case "clients":
+		s.printClients(out)
+	case "release":
+		match, opts, err := parseReleaseArgs(args)
+		if err != nil {
+			fmt.Fprintf(out, "Invalid release command: %v\n", err)
+			return
+		}
+		if s.releaseMatching(match, opts) == 0 {
+			fmt.Fprintln(out, "No matching pending requests")
+		}
+	case "order":
+		switch {
+		case len(args) == 0:
+			s.printSequence(out)
+			return
+		case len(args) == 1 && args[0] == "clear":
+			s.mu.Lock()
+			s.sequence = nil
+			s.mu.Unlock()
+			fmt.Fprintln(out, "Response order cleared")
+			return
+		case len(args) < 2:
+			fmt.Fprintln(out, "Usage: order <n> <m> ... | order clear")
+			return
+		}
+		ids := make([]int, len(args))
+		for i, arg := range args {
+			id, err := strconv.Atoi(strings.TrimPrefix(arg, "#"))
+			if err != nil {
+				fmt.Fprintf(out, "Invalid request number %q\n", arg)
+				return
+			}
+			ids[i] = id
+		}
+		if err := s.setSequence(ids); err != nil {
+			fmt.Fprintf(out, "Invalid order command: %v\n", err)
+			return
+		}
+		s.printSequence(out)
+	case "end":
+		match, err := parseTargetArgs(args)
+		if err != nil {
+			fmt.Fprintf(out, "Invalid end command: %v\n", err)
+			return
+		}
+		if s.releaseMatching(match, releaseOptions{finish: true}) == 0 {
+			fmt.Fprintln(out, "No matching pending requests")
+		}
+	case "show":
+		var query string
+		switch {
+		// Quoted field names may contain spaces
+		case len(args) >= 3 && args[1] == "--jq":
+			query = strings.Join(args[2:], " ")
+		case len(args) >= 2 && strings.HasPrefix(args[1], "--jq="):
+			query = strings.TrimPrefix(strings.Join(args[1:], " "), "--jq=")
+		case len(args) != 1:
+			fmt.Fprintln(out, "Usage: show <n> [--jq <path>]")
+			return
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(out, "Invalid request number %q\n", args[0])
+			return
+		}
+		req := s.findPending(id)
+		if req == nil {
+			fmt.Fprintf(out, "Request #%d is not pending\n", id)
+			return
+		}
+		if query == "" {
+			s.printRequest(out, req)
+			return
+		}
+		result, err := queryBody(req, query)
+		if err != nil {
+			fmt.Fprintf(out, "Request #%d: %v\n", id, err)
+			return
+		}
+		fmt.Fprintln(out, result)
+	case "diff":
+		if len(args) != 2 {
+			fmt.Fprintln(out, "Usage: diff <n> <m>")
+			return
+		}
+		var reqs [2]*capturedRequest
+		for i, arg := range args {
+			id, err := strconv.Atoi(strings.TrimPrefix(arg, "#"))
+			if err != nil {
+				fmt.Fprintf(out, "Invalid request number %q\n", arg)
+				return
+			}
+			req, ok := s.findCaptured(id)
+			if !ok {
+				fmt.Fprintf(out, "Request #%d is neither pending nor in the history\n", id)
+				return
+			}
+			reqs[i] = req
+		}
+		lines := s.diffRequests(reqs[0], reqs[1])
+		if len(lines) == 0 {
+			fmt.Fprintf(out, "Requests #%s and #%s are identical\n", args[0], args[1])
+			return
+		}
+		fmt.Fprintf(out, "Differences from #%s (-) to #%s (+):\n", strings.TrimPrefix(args[0], "#"), strings.TrimPrefix(args[1], "#"))
+		for _, line := range lines {
+			fmt.Fprintln(out, "  "+line)
+		}
+	case "scenario":
+		if s.scenario == nil {
+			fmt.Fprintln(out, "No scenario loaded (set SCENARIO_FILE)")
+			return
+		}
+		fmt.Fprintln(out, s.scenario.status())
+	case "stats":
+		s.printStats(out)
+	case "history":
+		if s.history == nil {
+			fmt.Fprintln(out, "History is disabled (HISTORY_SIZE=0)")
+			return
+		}
+		s.printHistory(out)
+	case "replay":
+		if len(args) != 1 {
+			fmt.Fprintln(out, "Usage: replay <n>")
+			return
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(out, "Invalid request number %q\n", args[0])
+			return
+		}
+		var entry *historyEntry
+		if s.history != nil {
+			entry = s.history.find(id)
+		}
+		if entry == nil {
+			fmt.Fprintf(out, "Request #%d is not in the history\n", id)
+			return
+		}
+		resp, body, err := s.replay(entry)
+		if err != nil {
+			fmt.Fprintf(out, "Replay of request #%d failed: %v\n", id, err)
+			return
+		}
+		fmt.Fprintf(out, "Replayed request #%d: %s %s -> %s (%d bytes)\n", id, entry.Method, entry.Path, resp.Status, len(body))
+	case "export":
+		if len(args) != 2 || (args[0] != "har" && args[0] != "sql") {
+			fmt.Fprintln(out, "Usage: export har|sql <file>")
+			return
+		}
+		if s.history == nil {
+			fmt.Fprintln(out, "History is disabled (HISTORY_SIZE=0)")
+			return
+		}
+		var count int
+		var err error
+		if args[0] == "har" {
+			count, err = s.writeHAR(args[1])
+		} else {
+			count, err = s.writeSQLFile(args[1])
+		}
+		if err != nil {
+			fmt.Fprintf(out, "Export failed: %v\n", err)
+			return
+		}
+		fmt.Fprintf(out, "Wrote %d request(s) to %s\n", count, args[1])
+	case "drop", "reset":
+		if len(args) != 1 {
+			fmt.Fprintf(out, "Usage: %s <n>\n", cmd)
+			return
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(out, "Invalid request number %q\n", args[0])
+			return
+		}
+		if s.dropMatching(matchID(id), cmd == "reset") == 0 {
+			fmt.Fprintf(out, "Request #%d is not pending\n", id)
+		}
+	case "emit":
+		if s.sse == nil {
+			fmt.Fprintln(out, "SSE is not enabled (start with SSE=1)")
+			return
+		}
+		s.emitEvent(out, strings.Join(args, " "))
+	case "help", "?":
+		fmt.Fprintln(out, commandHelp)
+	default:
+		id, err := strconv.Atoi(cmd)
+		if err != nil || len(args) > 0 {
+			fmt.Fprintf(out, "Unknown command %q (type \"help\" for a list of commands)\n", line)
+			return
+		}
+		if !s.releaseByID(id) {
+			fmt.Fprintf(out, "Request #%d is not pending\n", id)
+		}
+	}
+}
+
+// printRequest prints the full details of a captured request.
+func (s *Server) printRequest(out io.Writer, req *pendingRequest) {
+	fmt.Fprintf(out, "Request #%d: %s %s from %s\n", req.id, req.method, req.path, req.remoteAddr)
+	fmt.Fprintf(out, "Received: %s (held %s)\n",
+		req.requestTime.Format("15:04:05"), time.Since(req.requestTime).Round(time.Millisecond))
+	s.printHeaders(out, req.header)
+	fmt.Fprintln(out)
+	printFormParts(out, req)
+	if s.printProtoBody(out, req) {
+		return
+	}
+	printBody(out, req)
+}
+
+// printProtoBody prints req's body decoded as protobuf, reporting whether it
+// was protobuf.
+func (s *Server) printProtoBody(out io.Writer, req *pendingRequest) bool {
+	decoded, err := s.decodeProtoBody(req)
+	if err != nil {
+		fmt.Fprintf(out, "(could not decode protobuf body: %v)\n", err)
+		return false
+	}
+	if decoded == nil {
+		return false
+	}
+	typeName := decoded.Type
+	if typeName == "" {
+		typeName = "unknown type, fields by number"
+	}
+	fmt.Fprintf(out, "Protobuf body (%s, %d byte(s)):\n", typeName, req.bodySize)
+	for _, message := range decoded.Messages {
+		data, _ := json.MarshalIndent(message, "", "  ")
+		fmt.Fprintln(out, string(data))
+	}
+	return true
+}
+
+// printHeaders prints headers sorted by name, masking secrets if configured.
+func (s *Server) printHeaders(out io.Writer, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(out, "%s: %s\n", name, s.headerValue(name, value))
+		}
+	}
+}
+
+func printBody(out io.Writer, req *pendingRequest) {
+	if req.bodySize == 0 {
+		fmt.Fprintln(out, "(no body)")
+		return
+	}
+	if pretty, ok := prettyJSON(req.body); ok {
+		fmt.Fprintln(out, pretty)
+		return
+	}
+	if pretty, ok := prettyXML(req.body); ok && int64(len(req.body)) == req.bodySize {
+		fmt.Fprintln(out, pretty)
+		return
+	}
+	fmt.Fprintln(out, string(req.body))
+	if int64(len(req.body)) < req.bodySize {
+		fmt.Fprintf(out, "(body truncated: showing %d of %d bytes)\n", len(req.body), req.bodySize)
+	}
+}
+
+// secretHeaders are masked in console output when MASK_SECRETS is set.
+var secretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// headerValue returns value for display, masking it if name carries
+// credentials and masking is enabled. The auth scheme is kept visible.
+func (s *Server) headerValue(name, value string) string {
+	if !s.maskSecrets || !secretHeaders[http.CanonicalHeaderKey(name)] {
+		return value
+	}
+	if scheme, _, found := strings.Cut(value, " "); found && strings.HasSuffix(name, "Authorization") {
+		return scheme + " ********"
+	}
+	return "********"
+}
+
+// maskedHeaders returns a copy of header with secrets masked if configured.
+func (s *Server) maskedHeaders(header http.Header) http.Header {
+	if !s.maskSecrets {
+		return header
+	}
+	masked := make(http.Header, len(header))
+	for name, values := range header {
+		for _, value := range values {
+			masked.Add(name, s.headerValue(name, value))
+		}
+	}
+	return masked
+}
+
+// printClients prints each client with pending requests and their numbers,
+// in order of each client's oldest request.
+func (s *Server) printClients(out io.Writer) {
+	var clients []string
+	ids := make(map[string][]string)
+	for _, req := range s.snapshot() {
+		if _, seen := ids[req.client]; !seen {
+			clients = append(clients, req.client)
+		}
+		ids[req.client] = append(ids[req.client], "#"+strconv.Itoa(req.id))
+	}
+	if len(clients) == 0 {
+		fmt.Fprintln(out, "No pending requests")
+		return
+	}
+	for _, client := range clients {
+		fmt.Fprintf(out, "  %-30s %3d pending: %s\n", client, len(ids[client]), strings.Join(ids[client], " "))
+	}
+}
+
+// printPending prints one line per matching pending request in arrival order.
+// Requests answered by ROUTES_FILE routes are grouped into one queue per
+// route, in order of each queue's oldest request, followed by the rest.
+func (s *Server) printPending(out io.Writer, match func(*pendingRequest) bool) {
+	var routes []string
+	queues := make(map[string][]*pendingRequest)
+	for _, req := range s.snapshot() {
+		if !match(req) {
+			continue
+		}
+		route := routePath(req.route)
+		if _, seen := queues[route]; !seen && route != "" {
+			routes = append(routes, route)
+		}
+		queues[route] = append(queues[route], req)
+	}
+	total := 0
+	for _, queue := range queues {
+		total += len(queue)
+	}
+	if total == 0 {
+		fmt.Fprintln(out, "No pending requests")
+		return
+	}
+
+	fmt.Fprintf(out, "Pending requests: %d\n", total)
+	fmt.Fprintln(out, s.paintFor(out, ansiDim, fmt.Sprintf("  %-5s %6s %-7s %-30s %s", "#", "AGE", "METHOD", "PATH", "CLIENT")))
+	if len(routes) == 0 {
+		s.printQueue(out, queues[""])
+		return
+	}
+	for _, route := range routes {
+		fmt.Fprintf(out, "Route %s: %d pending\n", route, len(queues[route]))
+		s.printQueue(out, queues[route])
+	}
+	if unrouted := queues[""]; len(unrouted) > 0 {
+		fmt.Fprintf(out, "No route: %d pending\n", len(unrouted))
+		s.printQueue(out, unrouted)
+	}
+}
+
+// printQueue prints one line per request, with details on the lines below.
+func (s *Server) printQueue(out io.Writer, pending []*pendingRequest) {
+	now := time.Now()
+	for _, req := range pending {
+		fmt.Fprintf(out, "  %s %6s %s %-30s %s%s\n",
+			s.paintFor(out, ansiBold, fmt.Sprintf("%-5s", "#"+strconv.Itoa(req.id))),
+			now.Sub(req.requestTime).Round(time.Second),
+			s.paintFor(out, methodColor(req.method), fmt.Sprintf("%-7s", req.method)),
+			req.path, req.client, s.portSuffix(req))
+		if req.requestID != "" {
+			fmt.Fprintf(out, "        request id %s\n", req.requestID)
+		}
+		if req.clientCert != "" {
+			fmt.Fprintf(out, "        client certificate: %s\n", req.clientCert)
+		}
+		if req.traceID != "" {
+			fmt.Fprintf(out, "        trace %s\n", req.traceID)
+		}
+		if req.group != "" {
+			fmt.Fprintf(out, "        group %s\n", req.group)
+		}
+		for _, op := range req.graphQL {
+			fmt.Fprintf(out, "        graphql %s\n", op)
+		}
+		if req.soapAction != "" {
+			fmt.Fprintf(out, "        soap action %s\n", req.soapAction)
+		}
+		if req.duplicateOf != 0 {
+			fmt.Fprintf(out, "        %s\n", s.paintFor(out, ansiRed, "duplicate of "+req.duplicateNote))
+		}
+		if req.idempotencyKey != "" {
+			note := ""
+			if req.idempotentRepeatOf != 0 {
+				note = fmt.Sprintf(", repeat of #%d", req.idempotentRepeatOf)
+				if req.idempotencyConflict {
+					note = s.paintFor(out, ansiRed, fmt.Sprintf(", reused from #%d with a different request", req.idempotentRepeatOf))
+				}
+			}
+			fmt.Fprintf(out, "        idempotency key %s%s\n", req.idempotencyKey, note)
+		}
+		if req.partial {
+			fmt.Fprintln(out, "        partial body sent; release again to finish")
+		}
+		if req.awaitingContinue {
+			fmt.Fprintln(out, "        awaiting 100 Continue; release to read the body")
+		}
+		if req.awaitingBody {
+			fmt.Fprintf(out, "        body read stalled after %d byte(s); release to read the rest\n", req.bodyRead)
+		}
+	}
+}
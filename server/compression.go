@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressionEncodings are the encodings the server can apply, in order of
+// preference when negotiating. The standard library has no brotli encoder,
+// so "br" can only be sent as a CONTENT_ENCODING label.
+var compressionEncodings = []string{"gzip", "deflate"}
+
+// parseCompression validates COMPRESSION: "auto" negotiates with the
+// client's Accept-Encoding, "gzip" or "deflate" is applied regardless, and
+// "none" or empty disables compression.
+func parseCompression(value string) (string, error) {
+	switch value {
+	case "", "none":
+		return "", nil
+	case "auto", "gzip", "deflate":
+		return value, nil
+	case "br":
+		return "", fmt.Errorf("brotli is not supported (use CONTENT_ENCODING=br to send a mismatched header)")
+	}
+	return "", fmt.Errorf("invalid COMPRESSION %q (want auto, gzip, deflate or none)", value)
+}
+
+// negotiateEncoding picks the first of compressionEncodings that the
+// Accept-Encoding header allows, or "" for identity.
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				continue
+			}
+		}
+		accepted[name] = true
+	}
+	for _, encoding := range compressionEncodings {
+		if accepted[encoding] || accepted["*"] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// responseEncoding returns the encoding to compress r's response with and the
+// Content-Encoding header to announce, which differs from it when
+// CONTENT_ENCODING asks for a deliberate mismatch.
+func (s *Server) responseEncoding(r *http.Request) (encoding, header string) {
+	switch s.compression {
+	case "auto":
+		encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	default:
+		encoding = s.compression
+	}
+	header = encoding
+	if s.contentEncoding != "" {
+		header = s.contentEncoding
+	}
+	return encoding, header
+}
+
+// compressBody returns body compressed with encoding; "" returns it as is.
+func compressBody(body []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "":
+		return body, nil
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		// HTTP's "deflate" is the zlib format, not a raw deflate stream
+		w = zlib.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
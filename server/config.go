@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// reloadableOptions are the options re-read when the -config file, or a file
+// it names, changes.
+var reloadableOptions = []string{"status", "auto-release", "profile", "body", "body-file", "hold-rules", "body-rules", "routes"}
+
+// configPollInterval is how often the -config file is checked for changes.
+const configPollInterval = time.Second
+
+// loadSettings reads the reloadable settings from the environment and
+// applies them together. On error nothing is changed.
+func (s *Server) loadSettings() error {
+	status := http.StatusOK
+	if value := os.Getenv("STATUS"); value != "" {
+		var err error
+		if status, err = parseStatus(value); err != nil {
+			return fmt.Errorf("invalid STATUS: %v", err)
+		}
+	}
+
+	holdTimeout, err := durationEnv("HOLD_TIMEOUT")
+	if err != nil {
+		return fmt.Errorf("invalid HOLD_TIMEOUT: %v", err)
+	}
+
+	var profile *latencyProfile
+	if value := os.Getenv("LATENCY_PROFILE"); value != "" {
+		if profile, err = parseLatencyProfile(value); err != nil {
+			return fmt.Errorf("invalid LATENCY_PROFILE: %v", err)
+		}
+	}
+
+	bodyTemplate, err := loadBodyTemplate()
+	if err != nil {
+		return fmt.Errorf("invalid body template: %v", err)
+	}
+
+	holdRules, err := parseHoldRules(os.Getenv("HOLD_RULES"))
+	if err != nil {
+		return fmt.Errorf("invalid HOLD_RULES: %v", err)
+	}
+
+	bodyRules, err := parseBodyRules(os.Getenv("BODY_RULES"))
+	if err != nil {
+		return fmt.Errorf("invalid BODY_RULES: %v", err)
+	}
+
+	var routes []*route
+	if file := os.Getenv("ROUTES_FILE"); file != "" {
+		if routes, err = loadRoutes(file); err != nil {
+			return fmt.Errorf("invalid routes file: %v", err)
+		}
+	}
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	s.status = status
+	s.holdTimeout = holdTimeout
+	s.latencyProfile = profile
+	s.bodyTemplate = bodyTemplate
+	s.holdRules = holdRules
+	s.bodyRules = bodyRules
+	s.routes = routes
+	return nil
+}
+
+// watchConfig polls file, along with the routes and body template files in
+// use, and reloads the reloadable options when any of them changes. Options
+// in fixed were set by a flag or the environment and keep their values.
+// Held requests are unaffected; new requests see the new settings.
+func (s *Server) watchConfig(file string, fixed map[string]bool) {
+	last := configModTimes(file)
+	for range time.Tick(configPollInterval) {
+		current := configModTimes(file)
+		if current == last {
+			continue
+		}
+		last = current
+
+		if err := s.reloadConfig(file, fixed); err != nil {
+			s.warnf("Keeping the previous configuration: %v", err)
+			continue
+		}
+		s.printf("Reloaded configuration from %s\n", file)
+	}
+}
+
+// configModTimes returns the modification times of the config file and the
+// files it currently points at, as one comparable value.
+func configModTimes(file string) [3]time.Time {
+	var times [3]time.Time
+	for i, name := range []string{file, os.Getenv("ROUTES_FILE"), os.Getenv("BODY_TEMPLATE_FILE")} {
+		if name == "" {
+			continue
+		}
+		if info, err := os.Stat(name); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
+
+// reloadConfig re-reads file and applies its reloadable options.
+func (s *Server) reloadConfig(file string, fixed map[string]bool) error {
+	config, err := readConfigOptions(file)
+	if err != nil {
+		return err
+	}
+
+	envByFlag := make(map[string]string, len(options))
+	for _, opt := range options {
+		envByFlag[opt.flag] = opt.env
+	}
+	for _, name := range reloadableOptions {
+		env := envByFlag[name]
+		if fixed[env] {
+			continue
+		}
+		if value, ok := config[name]; ok {
+			os.Setenv(env, value)
+		} else {
+			os.Unsetenv(env)
+		}
+	}
+	return s.loadSettings()
+}
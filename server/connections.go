@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// connRequestsKey is the connection context key carrying the number of
+// requests received on the connection.
+type connRequestsKey struct{}
+
+// connContext gives each connection its own request counter.
+func connContext(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, connRequestsKey{}, new(atomic.Int64))
+}
+
+// closeConnection asks the client to close the connection after this
+// response when CONNECTION_CLOSE is set or when the connection has carried
+// MAX_CONN_REQUESTS requests. It only applies to HTTP/1.x, where connections
+// are reused one request at a time.
+func (s *Server) closeConnection(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 1 {
+		return
+	}
+	if s.connectionClose {
+		w.Header().Set("Connection", "close")
+		return
+	}
+	if s.maxConnRequests <= 0 {
+		return
+	}
+	counter, ok := r.Context().Value(connRequestsKey{}).(*atomic.Int64)
+	if !ok {
+		return
+	}
+	if n := counter.Add(1); n >= int64(s.maxConnRequests) {
+		w.Header().Set("Connection", "close")
+		s.printf("Closing the connection from %s after request %d on it\n", r.RemoteAddr, n)
+	}
+}
+
+// serverLimits are the http.Server limits set with READ_HEADER_TIMEOUT,
+// IDLE_TIMEOUT and MAX_HEADER_BYTES. They protect the server itself from
+// slow or oversized clients; held requests are unaffected, since there is no
+// read or write timeout once the headers are in.
+type serverLimits struct {
+	readHeaderTimeout time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+}
+
+// parseServerLimits reads the listener limits from the environment.
+func parseServerLimits() (serverLimits, error) {
+	var limits serverLimits
+	var err error
+	if limits.readHeaderTimeout, err = durationEnv("READ_HEADER_TIMEOUT"); err != nil {
+		return limits, fmt.Errorf("invalid READ_HEADER_TIMEOUT: %v", err)
+	}
+	if limits.idleTimeout, err = durationEnv("IDLE_TIMEOUT"); err != nil {
+		return limits, fmt.Errorf("invalid IDLE_TIMEOUT: %v", err)
+	}
+	if value := os.Getenv("MAX_HEADER_BYTES"); value != "" {
+		size, err := parseByteSize(value)
+		if err != nil || size <= 0 {
+			return limits, fmt.Errorf("invalid MAX_HEADER_BYTES %q", value)
+		}
+		limits.maxHeaderBytes = int(size)
+	}
+	return limits, nil
+}
+
+// apply sets the limits on hs.
+func (l serverLimits) apply(hs *http.Server) {
+	hs.ReadHeaderTimeout = l.readHeaderTimeout
+	hs.IdleTimeout = l.idleTimeout
+	hs.MaxHeaderBytes = l.maxHeaderBytes
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ANSI escape sequences used to color console output.
+const (
+	ansiReset   = "\033[0m"
+	ansiBold    = "\033[1m"
+	ansiDim     = "\033[2m"
+	ansiRed     = "\033[31m"
+	ansiGreen   = "\033[32m"
+	ansiYellow  = "\033[33m"
+	ansiBlue    = "\033[34m"
+	ansiMagenta = "\033[35m"
+	ansiCyan    = "\033[36m"
+)
+
+// parseColor decides whether console output is colored from COLOR: always,
+// never, or auto (the default), which colors a terminal unless NO_COLOR is
+// set or TERM is dumb.
+func parseColor(value string) (bool, error) {
+	switch value {
+	case "always", "1", "on":
+		return true, nil
+	case "never", "0", "off":
+		return false, nil
+	case "", "auto":
+		if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+			return false, nil
+		}
+		info, err := os.Stdout.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0, nil
+	default:
+		return false, fmt.Errorf("invalid COLOR %q (want auto, always or never)", value)
+	}
+}
+
+// writeConsole writes text to standard output in a single write, so that
+// output from concurrent handlers never interleaves mid-line or splits a
+// multi-line message.
+func (s *Server) writeConsole(text string) {
+	s.consoleMu.Lock()
+	defer s.consoleMu.Unlock()
+	if s.stdoutReserved {
+		io.WriteString(os.Stderr, text)
+		return
+	}
+	io.WriteString(os.Stdout, text)
+}
+
+// paint wraps text in an ANSI color when console colors are enabled.
+func (s *Server) paint(color, text string) string {
+	if !s.color || color == "" {
+		return text
+	}
+	return color + text + ansiReset
+}
+
+// consoleBuffer collects command output for the console, to be written with
+// writeConsole.
+type consoleBuffer struct {
+	strings.Builder
+}
+
+// paintFor is paint for output to out, which is only colored when it is
+// bound for the console rather than, say, a ctl client's connection.
+func (s *Server) paintFor(out io.Writer, color, text string) string {
+	if _, console := out.(*consoleBuffer); !console && out != io.Writer(os.Stdout) {
+		return text
+	}
+	return s.paint(color, text)
+}
+
+// methodColor is the color of an HTTP method in console output.
+func methodColor(method string) string {
+	switch method {
+	case "GET", "HEAD":
+		return ansiGreen
+	case "POST":
+		return ansiYellow
+	case "PUT", "PATCH":
+		return ansiBlue
+	case "DELETE":
+		return ansiRed
+	default:
+		return ansiMagenta
+	}
+}
+
+// eventColor is the color of a request event in console output.
+func eventColor(event string) string {
+	switch event {
+	case "held":
+		return ansiYellow
+	case "released":
+		return ansiGreen
+	case "passed", "replayed":
+		return ansiCyan
+	case "abandoned", "dropped", "reset", "conflict":
+		return ansiRed
+	default:
+		return ansiBlue
+	}
+}
+
+// requestLine formats a console line about req in aligned columns (time,
+// request number, method, path and event) followed by detail:
+//
+//	[15:04:05] #12   POST    /api/orders                    released  Response body sent after waiting 2s (id 9f1c...)
+//
+// The request ID comes last so that client logs can be searched for it.
+func (s *Server) requestLine(req *pendingRequest, event, detail string) string {
+	id := "#-"
+	if req.id != 0 {
+		id = fmt.Sprintf("#%d", req.id)
+	}
+	line := fmt.Sprintf("%s %s %s %-30s %s %s",
+		s.paint(ansiDim, "["+time.Now().Format("15:04:05")+"]"),
+		s.paint(ansiBold, fmt.Sprintf("%-5s", id)),
+		s.paint(methodColor(req.method), fmt.Sprintf("%-7s", req.method)),
+		req.path,
+		s.paint(eventColor(event), fmt.Sprintf("%-9s", event)),
+		detail)
+	if req.requestID != "" {
+		line += " " + s.paint(ansiDim, "(id "+req.requestID+")")
+	}
+	return line
+}
+
+// logRequest prints a requestLine.
+func (s *Server) logRequest(req *pendingRequest, event, format string, args ...interface{}) {
+	s.printf("%s\n", s.requestLine(req, event, fmt.Sprintf(format, args...)))
+}
+
+// indentLines prefixes every line of text so that it lines up under the
+// path column of a requestLine.
+func indentLines(text string) string {
+	indent := strings.Repeat(" ", len("[15:04:05] #12   GET     "))
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = indent + line
+		}
+	}
+	return strings.Join(lines, "")
+}
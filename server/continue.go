@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// parseExpectContinue validates EXPECT_CONTINUE: "auto" (or empty) sends
+// 100 Continue as soon as the body is read, "hold" withholds it until the
+// request is released, and "refuse" answers with 417 on release without
+// ever reading the body.
+func parseExpectContinue(value string) (string, error) {
+	switch value {
+	case "", "auto":
+		return "", nil
+	case "hold", "refuse":
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid EXPECT_CONTINUE %q (want auto, hold or refuse)", value)
+}
+
+// expectsContinue reports whether the client is waiting for 100 Continue
+// before sending its body.
+func expectsContinue(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Expect"), "100-continue")
+}
+
+// holdContinue holds req before its body is read, which keeps net/http from
+// sending 100 Continue. On release it either lets the request proceed to be
+// held again for its response, or refuses it, in which case it reports
+// false and the response has been written.
+func (s *Server) holdContinue(w http.ResponseWriter, r *http.Request, req *pendingRequest) bool {
+	req.awaitingContinue = true
+	stopTimeout := s.hold(req)
+	released := s.waitForRelease(r.Context(), req)
+	stopTimeout()
+	req.awaitingContinue = false
+	if !released {
+		return false
+	}
+	if req.dropped {
+		s.abortResponse(w, req)
+		return false
+	}
+
+	if s.expectContinue == "refuse" {
+		status := http.StatusExpectationFailed
+		if req.releaseStatus != 0 {
+			status = req.releaseStatus
+		}
+		req.status = status
+		s.logReleased(req, fmt.Sprintf("Refused 100 Continue with %d", status))
+		w.Header().Set("Connection", "close")
+		s.answerStatus(w, req)
+		return false
+	}
+
+	s.logRequest(req, "continue", "Sending 100 Continue after waiting %s", time.Since(req.requestTime))
+	req.responseChan = make(chan struct{})
+	req.releaseCause, req.releaseStatus = "", 0
+	return true
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// controlSocketPath returns the command socket of the server on port: the
+// CONTROL_SOCKET path, or one in the temporary directory named after the
+// port. It returns "" when CONTROL_SOCKET is "off".
+func controlSocketPath(port string) string {
+	switch value := os.Getenv("CONTROL_SOCKET"); value {
+	case "":
+		return filepath.Join(os.TempDir(), fmt.Sprintf("variable-debug-web-server-%s.sock", port))
+	case "off", "0":
+		return ""
+	default:
+		return value
+	}
+}
+
+// serveCommands runs console commands received on a Unix socket at path, so
+// that other terminals can control the server with the ctl subcommand. Each
+// line a client sends is executed as if typed, and the command's output is
+// written back. The returned function closes the socket.
+func (s *Server) serveCommands(path string) (func(), error) {
+	// A socket left behind by a server that exited uncleanly is replaced;
+	// one that still answers belongs to another running server
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another server is listening on %s (set CONTROL_SOCKET to use another path)", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleCommands(conn)
+		}
+	}()
+	return func() { listener.Close() }, nil
+}
+
+// handleCommands executes each line received on conn.
+func (s *Server) handleCommands(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		s.execute(conn, scanner.Text())
+	}
+}
+
+// runCtl implements the ctl subcommand, which sends a console command to a
+// running server's command socket and prints its output:
+//
+//	variable-debug-web-server ctl release all
+//	variable-debug-web-server ctl -port 3000 list
+//
+// Without a command, it sends each line of standard input instead. With
+// -addr, it instead talks to the admin API of a server that may be remote or
+// in a container (see runAdminCtl). It returns the process exit code.
+func runCtl(args []string) int {
+	flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	flags.StringVar(&port, "port", port, "port of the server to control (same as PORT)")
+	socket := flags.String("socket", "", "command socket of the server (default CONTROL_SOCKET or one named after -port)")
+	addr := flags.String("addr", "", "address of the server's admin API, e.g. :9090 or http://host:9090, to use instead of the socket")
+	flags.Usage = func() {
+		out := flags.Output()
+		fmt.Fprintf(out, "Usage: %s ctl [flags] [command...]\n\n", os.Args[0])
+		fmt.Fprintf(out, "Runs a console command, such as \"release all\" or \"list\", on a running\n")
+		fmt.Fprintf(out, "server. Without a command, each line of standard input is run.\n")
+		fmt.Fprintf(out, "With -addr, commands go to the admin API instead:\n\n%s\n\n", adminCtlHelp)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *addr != "" {
+		return runAdminCtl(*addr, flags.Args())
+	}
+
+	path := *socket
+	if path == "" {
+		path = controlSocketPath(port)
+	}
+	if path == "" {
+		fmt.Fprintln(os.Stderr, "ctl: CONTROL_SOCKET is off; pass -socket")
+		return 2
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ctl: no server is listening on %s: %v\n", path, err)
+		return 1
+	}
+	defer conn.Close()
+
+	var input io.Reader = os.Stdin
+	if flags.NArg() > 0 {
+		input = strings.NewReader(strings.Join(flags.Args(), " ") + "\n")
+	}
+	go func() {
+		io.Copy(conn, input)
+		conn.(*net.UnixConn).CloseWrite()
+	}()
+	if _, err := io.Copy(os.Stdout, conn); err != nil {
+		fmt.Fprintf(os.Stderr, "ctl: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// parseSetCookies parses SET_COOKIE, Set-Cookie header values separated by
+// "|" (commas can't be used because they appear in Expires dates).
+func parseSetCookies(spec string) []string {
+	var cookies []string
+	for _, cookie := range strings.Split(spec, "|") {
+		if cookie = strings.TrimSpace(cookie); cookie != "" {
+			cookies = append(cookies, cookie)
+		}
+	}
+	return cookies
+}
+
+// sessionID returns the value of the SESSION_COOKIE cookie in header, or ""
+// if there is none.
+func (s *Server) sessionID(header http.Header) string {
+	if s.sessionCookie == "" {
+		return ""
+	}
+	cookie, err := (&http.Request{Header: header}).Cookie(s.sessionCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// setCookies adds the SET_COOKIE cookies to header, and a new session cookie
+// if SESSION_COOKIE is set and the request has none yet.
+func (s *Server) setCookies(header http.Header, req *pendingRequest) {
+	for _, cookie := range s.setCookie {
+		header.Add("Set-Cookie", cookie)
+	}
+	if s.sessionCookie == "" || s.sessionID(req.header) != "" {
+		return
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	cookie := &http.Cookie{
+		Name:     s.sessionCookie,
+		Value:    hex.EncodeToString(id),
+		Path:     "/",
+		HttpOnly: true,
+	}
+	header.Add("Set-Cookie", cookie.String())
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsPolicy adds Access-Control-* headers to responses and answers CORS
+// preflight requests, configured with the CORS_* environment variables.
+type corsPolicy struct {
+	// origins are the allowed origins; "*" allows any.
+	origins []string
+
+	// methods and headers are the preflight's Allow-Methods and
+	// Allow-Headers; empty reflects what the preflight asked for.
+	methods string
+	headers string
+
+	expose      string
+	maxAge      string
+	credentials bool
+
+	// holdPreflight holds preflights like other requests instead of
+	// answering them at once.
+	holdPreflight bool
+}
+
+// isPreflight reports whether r is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin, or
+// "" if it is not allowed. With credentials a wildcard has to be sent as the
+// origin itself.
+func (c *corsPolicy) allowOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range c.origins {
+		if allowed == "*" {
+			if c.credentials {
+				return origin
+			}
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// setHeaders adds the CORS headers for r to header, including the preflight
+// ones if it is a preflight.
+func (c *corsPolicy) setHeaders(header http.Header, r *http.Request, preflight bool) {
+	header.Add("Vary", "Origin")
+	origin := c.allowOrigin(r.Header.Get("Origin"))
+	if origin == "" {
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	if c.credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if c.expose != "" {
+			header.Set("Access-Control-Expose-Headers", c.expose)
+		}
+		return
+	}
+
+	methods := c.methods
+	if methods == "" {
+		methods = r.Header.Get("Access-Control-Request-Method")
+	}
+	header.Set("Access-Control-Allow-Methods", methods)
+	headers := c.headers
+	if headers == "" {
+		headers = r.Header.Get("Access-Control-Request-Headers")
+	}
+	if headers != "" {
+		header.Set("Access-Control-Allow-Headers", headers)
+	}
+	if c.maxAge != "" {
+		header.Set("Access-Control-Max-Age", c.maxAge)
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// handleDashboard serves the embedded dashboard page.
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+// handleDashboardStream sends the pending list as a Server-Sent Event
+// whenever the queue changes, and at least once a second so hold ages stay
+// current.
+func (s *Server) handleDashboardStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		pending, changed := s.watchQueue()
+		now := time.Now()
+		infos := make([]pendingInfo, 0, len(pending))
+		for _, req := range pending {
+			infos = append(infos, newPendingInfo(req, now))
+		}
+		data, _ := json.Marshal(infos)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
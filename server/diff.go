@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// capturedRequest is the part of a pending or completed request that diff
+// compares.
+type capturedRequest struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   []byte
+}
+
+// findCaptured returns request id from the pending queue or the history.
+func (s *Server) findCaptured(id int) (*capturedRequest, bool) {
+	if req := s.findPending(id); req != nil {
+		query, _ := url.ParseQuery(req.rawQuery)
+		return &capturedRequest{req.method, req.path, query, req.header, req.body}, true
+	}
+	if s.history != nil {
+		if entry := s.history.find(id); entry != nil {
+			query, _ := url.ParseQuery(entry.Query)
+			return &capturedRequest{entry.Method, entry.Path, query, entry.Header, entry.Body}, true
+		}
+	}
+	return nil, false
+}
+
+// diffLines collects the differences found by diffRequests, one section at a
+// time.
+type diffLines struct {
+	lines []string
+}
+
+func (d *diffLines) section(title string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+	d.lines = append(d.lines, title+":")
+	for _, line := range lines {
+		d.lines = append(d.lines, "  "+line)
+	}
+}
+
+// diffRequests returns a structured diff of a and b: "-" lines are only in
+// a, "+" lines only in b, and "~" lines changed.
+func (s *Server) diffRequests(a, b *capturedRequest) []string {
+	var d diffLines
+
+	var request []string
+	if a.method != b.method {
+		request = append(request, fmt.Sprintf("~ method: %s -> %s", a.method, b.method))
+	}
+	if a.path != b.path {
+		request = append(request, fmt.Sprintf("~ path: %s -> %s", a.path, b.path))
+	}
+	d.section("Request", request)
+
+	d.section("Query", diffValues(a.query, b.query, func(_, v string) string { return v }))
+
+	// Header names are canonical already, so they compare case-insensitively
+	d.section("Headers", diffValues(url.Values(a.header), url.Values(b.header), s.headerValue))
+
+	var body []string
+	var aJSON, bJSON interface{}
+	switch {
+	case bytes.Equal(a.body, b.body):
+	case len(a.body) > 0 && len(b.body) > 0 &&
+		json.Unmarshal(a.body, &aJSON) == nil && json.Unmarshal(b.body, &bJSON) == nil:
+		body = diffJSON("$", aJSON, bJSON, nil)
+	default:
+		body = append(body, fmt.Sprintf("~ %d byte(s) -> %d byte(s), not both JSON", len(a.body), len(b.body)))
+		if i := firstDifference(a.body, b.body); i >= 0 {
+			body = append(body, fmt.Sprintf("  first difference at byte %d", i))
+		}
+	}
+	d.section("Body", body)
+	return d.lines
+}
+
+// diffValues compares two multi-valued maps such as query parameters or
+// headers, formatting values with format.
+func diffValues(a, b url.Values, format func(name, value string) string) []string {
+	names := make(map[string]bool)
+	for name := range a {
+		names[name] = true
+	}
+	for name := range b {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	join := func(name string, values []string) string {
+		formatted := make([]string, len(values))
+		for i, value := range values {
+			formatted[i] = format(name, value)
+		}
+		return strings.Join(formatted, ", ")
+	}
+
+	var lines []string
+	for _, name := range sorted {
+		av, inA := a[name]
+		bv, inB := b[name]
+		switch {
+		case !inB:
+			lines = append(lines, fmt.Sprintf("- %s: %s", name, join(name, av)))
+		case !inA:
+			lines = append(lines, fmt.Sprintf("+ %s: %s", name, join(name, bv)))
+		case !reflect.DeepEqual(av, bv):
+			lines = append(lines, fmt.Sprintf("~ %s: %s -> %s", name, join(name, av), join(name, bv)))
+		}
+	}
+	return lines
+}
+
+// diffJSON appends the differences between two decoded JSON values at path
+// to lines.
+func diffJSON(path string, a, b interface{}, lines []string) []string {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make(map[string]bool)
+		for key := range av {
+			keys[key] = true
+		}
+		for key := range bv {
+			keys[key] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for key := range keys {
+			sorted = append(sorted, key)
+		}
+		sort.Strings(sorted)
+		for _, key := range sorted {
+			child := path + "." + key
+			aChild, inA := av[key]
+			bChild, inB := bv[key]
+			switch {
+			case !inB:
+				lines = append(lines, fmt.Sprintf("- %s: %s", child, jsonText(aChild)))
+			case !inA:
+				lines = append(lines, fmt.Sprintf("+ %s: %s", child, jsonText(bChild)))
+			default:
+				lines = diffJSON(child, aChild, bChild, lines)
+			}
+		}
+		return lines
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			child := path + "[" + strconv.Itoa(i) + "]"
+			switch {
+			case i >= len(bv):
+				lines = append(lines, fmt.Sprintf("- %s: %s", child, jsonText(av[i])))
+			case i >= len(av):
+				lines = append(lines, fmt.Sprintf("+ %s: %s", child, jsonText(bv[i])))
+			default:
+				lines = diffJSON(child, av[i], bv[i], lines)
+			}
+		}
+		return lines
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		lines = append(lines, fmt.Sprintf("~ %s: %s -> %s", path, jsonText(a), jsonText(b)))
+	}
+	return lines
+}
+
+// jsonText formats a decoded JSON value compactly.
+func jsonText(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// firstDifference returns the index of the first differing byte of a and b,
+// or -1 if they are equal.
+func firstDifference(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return len(a)
+		}
+		return len(b)
+	}
+	return -1
+}
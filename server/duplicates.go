@@ -0,0 +1,123 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// duplicateDetector flags requests identical to one that is still pending or
+// was answered within the window: the same method, path, query and body.
+// Clients that time out under an artificial delay and retry show up this way.
+// It is only set up when DUPLICATE_WINDOW is.
+type duplicateDetector struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]*seenRequest
+	// answered lists requests in the order they were answered, so that the
+	// oldest can be forgotten without scanning seen.
+	answered []*seenRequest
+}
+
+// seenRequest is the latest request with a given fingerprint.
+type seenRequest struct {
+	id          int
+	fingerprint string
+	received    time.Time
+	finished    time.Time // zero while pending
+}
+
+func newDuplicateDetector(window time.Duration) *duplicateDetector {
+	return &duplicateDetector{window: window, seen: make(map[string]*seenRequest)}
+}
+
+// requestFingerprint identifies req by its method, path, query and a hash of
+// its body. It is only meaningful once the body has been read.
+func requestFingerprint(req *pendingRequest) string {
+	sum := sha256.Sum256(req.body)
+	return fmt.Sprintf("%s %s?%s %d %s", req.method, req.path, req.rawQuery, req.bodySize, hex.EncodeToString(sum[:]))
+}
+
+// check remembers the numbered req and, if an identical request is pending
+// or was answered recently, marks req as its duplicate. Requests whose body
+// has not been read yet have no fingerprint and are skipped.
+func (d *duplicateDetector) check(req *pendingRequest) {
+	if req.fingerprint == "" {
+		return
+	}
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expireLocked(now)
+	if seen, ok := d.seen[req.fingerprint]; ok && seen.id != req.id {
+		req.duplicateOf = seen.id
+		if seen.finished.IsZero() {
+			req.duplicateNote = fmt.Sprintf("#%d, still pending after %s", seen.id, now.Sub(seen.received).Round(time.Millisecond))
+		} else {
+			req.duplicateNote = fmt.Sprintf("#%d, answered %s ago", seen.id, now.Sub(seen.finished).Round(time.Millisecond))
+		}
+	}
+	d.seen[req.fingerprint] = &seenRequest{id: req.id, fingerprint: req.fingerprint, received: req.requestTime}
+}
+
+// expireLocked forgets requests answered longer ago than the window. d.mu must
+// be held.
+func (d *duplicateDetector) expireLocked(now time.Time) {
+	n := 0
+	for n < len(d.answered) && now.Sub(d.answered[n].finished) > d.window {
+		seen := d.answered[n]
+		if d.seen[seen.fingerprint] == seen {
+			delete(d.seen, seen.fingerprint)
+		}
+		d.answered[n] = nil
+		n++
+	}
+	d.answered = d.answered[n:]
+}
+
+// finish notes that req was answered, starting its window.
+func (d *duplicateDetector) finish(req *pendingRequest) {
+	if req.fingerprint == "" {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if seen, ok := d.seen[req.fingerprint]; ok && seen.id == req.id {
+		seen.finished = time.Now()
+		d.answered = append(d.answered, seen)
+	}
+}
+
+// checkRepeatsLocked flags the numbered req if it repeats an earlier request,
+// either exactly or by its Idempotency-Key. s.mu must be held.
+func (s *Server) checkRepeatsLocked(req *pendingRequest) {
+	if s.duplicates != nil {
+		s.duplicates.check(req)
+	}
+	if s.idempotency != nil {
+		s.idempotency.note(req)
+	}
+}
+
+// repeatNotes returns the console lines flagging req as a repeat of an
+// earlier request, if it is one.
+func (s *Server) repeatNotes(req *pendingRequest) string {
+	var notes strings.Builder
+	if req.duplicateOf != 0 {
+		notes.WriteString(s.duplicateWarning(req) + "\n")
+	}
+	if note := s.idempotencyNote(req); note != "" {
+		notes.WriteString(note + "\n")
+	}
+	return notes.String()
+}
+
+// duplicateWarning describes what req duplicates for the console.
+func (s *Server) duplicateWarning(req *pendingRequest) string {
+	return s.paint(ansiRed, "Duplicate of "+req.duplicateNote) + ": same method, path, query and body; possibly a client retry"
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// newLogger returns the structured logger selected by LOG_FORMAT, or nil for
+// the default human-readable console output. In quiet mode only warnings are
+// logged, as text on stderr unless JSON was requested.
+func newLogger(format string, quiet bool) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{}
+	if quiet {
+		opts.Level = slog.LevelWarn
+	}
+	switch format {
+	case "", "text":
+		if quiet {
+			return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+		}
+		return nil, nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid LOG_FORMAT %q (want text or json)", format)
+	}
+}
+
+// printf writes free-form console output. It is suppressed when structured
+// logging is enabled so that stdout only carries event records.
+func (s *Server) printf(format string, args ...interface{}) {
+	if s.logger == nil {
+		s.writeConsole(fmt.Sprintf(format, args...))
+	}
+}
+
+// warnf reports a problem that doesn't stop the server.
+func (s *Server) warnf(format string, args ...interface{}) {
+	if s.logger != nil {
+		s.logger.Warn(fmt.Sprintf(format, args...))
+		return
+	}
+	s.writeConsole(fmt.Sprintf(format+"\n", args...))
+}
+
+// portSuffix names the port req arrived on when several ports are served.
+func (s *Server) portSuffix(req *pendingRequest) string {
+	if len(s.ports) <= 1 || req.port == "" {
+		return ""
+	}
+	return " on :" + req.port
+}
+
+func requestAttrs(req *pendingRequest) []any {
+	attrs := []any{
+		slog.Int("id", req.id),
+		slog.String("method", req.method),
+		slog.String("path", req.path),
+		slog.String("remote_addr", req.remoteAddr),
+	}
+	if req.requestID != "" {
+		attrs = append(attrs, slog.String("request_id", req.requestID))
+	}
+	if req.port != "" {
+		attrs = append(attrs, slog.String("port", req.port))
+	}
+	if req.clientCert != "" {
+		attrs = append(attrs, slog.String("client_cert", req.clientCert))
+	}
+	if req.traceID != "" {
+		attrs = append(attrs, slog.String("trace_id", req.traceID))
+	}
+	if len(req.graphQL) > 0 {
+		attrs = append(attrs, slog.String("graphql_operation", req.graphQL[0].Name))
+	}
+	if req.soapAction != "" {
+		attrs = append(attrs, slog.String("soap_action", req.soapAction))
+	}
+	if req.duplicateOf != 0 {
+		attrs = append(attrs, slog.Int("duplicate_of", req.duplicateOf))
+	}
+	if req.idempotencyKey != "" {
+		attrs = append(attrs, slog.String("idempotency_key", req.idempotencyKey))
+	}
+	if req.idempotentRepeatOf != 0 {
+		attrs = append(attrs, slog.Int("idempotent_repeat_of", req.idempotentRepeatOf), slog.Bool("idempotency_conflict", req.idempotencyConflict))
+	}
+	return attrs
+}
+
+// logReceived reports a request that has just been added to the queue.
+func (s *Server) logReceived(req *pendingRequest, pendingCount int) {
+	ev := newRequestEvent("received", req)
+	ev.Pending = pendingCount
+	s.publish(ev)
+	if s.logger != nil {
+		attrs := append(requestAttrs(req), slog.Int("pending", pendingCount))
+		if s.verbose {
+			attrs = append(attrs, slog.Any("headers", s.maskedHeaders(req.header)))
+		}
+		if s.verboseBody {
+			attrs = append(attrs, slog.String("body", string(req.body)))
+		}
+		s.logger.Info("request received", attrs...)
+		return
+	}
+
+	// The whole report is written at once so that it stays together
+	var details strings.Builder
+	if req.clientCert != "" {
+		fmt.Fprintf(&details, "Client certificate: %s\n", req.clientCert)
+	}
+	if req.traceID != "" {
+		fmt.Fprintf(&details, "Trace: %s\n", req.traceID)
+	}
+	for _, op := range req.graphQL {
+		fmt.Fprintf(&details, "GraphQL: %s\n", op)
+	}
+	if req.soapAction != "" {
+		fmt.Fprintf(&details, "SOAP action: %s\n", req.soapAction)
+	}
+	details.WriteString(s.repeatNotes(req))
+	if req.awaitingContinue {
+		fmt.Fprintln(&details, "Expect: 100-continue; the body is not read until release")
+	}
+	if req.awaitingBody {
+		fmt.Fprintf(&details, "Holding after %d byte(s) of the body; the rest is not read until release\n", req.bodyRead)
+	}
+	report := s.requestLine(req, "held", fmt.Sprintf("from %s%s, %d pending", req.remoteAddr, s.portSuffix(req), pendingCount)) +
+		"\n" + indentLines(details.String())
+	var verbose strings.Builder
+	if s.verbose {
+		s.printHeaders(&verbose, req.header)
+	}
+	if s.verboseBody {
+		printBody(&verbose, req)
+	}
+	s.writeConsole(report + verbose.String())
+}
+
+// logPassed reports a request that is answered immediately without a hold.
+func (s *Server) logPassed(req *pendingRequest) {
+	s.recordHistory(req, "passthrough")
+	s.publish(newRequestEvent("passed", req))
+	s.served.Add(1)
+	if s.logger != nil {
+		s.logger.Info("request passed through", requestAttrs(req)...)
+		return
+	}
+
+	if notes := s.repeatNotes(req); notes != "" {
+		s.writeConsole(s.requestLine(req, "passed", fmt.Sprintf("from %s (not held)", req.remoteAddr)) +
+			"\n" + indentLines(notes))
+		return
+	}
+	s.logRequest(req, "passed", "from %s (not held)", req.remoteAddr)
+}
+
+// logReleased reports that req has been released; action describes what
+// happens next in the console output, e.g. "Response body sent".
+func (s *Server) logReleased(req *pendingRequest, action string) {
+	s.recordHistory(req, "released")
+	ev := newRequestEvent("released", req)
+	ev.Cause = req.releaseCause
+	s.publish(ev)
+	s.traceHold(req, "released")
+	if !req.partial {
+		s.served.Add(1)
+	}
+	now := time.Now()
+	held := now.Sub(req.requestTime)
+	if s.logger != nil {
+		s.logger.Info("request released", append(requestAttrs(req),
+			slog.String("cause", req.releaseCause),
+			slog.Float64("hold_ms", float64(held)/float64(time.Millisecond)))...)
+		return
+	}
+
+	s.logRequest(req, "released", "%s after waiting %s", action, held)
+}
+
+// logAbandoned reports that the client disconnected while req was held.
+func (s *Server) logAbandoned(req *pendingRequest) {
+	s.recordHistory(req, "abandoned")
+	s.publish(newRequestEvent("abandoned", req))
+	s.traceHold(req, "abandoned")
+	now := time.Now()
+	held := now.Sub(req.requestTime)
+	if s.logger != nil {
+		s.logger.Info("request abandoned", append(requestAttrs(req),
+			slog.Float64("hold_ms", float64(held)/float64(time.Millisecond)))...)
+		return
+	}
+
+	s.logRequest(req, "abandoned", "Client disconnected after waiting %s", held)
+}
+
+// logDropped reports that req's connection was closed without a response.
+func (s *Server) logDropped(req *pendingRequest) {
+	if req.reset {
+		s.recordHistory(req, "reset")
+	} else {
+		s.recordHistory(req, "dropped")
+	}
+	ev := newRequestEvent("dropped", req)
+	ev.Reset = req.reset
+	s.publish(ev)
+	s.traceHold(req, "dropped")
+	now := time.Now()
+	held := now.Sub(req.requestTime)
+	if s.logger != nil {
+		s.logger.Info("request dropped", append(requestAttrs(req),
+			slog.Bool("reset", req.reset),
+			slog.Float64("hold_ms", float64(held)/float64(time.Millisecond)))...)
+		return
+	}
+
+	what := "dropped"
+	if req.reset {
+		what = "reset"
+	}
+	s.logRequest(req, what, "Connection %s after waiting %s", what, held)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// eventSubscribers fans request events out to admin /events streams.
+type eventSubscribers struct {
+	mu      sync.Mutex
+	streams map[chan requestEvent]struct{}
+}
+
+func (e *eventSubscribers) subscribe() chan requestEvent {
+	stream := make(chan requestEvent, 64)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.streams == nil {
+		e.streams = make(map[chan requestEvent]struct{})
+	}
+	e.streams[stream] = struct{}{}
+	return stream
+}
+
+func (e *eventSubscribers) unsubscribe(stream chan requestEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.streams, stream)
+}
+
+// broadcast sends ev to every subscriber, skipping any that are too slow to
+// keep up.
+func (e *eventSubscribers) broadcast(ev requestEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for stream := range e.streams {
+		select {
+		case stream <- ev:
+		default:
+		}
+	}
+}
+
+// handleEvents streams request events (received, passed, released,
+// abandoned and dropped) as they happen. WebSocket clients get one JSON text
+// message per event; anyone else gets Server-Sent Events named after the
+// event type.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if isWebSocketUpgrade(r) {
+		s.streamEventsWebSocket(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	stream := s.eventSubs.subscribe()
+	defer s.eventSubs.unsubscribe(stream)
+	for {
+		select {
+		case ev := <-stream:
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Event, data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// streamEventsWebSocket completes the WebSocket handshake and writes each
+// event as a text message until the client goes away.
+func (s *Server) streamEventsWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "unsupported WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket upgrade not supported on this connection", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", webSocketAccept(key))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	stream := s.eventSubs.subscribe()
+	defer s.eventSubs.unsubscribe(stream)
+
+	// The client only ever sends control frames; stop when it closes
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			opcode, payload, err := readWebSocketFrame(rw.Reader)
+			if err != nil || opcode == opClose {
+				return
+			}
+			if opcode == opPing {
+				writeWebSocketFrame(conn, opPong, payload)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case ev := <-stream:
+			data, _ := json.Marshal(ev)
+			if err := writeWebSocketFrame(conn, opText, data); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// findFixture returns the file in FIXTURES_DIR that answers a request and
+// its content type, or "" if there is none. GET /users/42 is answered by
+// users/42.GET.<ext> if it exists, else by users/42 or users/42.<ext>
+// (users/42.json, say); a directory is answered by its index file.
+func (s *Server) findFixture(method, urlPath string) (file, contentType string) {
+	base := filepath.Join(s.fixturesDir, filepath.FromSlash(path.Clean("/"+urlPath)))
+	if info, err := os.Stat(base); err == nil && info.IsDir() {
+		base = filepath.Join(base, "index")
+	}
+	dir, name := filepath.Split(base)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", ""
+	}
+
+	var exact, generic string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		entryName := entry.Name()
+		ext, ok := strings.CutPrefix(entryName, name)
+		switch {
+		case !ok:
+		case strings.HasPrefix(ext, "."+method+".") && !strings.Contains(ext[len(method)+2:], "."):
+			exact = entryName
+		case ext == "" || strings.HasPrefix(ext, ".") && !strings.Contains(ext[1:], "."):
+			if generic == "" || ext == "" {
+				generic = entryName
+			}
+		}
+	}
+	if exact == "" {
+		exact = generic
+	}
+	if exact == "" {
+		return "", ""
+	}
+
+	contentType = mime.TypeByExtension(filepath.Ext(exact))
+	if contentType == "" {
+		contentType = s.contentType
+	}
+	return filepath.Join(dir, exact), contentType
+}
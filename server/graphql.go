@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// graphQLOperation is one operation of a GraphQL request.
+type graphQLOperation struct {
+	Type      string          `json:"type"`
+	Name      string          `json:"name,omitempty"`
+	Variables json.RawMessage `json:"variables,omitempty"`
+}
+
+// graphQLRequest is the JSON body of a GraphQL POST.
+type graphQLRequest struct {
+	Query         string          `json:"query"`
+	OperationName string          `json:"operationName"`
+	Variables     json.RawMessage `json:"variables"`
+}
+
+// graphQLDefinition finds the operation definitions in a GraphQL document.
+var graphQLDefinition = regexp.MustCompile(`(?:^|[}\s])(query|mutation|subscription)\b\s*([_A-Za-z][_0-9A-Za-z]*)?`)
+
+// parseGraphQL returns the operations of a GraphQL POST: an
+// application/graphql body, or a JSON body (or batch of them) with a query.
+// Other requests have none.
+func parseGraphQL(method string, header http.Header, body []byte) []graphQLOperation {
+	if method != http.MethodPost || len(body) == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mediaType == "application/graphql" {
+		return []graphQLOperation{graphQLOperationOf(graphQLRequest{Query: string(body)})}
+	}
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return nil
+	}
+
+	var batch []graphQLRequest
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if json.Unmarshal(trimmed, &batch) != nil {
+			return nil
+		}
+	} else {
+		var single graphQLRequest
+		if json.Unmarshal(trimmed, &single) != nil {
+			return nil
+		}
+		batch = append(batch, single)
+	}
+
+	var ops []graphQLOperation
+	for _, request := range batch {
+		if request.Query == "" {
+			return nil
+		}
+		ops = append(ops, graphQLOperationOf(request))
+	}
+	return ops
+}
+
+// graphQLOperationOf describes the operation request runs: the one named by
+// operationName, or else the first in its query. A query that starts with
+// "{" is an anonymous query.
+func graphQLOperationOf(request graphQLRequest) graphQLOperation {
+	op := graphQLOperation{Type: "query", Name: request.OperationName}
+	if vars := bytes.TrimSpace(request.Variables); len(vars) > 0 && !bytes.Equal(vars, []byte("null")) {
+		var compact bytes.Buffer
+		if json.Compact(&compact, vars) == nil {
+			op.Variables = compact.Bytes()
+		}
+	}
+	for _, match := range graphQLDefinition.FindAllStringSubmatch(request.Query, -1) {
+		if op.Name == "" || match[2] == op.Name {
+			op.Type = match[1]
+			if op.Name == "" {
+				op.Name = match[2]
+			}
+			break
+		}
+	}
+	return op
+}
+
+// String formats op for the console, e.g. "mutation CreateOrder
+// {"id":1}". Long variables are shortened.
+func (op graphQLOperation) String() string {
+	name := op.Name
+	if name == "" {
+		name = "(anonymous)"
+	}
+	text := op.Type + " " + name
+	if len(op.Variables) > 0 {
+		vars := string(op.Variables)
+		if len(vars) > 120 {
+			vars = vars[:117] + "..."
+		}
+		text += " " + vars
+	}
+	return text
+}
+
+// matchOperation selects GraphQL requests that run the named operation.
+func matchOperation(name string) func(*pendingRequest) bool {
+	return func(req *pendingRequest) bool {
+		for _, op := range req.graphQL {
+			if op.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// The types below cover the subset of HAR 1.2
+// (http://www.softwareishard.com/blog/har-12-spec/) that browser dev tools
+// need to import a capture.
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+
+	// Custom fields carry the debug server's own view of the request.
+	ID      int     `json:"_id"`
+	Outcome string  `json:"_outcome"`
+	HoldMs  float64 `json:"_holdMs"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// harTimings reports the hold as server wait time; the other phases aren't
+// observed and are marked -1 where the spec allows it.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// buildHAR converts the recorded history into a HAR document.
+func (s *Server) buildHAR() harFile {
+	var entries []*historyEntry
+	if s.history != nil {
+		entries = s.history.list()
+	}
+
+	har := harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "variable-debug-web-server", Version: "1.0"},
+		Entries: make([]harEntry, 0, len(entries)),
+	}}
+	for _, entry := range entries {
+		har.Log.Entries = append(har.Log.Entries, s.harEntry(entry))
+	}
+	return har
+}
+
+func (s *Server) harEntry(entry *historyEntry) harEntry {
+	held := entry.FinishedAt.Sub(entry.ReceivedAt)
+	holdMs := float64(held) / float64(time.Millisecond)
+
+	u := url.URL{Scheme: entry.Scheme, Host: entry.Host, Path: entry.Path, RawQuery: entry.Query}
+	query, _ := url.ParseQuery(entry.Query)
+
+	request := harRequest{
+		Method:      entry.Method,
+		URL:         u.String(),
+		HTTPVersion: harVersion(entry.Proto),
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(s.maskedHeaders(entry.Header)),
+		QueryString: harValues(query),
+		HeadersSize: -1,
+		BodySize:    len(entry.Body),
+	}
+	if len(entry.Body) > 0 {
+		request.PostData = &harPostData{
+			MimeType: entry.Header.Get("Content-Type"),
+			Text:     string(entry.Body),
+		}
+	}
+
+	response := harResponse{
+		Status:      entry.Status,
+		StatusText:  http.StatusText(entry.Status),
+		HTTPVersion: harVersion(entry.Proto),
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(entry.ResponseHeader),
+		Content:     harBody(entry.ResponseHeader.Get("Content-Type"), entry.ResponseBody),
+		HeadersSize: -1,
+		BodySize:    len(entry.ResponseBody),
+	}
+	if entry.ResponseHeader == nil {
+		// Dropped or proxied responses weren't captured
+		response.BodySize = -1
+	}
+
+	return harEntry{
+		StartedDateTime: entry.ReceivedAt.Format(time.RFC3339Nano),
+		Time:            holdMs,
+		Request:         request,
+		Response:        response,
+		Timings:         harTimings{Blocked: -1, DNS: -1, Connect: -1, Wait: holdMs},
+		Comment:         "held for " + entry.HeldFor + ", " + entry.Outcome,
+		ID:              entry.ID,
+		Outcome:         entry.Outcome,
+		HoldMs:          holdMs,
+	}
+}
+
+// harVersion returns proto, or HTTP/1.1 when it wasn't recorded.
+func harVersion(proto string) string {
+	if proto == "" {
+		return "HTTP/1.1"
+	}
+	return proto
+}
+
+// harHeaders flattens header into name/value pairs in a stable order.
+func harHeaders(header http.Header) []harNameValue {
+	return harValues(url.Values(header))
+}
+
+func harValues(values map[string][]string) []harNameValue {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := []harNameValue{}
+	for _, name := range names {
+		for _, value := range values[name] {
+			pairs = append(pairs, harNameValue{Name: name, Value: value})
+		}
+	}
+	return pairs
+}
+
+// harBody describes a response body, base64-encoding anything that isn't
+// valid UTF-8 text.
+func harBody(contentType string, body []byte) harContent {
+	content := harContent{Size: len(body), MimeType: contentType}
+	if content.MimeType == "" {
+		content.MimeType = "application/octet-stream"
+	}
+	if len(body) == 0 {
+		return content
+	}
+	if utf8.Valid(body) {
+		content.Text = string(body)
+		return content
+	}
+	content.Text = base64.StdEncoding.EncodeToString(body)
+	content.Encoding = "base64"
+	return content
+}
+
+// writeHAR writes the recorded history to file in HAR format.
+func (s *Server) writeHAR(file string) (int, error) {
+	har := s.buildHAR()
+	data, err := json.MarshalIndent(har, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	return len(har.Log.Entries), os.WriteFile(file, append(data, '\n'), 0o644)
+}
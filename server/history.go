@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultHistorySize is how many completed requests are kept unless
+// HISTORY_SIZE says otherwise.
+const defaultHistorySize = 100
+
+// historyEntry is a completed request kept for later inspection and replay.
+type historyEntry struct {
+	ID             int         `json:"id"`
+	Method         string      `json:"method"`
+	Path           string      `json:"path"`
+	Query          string      `json:"query,omitempty"`
+	RemoteAddr     string      `json:"remote_addr"`
+	Header         http.Header `json:"headers"`
+	Body           []byte      `json:"-"`
+	ReceivedAt     time.Time   `json:"received_at"`
+	FinishedAt     time.Time   `json:"finished_at"`
+	HeldFor        string      `json:"held_for"`
+	Outcome        string      `json:"outcome"`
+	Status         int         `json:"status,omitempty"`
+	RequestID      string      `json:"request_id,omitempty"`
+	DuplicateOf    int         `json:"duplicate_of,omitempty"`
+	IdempotencyKey string      `json:"idempotency_key,omitempty"`
+
+	// Fields used to rebuild the full exchange when exporting.
+	Scheme         string      `json:"-"`
+	Host           string      `json:"-"`
+	Proto          string      `json:"-"`
+	ResponseHeader http.Header `json:"-"`
+	ResponseBody   []byte      `json:"-"`
+}
+
+// requestHistory is a bounded, oldest-first list of completed requests.
+type requestHistory struct {
+	mu      sync.Mutex
+	entries []*historyEntry
+	limit   int
+
+	// file, when set, saves every change (HISTORY_FILE).
+	file *historyFile
+}
+
+func newRequestHistory(limit int) *requestHistory {
+	return &requestHistory{limit: limit}
+}
+
+// load replaces the entries with ones saved by an earlier run, keeping the
+// newest if there are more than the limit.
+func (h *requestHistory) load(entries []*historyEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(entries) > h.limit {
+		entries = entries[len(entries)-h.limit:]
+	}
+	h.entries = append([]*historyEntry(nil), entries...)
+}
+
+// saveLocked writes entry to the history file, if any.
+func (h *requestHistory) saveLocked(entry *historyEntry) {
+	if h.file != nil {
+		h.file.save(entry)
+	}
+}
+
+// record adds or updates the entry for req. A request that is released in
+// stages (e.g. a partial response) keeps a single entry.
+func (h *requestHistory) record(req *pendingRequest, outcome string) {
+	now := time.Now()
+	entry := &historyEntry{
+		ID:             req.id,
+		Method:         req.method,
+		Path:           req.path,
+		Query:          req.rawQuery,
+		RemoteAddr:     req.remoteAddr,
+		Header:         req.header,
+		Body:           req.body,
+		ReceivedAt:     req.requestTime.UTC(),
+		FinishedAt:     now.UTC(),
+		HeldFor:        now.Sub(req.requestTime).Round(time.Millisecond).String(),
+		Outcome:        outcome,
+		Status:         req.status,
+		RequestID:      req.requestID,
+		DuplicateOf:    req.duplicateOf,
+		IdempotencyKey: req.idempotencyKey,
+		Scheme:         req.scheme,
+		Host:           req.host,
+		Proto:          req.proto,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, existing := range h.entries {
+		if existing.ID == req.id {
+			entry.ResponseHeader = existing.ResponseHeader
+			entry.ResponseBody = existing.ResponseBody
+			h.entries[i] = entry
+			h.saveLocked(entry)
+			return
+		}
+	}
+	h.entries = append(h.entries, entry)
+	h.saveLocked(entry)
+	if len(h.entries) > h.limit {
+		h.entries = h.entries[len(h.entries)-h.limit:]
+	}
+}
+
+// recordResponse attaches the response sent for request id to its entry.
+func (h *requestHistory) recordResponse(id, status int, header http.Header, body []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, existing := range h.entries {
+		if existing.ID == id {
+			updated := *existing
+			updated.Status = status
+			updated.ResponseHeader = header.Clone()
+			updated.ResponseBody = body
+			h.entries[i] = &updated
+			h.saveLocked(&updated)
+			return
+		}
+	}
+}
+
+// list returns a copy of the recorded entries, oldest first.
+func (h *requestHistory) list() []*historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]*historyEntry(nil), h.entries...)
+}
+
+// find returns the entry for the given request number, or nil.
+func (h *requestHistory) find(id int) *historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, entry := range h.entries {
+		if entry.ID == id {
+			return entry
+		}
+	}
+	return nil
+}
+
+// recordHistory adds req to the history, if history is enabled, and notes
+// its outcome for the access log and statistics.
+func (s *Server) recordHistory(req *pendingRequest, outcome string) {
+	if s.history != nil {
+		s.history.record(req, outcome)
+	}
+	if req.access != nil {
+		req.access.set(req.id, time.Since(req.requestTime), outcome)
+	}
+	s.stats.record(req, outcome)
+	if s.duplicates != nil {
+		s.duplicates.finish(req)
+	}
+	if s.idempotency != nil {
+		switch outcome {
+		case "abandoned", "dropped", "reset":
+			s.idempotency.forget(req)
+		}
+	}
+}
+
+// recordResponse attaches the response sent for req to its history entry.
+func (s *Server) recordResponse(req *pendingRequest, status int, header http.Header, body []byte) {
+	if s.history != nil {
+		s.history.recordResponse(req.id, status, header, body)
+	}
+	if s.idempotency != nil {
+		s.idempotency.complete(req, status, header, body)
+	}
+}
+
+// printHistory prints one line per completed request, oldest first.
+func (s *Server) printHistory(out io.Writer) {
+	entries := s.history.list()
+	if len(entries) == 0 {
+		fmt.Fprintln(out, "No completed requests yet")
+		return
+	}
+	for _, entry := range entries {
+		status := "-"
+		if entry.Status != 0 {
+			status = fmt.Sprint(entry.Status)
+		}
+		fmt.Fprintf(out, "  #%-4d %-7s %-30s %-11s %3s  held %s\n",
+			entry.ID, entry.Method, entry.Path, entry.Outcome, status, entry.HeldFor)
+	}
+}
+
+// hopHeaders are not copied onto replayed requests.
+var hopHeaders = []string{
+	"Connection", "Content-Length", "Keep-Alive", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// replay re-sends a recorded request to the replay upstream and returns the
+// upstream's response with its body read.
+func (s *Server) replay(entry *historyEntry) (*http.Response, []byte, error) {
+	if s.replayUpstream == "" {
+		return nil, nil, fmt.Errorf("no upstream configured (set REPLAY_UPSTREAM or UPSTREAM)")
+	}
+
+	target := strings.TrimSuffix(s.replayUpstream, "/") + entry.Path
+	if entry.Query != "" {
+		target += "?" + entry.Query
+	}
+	req, err := http.NewRequest(entry.Method, target, bytes.NewReader(entry.Body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header = entry.Header.Clone()
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, err
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storedEntry is a history entry as written to HISTORY_FILE, including the
+// fields the admin API leaves out.
+type storedEntry struct {
+	historyEntry
+	Body           []byte      `json:"body,omitempty"`
+	Scheme         string      `json:"scheme,omitempty"`
+	Host           string      `json:"host,omitempty"`
+	Proto          string      `json:"proto,omitempty"`
+	ResponseHeader http.Header `json:"response_headers,omitempty"`
+	ResponseBody   []byte      `json:"response_body,omitempty"`
+}
+
+func newStoredEntry(entry *historyEntry) storedEntry {
+	return storedEntry{
+		historyEntry:   *entry,
+		Body:           entry.Body,
+		Scheme:         entry.Scheme,
+		Host:           entry.Host,
+		Proto:          entry.Proto,
+		ResponseHeader: entry.ResponseHeader,
+		ResponseBody:   entry.ResponseBody,
+	}
+}
+
+func (e storedEntry) entry() *historyEntry {
+	entry := e.historyEntry
+	entry.Body = e.Body
+	entry.Scheme = e.Scheme
+	entry.Host = e.Host
+	entry.Proto = e.Proto
+	entry.ResponseHeader = e.ResponseHeader
+	entry.ResponseBody = e.ResponseBody
+	return &entry
+}
+
+// historyFile appends every change to a history entry to a JSON Lines file,
+// so that a session's history survives restarts. A request updated several
+// times appears once per update; the last line wins when loading.
+type historyFile struct {
+	mu   sync.Mutex
+	file *os.File
+	warn func(format string, args ...interface{})
+
+	failed bool
+}
+
+// openHistoryFile loads the entries previously saved in path, compacts the
+// file to one line per request and opens it for appending.
+func openHistoryFile(path string, warn func(string, ...interface{})) (*historyFile, []*historyEntry, error) {
+	entries, err := readHistoryFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		enc.Encode(newStoredEntry(entry))
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return nil, nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &historyFile{file: file, warn: warn}, entries, nil
+}
+
+// readHistoryFile returns the entries saved in path, oldest first. A missing
+// file has none.
+func readHistoryFile(path string) ([]*historyEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []*historyEntry
+	index := make(map[int]int)
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			var stored storedEntry
+			if jsonErr := json.Unmarshal(data, &stored); jsonErr != nil {
+				// A crash can leave a partial last line behind
+				if err == io.EOF {
+					break
+				}
+				return nil, fmt.Errorf("%s:%d: %v", path, line, jsonErr)
+			}
+			if i, ok := index[stored.ID]; ok {
+				entries[i] = stored.entry()
+			} else {
+				index[stored.ID] = len(entries)
+				entries = append(entries, stored.entry())
+			}
+		}
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// save appends entry to the file. Failures are reported once.
+func (f *historyFile) save(entry *historyEntry) {
+	data, err := json.Marshal(newStoredEntry(entry))
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		_, err = f.file.Write(append(data, '\n'))
+	}
+	if err != nil && !f.failed {
+		f.failed = true
+		f.warn("Failed to save history to %s: %v", f.file.Name(), err)
+	}
+}
+
+// entries returns every entry saved in the file, oldest first.
+func (f *historyFile) entries() ([]*historyEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return readHistoryFile(f.file.Name())
+}
+
+// writeSQL writes the history as SQL statements that create and fill a
+// requests table, for loading into SQLite with "sqlite3 debug.db < file".
+// With HISTORY_FILE that is the whole file, not just the last HISTORY_SIZE
+// requests.
+func (s *Server) writeSQL(w io.Writer) (int, error) {
+	entries := s.history.list()
+	if s.history.file != nil {
+		var err error
+		if entries, err = s.history.file.entries(); err != nil {
+			return 0, err
+		}
+	}
+	b := bufio.NewWriter(w)
+	b.WriteString(`CREATE TABLE IF NOT EXISTS requests (
+  id INTEGER PRIMARY KEY,
+  method TEXT,
+  path TEXT,
+  query TEXT,
+  remote_addr TEXT,
+  received_at TEXT,
+  finished_at TEXT,
+  held_ms REAL,
+  outcome TEXT,
+  status INTEGER,
+  request_headers TEXT,
+  request_body BLOB,
+  response_headers TEXT,
+  response_body BLOB
+);
+BEGIN;
+`)
+	for _, e := range entries {
+		requestHeaders, _ := json.Marshal(e.Header)
+		responseHeaders, _ := json.Marshal(e.ResponseHeader)
+		held := float64(e.FinishedAt.Sub(e.ReceivedAt)) / float64(time.Millisecond)
+		fmt.Fprintf(b, "INSERT OR REPLACE INTO requests VALUES (%d, %s, %s, %s, %s, %s, %s, %s, %s, %d, %s, %s, %s, %s);\n",
+			e.ID, sqlString(e.Method), sqlString(e.Path), sqlString(e.Query), sqlString(e.RemoteAddr),
+			sqlString(e.ReceivedAt.Format(time.RFC3339Nano)), sqlString(e.FinishedAt.Format(time.RFC3339Nano)),
+			strconv.FormatFloat(held, 'f', 3, 64), sqlString(e.Outcome), e.Status,
+			sqlString(string(requestHeaders)), sqlBlob(e.Body), sqlString(string(responseHeaders)), sqlBlob(e.ResponseBody))
+	}
+	b.WriteString("COMMIT;\n")
+	return len(entries), b.Flush()
+}
+
+// writeSQLFile writes the history to file with writeSQL.
+func (s *Server) writeSQLFile(file string) (int, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, err
+	}
+	count, err := s.writeSQL(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return count, err
+}
+
+// sqlString quotes s as an SQL string literal.
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// sqlBlob quotes data as an SQL blob literal, or NULL if there is none.
+func sqlBlob(data []byte) string {
+	if data == nil {
+		return "NULL"
+	}
+	return "X'" + hex.EncodeToString(data) + "'"
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// idempotencyKeyLimit is how many Idempotency-Key values are remembered; the
+// oldest are forgotten first.
+const idempotencyKeyLimit = 1000
+
+// idempotencyTracker follows the Idempotency-Key header across requests. It
+// flags a key that arrives again, warns when the repeat has a different
+// method, path or body than the first request, and in replay mode answers
+// repeats the way an idempotent API would: with the first response, 409 while
+// the first request is still pending, or 422 for a mismatch.
+type idempotencyTracker struct {
+	replay bool
+
+	mu    sync.Mutex
+	keys  map[string]*idempotencyEntry
+	order []string
+}
+
+// idempotencyEntry is the first request seen with a key, and in replay mode
+// its response once it has been sent.
+type idempotencyEntry struct {
+	id          int
+	fingerprint string
+	done        bool
+	status      int
+	header      http.Header
+	body        []byte
+}
+
+// parseIdempotency parses IDEMPOTENCY: warn (the default) or replay; off
+// disables tracking and returns nil.
+func parseIdempotency(mode string) (*idempotencyTracker, error) {
+	switch mode {
+	case "", "warn":
+		return newIdempotencyTracker(false), nil
+	case "replay":
+		return newIdempotencyTracker(true), nil
+	case "off", "0":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("invalid IDEMPOTENCY %q (want warn, replay or off)", mode)
+	}
+}
+
+func newIdempotencyTracker(replay bool) *idempotencyTracker {
+	return &idempotencyTracker{replay: replay, keys: make(map[string]*idempotencyEntry)}
+}
+
+// note remembers the numbered req as the first request with its key, or, if
+// the key was seen before, marks req as a repeat and whether it conflicts.
+// Requests whose body has not been read yet are skipped.
+func (t *idempotencyTracker) note(req *pendingRequest) {
+	if req.idempotencyKey == "" || req.fingerprint == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if entry, ok := t.keys[req.idempotencyKey]; ok {
+		if entry.id != req.id {
+			req.idempotentRepeatOf = entry.id
+			req.idempotencyConflict = entry.fingerprint != req.fingerprint
+		}
+		return
+	}
+	t.keys[req.idempotencyKey] = &idempotencyEntry{id: req.id, fingerprint: req.fingerprint}
+	t.order = append(t.order, req.idempotencyKey)
+	if len(t.order) > idempotencyKeyLimit {
+		delete(t.keys, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// lookup returns a copy of the entry for key, if any.
+func (t *idempotencyTracker) lookup(key string) (idempotencyEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.keys[key]
+	if !ok {
+		return idempotencyEntry{}, false
+	}
+	return *entry, true
+}
+
+// complete marks the key of req as answered if req was the first request
+// with it. The response itself is only kept in replay mode, which sends it
+// again.
+func (t *idempotencyTracker) complete(req *pendingRequest, status int, header http.Header, body []byte) {
+	if req.idempotencyKey == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.keys[req.idempotencyKey]
+	if !ok || entry.id != req.id {
+		return
+	}
+	entry.done = true
+	if t.replay {
+		entry.status, entry.header, entry.body = status, header.Clone(), body
+	}
+}
+
+// forget drops the key of req if it was the first request with it and never
+// got a response (it was dropped or abandoned), so that a retry is handled
+// afresh.
+func (t *idempotencyTracker) forget(req *pendingRequest) {
+	if req.idempotencyKey == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if entry, ok := t.keys[req.idempotencyKey]; ok && entry.id == req.id && !entry.done {
+		delete(t.keys, req.idempotencyKey)
+		for i, key := range t.order {
+			if key == req.idempotencyKey {
+				t.order = append(t.order[:i], t.order[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// serveIdempotent answers a repeated Idempotency-Key without holding it when
+// IDEMPOTENCY=replay: with the stored response if the first request has been
+// answered, 409 if it is still pending, or 422 if the repeat does not match
+// it. It reports whether it answered.
+func (s *Server) serveIdempotent(w http.ResponseWriter, req *pendingRequest) bool {
+	if s.idempotency == nil || !s.idempotency.replay || req.idempotencyKey == "" {
+		return false
+	}
+	entry, ok := s.idempotency.lookup(req.idempotencyKey)
+	if !ok {
+		return false
+	}
+
+	s.numberRequest(req)
+	req.releaseCause = "idempotent"
+
+	var outcome, detail string
+	switch {
+	case entry.fingerprint != req.fingerprint:
+		outcome = "conflict"
+		detail = fmt.Sprintf("Idempotency-Key %q was first used by #%d for a different request; answered 422", req.idempotencyKey, entry.id)
+		req.status = http.StatusUnprocessableEntity
+		writeJSON(w, req.status, map[string]string{"error": "Idempotency-Key reused with a different request"})
+	case !entry.done:
+		outcome = "conflict"
+		detail = fmt.Sprintf("Idempotency-Key %q is in use by #%d, still pending; answered 409", req.idempotencyKey, entry.id)
+		req.status = http.StatusConflict
+		writeJSON(w, req.status, map[string]string{"error": "a request with this Idempotency-Key is still in progress"})
+	default:
+		outcome = "replayed"
+		detail = fmt.Sprintf("Idempotency-Key %q: answered with the response to #%d", req.idempotencyKey, entry.id)
+		for name, values := range entry.header {
+			switch name {
+			case "Content-Encoding", "Content-Length", "Trailer", "Date", "X-Request-Id":
+				continue
+			}
+			w.Header()[name] = values
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.Header().Set("Content-Length", strconv.Itoa(len(entry.body)))
+		req.status = entry.status
+		if req.status == 0 {
+			req.status = http.StatusOK
+		}
+		w.WriteHeader(req.status)
+		w.Write(entry.body)
+	}
+
+	s.recordHistory(req, outcome)
+	s.publish(newRequestEvent(outcome, req))
+	s.served.Add(1)
+	if s.logger != nil {
+		s.logger.Info("request answered for idempotency key", append(requestAttrs(req), "outcome", outcome)...)
+		return true
+	}
+	s.logRequest(req, outcome, "%s (not held)", detail)
+	return true
+}
+
+// idempotencyNote describes how req relates to an earlier request with the
+// same Idempotency-Key for the console, or returns "".
+func (s *Server) idempotencyNote(req *pendingRequest) string {
+	switch {
+	case req.idempotentRepeatOf == 0:
+		return ""
+	case req.idempotencyConflict:
+		return s.paint(ansiRed, fmt.Sprintf("Idempotency-Key %q was first used by #%d with a different method, path or body", req.idempotencyKey, req.idempotentRepeatOf))
+	default:
+		return fmt.Sprintf("Idempotency-Key %q repeats #%d", req.idempotencyKey, req.idempotentRepeatOf)
+	}
+}
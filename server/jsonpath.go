@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// queryJSON extracts the value at path from a decoded JSON document. Paths
+// use a jq-like subset: "." is the whole document, ".items[0].id" selects
+// by field name and array index (negative indexes count from the end), and
+// .["odd key"] quotes field names that are not plain identifiers.
+func queryJSON(doc interface{}, path string) (interface{}, error) {
+	rest := strings.TrimSpace(path)
+	if !strings.HasPrefix(rest, ".") {
+		return nil, fmt.Errorf("path %q must start with \".\"", path)
+	}
+	rest = rest[1:]
+	value := doc
+	at := "."
+	for rest != "" {
+		switch {
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ] in %q", path)
+			}
+			key := rest[1:end]
+			rest = strings.TrimPrefix(rest[end+1:], ".")
+			if unquoted, err := strconv.Unquote(key); err == nil {
+				next, err := jsonField(value, unquoted, at)
+				if err != nil {
+					return nil, err
+				}
+				value, at = next, at+"["+key+"]"
+				continue
+			}
+			index, err := strconv.Atoi(key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index [%s] in %q", key, path)
+			}
+			array, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s is not an array", at)
+			}
+			if index < 0 {
+				index += len(array)
+			}
+			if index < 0 || index >= len(array) {
+				return nil, fmt.Errorf("%s has no element [%s] (length %d)", at, key, len(array))
+			}
+			value, at = array[index], at+"["+key+"]"
+		case rest[0] == '.':
+			return nil, fmt.Errorf("empty field name in %q", path)
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			name := rest[:end]
+			rest = strings.TrimPrefix(rest[end:], ".")
+			next, err := jsonField(value, name, at)
+			if err != nil {
+				return nil, err
+			}
+			value, at = next, strings.TrimSuffix(at, ".")+"."+name
+		}
+	}
+	return value, nil
+}
+
+// jsonField returns the field name of value, which must be an object.
+func jsonField(value interface{}, name, at string) (interface{}, error) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not an object", at)
+	}
+	field, ok := object[name]
+	if !ok {
+		return nil, fmt.Errorf("%s has no field %q", at, name)
+	}
+	return field, nil
+}
+
+// prettyJSON indents body if it is JSON, reporting whether it was. Field
+// order and numbers are kept as sent.
+func prettyJSON(body []byte) (string, bool) {
+	var buf bytes.Buffer
+	if json.Indent(&buf, bytes.TrimSpace(body), "", "  ") != nil {
+		return "", false
+	}
+	return buf.String(), true
+}
+
+// queryBody extracts path from req's JSON body and formats the result as
+// indented JSON.
+func queryBody(req *pendingRequest, path string) (string, error) {
+	if int64(len(req.body)) < req.bodySize {
+		return "", fmt.Errorf("the body was truncated at %d bytes", len(req.body))
+	}
+	decoder := json.NewDecoder(bytes.NewReader(req.body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return "", fmt.Errorf("the body is not JSON: %v", err)
+	}
+	value, err := queryJSON(doc, path)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxProfileDelay caps sampled delays so a heavy-tailed profile can't hold a
+// request practically forever.
+const maxProfileDelay = 5 * time.Minute
+
+// latencyProfile automatically releases held requests after a sampled delay.
+type latencyProfile struct {
+	// spec is the profile as configured, e.g. "normal:500ms±200ms".
+	spec   string
+	sample func() time.Duration
+}
+
+// parseLatencyProfile parses a LATENCY_PROFILE value:
+//
+//	fixed:<d>                 always wait d
+//	uniform:<min>-<max>       wait uniformly between min and max
+//	normal:<mean>±<stddev>    normally distributed; "+-" may be used for "±"
+//	pareto[:<scale>[,<alpha>]]  heavy-tailed; defaults to 100ms and 1.16
+//	                          (the 80/20 rule)
+//
+// Sampled delays are clamped to [0, 5m].
+func parseLatencyProfile(value string) (*latencyProfile, error) {
+	name, args, _ := strings.Cut(value, ":")
+	profile := &latencyProfile{spec: value}
+
+	switch name {
+	case "fixed":
+		d, err := time.ParseDuration(args)
+		if err != nil {
+			return nil, fmt.Errorf("fixed profile needs a duration such as fixed:2s: %v", err)
+		}
+		profile.sample = func() time.Duration { return d }
+	case "uniform":
+		lo, hi, err := parseDurationRange(args)
+		if err != nil {
+			return nil, fmt.Errorf("uniform profile needs a range such as uniform:100ms-2s: %v", err)
+		}
+		profile.sample = func() time.Duration {
+			return lo + time.Duration(rand.Int63n(int64(hi-lo)+1))
+		}
+	case "normal":
+		meanText, stddevText, found := strings.Cut(strings.Replace(args, "+-", "±", 1), "±")
+		if !found {
+			return nil, fmt.Errorf("normal profile needs a mean and deviation such as normal:500ms±200ms")
+		}
+		mean, err := time.ParseDuration(meanText)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mean %q: %v", meanText, err)
+		}
+		stddev, err := time.ParseDuration(stddevText)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deviation %q: %v", stddevText, err)
+		}
+		profile.sample = func() time.Duration {
+			return mean + time.Duration(rand.NormFloat64()*float64(stddev))
+		}
+	case "pareto":
+		scale, alpha := 100*time.Millisecond, 1.16
+		if args != "" {
+			scaleText, alphaText, hasAlpha := strings.Cut(args, ",")
+			var err error
+			if scale, err = time.ParseDuration(scaleText); err != nil {
+				return nil, fmt.Errorf("invalid pareto scale %q: %v", scaleText, err)
+			}
+			if hasAlpha {
+				if alpha, err = strconv.ParseFloat(alphaText, 64); err != nil || alpha <= 0 {
+					return nil, fmt.Errorf("invalid pareto alpha %q", alphaText)
+				}
+			}
+		}
+		profile.sample = func() time.Duration {
+			// Inverse transform sampling; 1-Float64 is in (0, 1]
+			return time.Duration(float64(scale) / math.Pow(1-rand.Float64(), 1/alpha))
+		}
+	default:
+		return nil, fmt.Errorf("unknown latency profile %q (expected fixed, uniform, normal or pareto)", name)
+	}
+	return profile, nil
+}
+
+// delay samples the profile, clamped to [0, maxProfileDelay].
+func (p *latencyProfile) delay() time.Duration {
+	d := p.sample()
+	if d < 0 {
+		return 0
+	}
+	if d > maxProfileDelay {
+		return maxProfileDelay
+	}
+	return d
+}
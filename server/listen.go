@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// listenAddrs collects repeated -listen flags.
+type listenAddrs []string
+
+func (l *listenAddrs) String() string { return strings.Join(*l, ",") }
+
+func (l *listenAddrs) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// listenAddress normalizes a listen address: "unix:<path>" for a Unix domain
+// socket, otherwise "[host]:port" or a bare port number.
+func listenAddress(value string) string {
+	if strings.HasPrefix(value, "unix:") || strings.Contains(value, ":") {
+		return value
+	}
+	return ":" + value
+}
+
+// listen opens a listener for addr as returned by listenAddress. A stale
+// socket file left behind by a previous run is removed first; the listener
+// removes its own socket file when it is closed.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Malformed response modes, selected with MALFORMED or the X-Debug-Malformed
+// control header:
+//
+//   - content-length: Content-Length claims more bytes than are sent before
+//     the connection closes
+//   - chunking: chunked framing with the CRLF after the chunk data missing
+//   - garbage: junk bytes written before the status line
+//   - truncate: a correctly framed body cut in half, e.g. invalid JSON
+var malformedModes = []string{"content-length", "chunking", "garbage", "truncate"}
+
+// parseMalformed validates a malformed response mode.
+func parseMalformed(value string) (string, error) {
+	for _, mode := range malformedModes {
+		if value == mode {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("invalid malformed mode %q (want content-length, chunking, garbage or truncate)", value)
+}
+
+// serveMalformed answers r with a response that violates HTTP in the way
+// req.malformed selects. Unlike normal responses, nothing is sent while the
+// request is held so that the status line itself can be corrupted.
+func (s *Server) serveMalformed(w http.ResponseWriter, r *http.Request, req *pendingRequest, held bool, status int) {
+	if held {
+		if !s.waitForRelease(r.Context(), req) {
+			return
+		}
+		if req.dropped {
+			s.abortResponse(w, req)
+			return
+		}
+		s.logReleased(req, fmt.Sprintf("Malformed response (%s) sent", req.malformed))
+	}
+	if req.releaseStatus != 0 {
+		status = req.releaseStatus
+	}
+	req.status = status
+
+	header := http.Header{}
+	header.Set("Content-Type", s.contentType)
+	if rt := req.route; rt != nil {
+		if rt.ContentType != "" {
+			header.Set("Content-Type", rt.ContentType)
+		}
+		for name, value := range rt.Headers {
+			header.Set(name, value)
+		}
+	}
+	header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	header.Set("Connection", "close")
+
+	var rendered bytes.Buffer
+	s.writeBody(&rendered, r, req, time.Now())
+	body := rendered.Bytes()
+	s.recordResponse(req, status, header, body)
+
+	var out bytes.Buffer
+	switch req.malformed {
+	case "garbage":
+		out.WriteString("\x00\xff\xfeGARBAGE\r\n")
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	case "content-length":
+		header.Set("Content-Length", strconv.Itoa(len(body)+1024))
+	case "chunking":
+		header.Set("Transfer-Encoding", "chunked")
+		body = []byte(fmt.Sprintf("%x\r\n%s0\r\n\r\n", len(body), body))
+	case "truncate":
+		body = body[:len(body)/2]
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	fmt.Fprintf(&out, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	header.Write(&out)
+	out.WriteString("\r\n")
+	out.Write(body)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		s.warnf("Request #%d: Cannot send a malformed response over %s; sending a normal one", req.id, r.Proto)
+		w.WriteHeader(status)
+		w.Write(rendered.Bytes())
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		s.warnf("Request #%d: Failed to take over the connection: %v", req.id, err)
+		return
+	}
+	defer conn.Close()
+	conn.Write(out.Bytes())
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware wraps the handler that holds and answers requests. Embedding
+// code registers its own with Server.Use; built-in ones are configured with
+// MIDDLEWARE or per route (see middlewareSpec).
+type Middleware func(http.Handler) http.Handler
+
+// registeredMiddleware is a Middleware added with Server.Use.
+type registeredMiddleware struct {
+	pattern    string
+	middleware Middleware
+}
+
+// Use adds middleware for requests whose path matches pattern (a prefix or
+// glob, as for the release command; "/" matches everything). Middleware runs
+// in the order it was added, outside MIDDLEWARE and route middleware. Use
+// must be called before the server starts handling requests.
+func (s *Server) Use(pattern string, middleware ...Middleware) {
+	for _, m := range middleware {
+		s.middleware = append(s.middleware, registeredMiddleware{pattern, m})
+	}
+}
+
+// Handler returns the handler for the main listener: handleRequest wrapped in
+// the middleware that applies to each request.
+func (s *Server) Handler() http.Handler {
+	final := http.HandlerFunc(s.handleRequest)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.closeConnection(w, r)
+		r = withRequestID(w, r)
+
+		start := time.Now()
+		r, record := s.withAccessRecord(r)
+		if record != nil {
+			rec := &statusRecorder{ResponseWriter: w}
+			w = rec
+			defer s.accessLog.log(r, start, rec, record)
+		}
+
+		var chain []Middleware
+		for _, m := range s.middleware {
+			if matchPath(m.pattern, r.URL.Path) {
+				chain = append(chain, m.middleware)
+			}
+		}
+		for _, spec := range s.builtinMiddleware {
+			chain = append(chain, s.builtin(spec))
+		}
+		if rt := s.matchRoute(r); rt != nil {
+			for _, spec := range rt.middleware {
+				chain = append(chain, s.builtin(spec))
+			}
+		}
+
+		var h http.Handler = final
+		for i := len(chain) - 1; i >= 0; i-- {
+			h = chain[i](h)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// middlewareSpec is a parsed built-in middleware:
+//
+//   - log: prints each request and its status and duration
+//   - capture:<dir>: writes each request, with its body, to a file in dir
+//   - auth:basic:<user>:<password> or auth:bearer:<token>: answers requests
+//     without those credentials with 401 or 403 at once
+//   - delay:<duration>: waits before the request reaches the next handler
+type middlewareSpec struct {
+	name  string
+	dir   string
+	auth  *authConfig
+	delay time.Duration
+}
+
+// parseMiddlewareSpecs parses a list of built-in middleware names with their
+// arguments, e.g. ["log", "delay:2s"].
+func parseMiddlewareSpecs(specs []string) ([]middlewareSpec, error) {
+	var parsed []middlewareSpec
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, arg, _ := strings.Cut(spec, ":")
+		m := middlewareSpec{name: name}
+		switch name {
+		case "log":
+		case "capture":
+			if arg == "" {
+				return nil, fmt.Errorf("middleware %q needs a directory (capture:<dir>)", spec)
+			}
+			m.dir = arg
+		case "auth":
+			auth, err := parseAuth(arg)
+			if err != nil {
+				return nil, fmt.Errorf("middleware %q: %v", spec, err)
+			}
+			m.auth = auth
+		case "delay":
+			delay, err := parseDelay(arg)
+			if err != nil {
+				return nil, fmt.Errorf("middleware %q: %v", spec, err)
+			}
+			m.delay = delay
+		default:
+			return nil, fmt.Errorf("unknown middleware %q (want log, capture, auth or delay)", name)
+		}
+		parsed = append(parsed, m)
+	}
+	return parsed, nil
+}
+
+// builtin returns the Middleware for spec.
+func (s *Server) builtin(spec middlewareSpec) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch spec.name {
+			case "log":
+				start := time.Now()
+				rec := &statusRecorder{ResponseWriter: w}
+				s.printf("[%s] --> %s %s from %s\n", start.Format("15:04:05"), r.Method, r.URL.Path, r.RemoteAddr)
+				next.ServeHTTP(rec, r)
+				s.printf("[%s] <-- %s %s: %d in %s\n", time.Now().Format("15:04:05"), r.Method, r.URL.Path, rec.status(), time.Since(start))
+				return
+			case "capture":
+				s.capture(spec.dir, r)
+			case "auth":
+				if failure := spec.auth.check(r, r.RemoteAddr); failure != nil {
+					if failure.challenge != "" {
+						w.Header().Set("WWW-Authenticate", failure.challenge)
+					}
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(failure.status)
+					w.Write(failure.body())
+					return
+				}
+			case "delay":
+				if !sleepContext(r.Context(), spec.delay) {
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// captureCounter numbers capture files so that concurrent requests never
+// share a name.
+var captureCounter atomic.Int64
+
+// capture writes r, including its body, to a new file in dir.
+func (s *Server) capture(dir string, r *http.Request) {
+	dump, err := httputil.DumpRequest(r, true)
+	if err == nil {
+		err = os.MkdirAll(dir, 0o755)
+	}
+	if err == nil {
+		name := fmt.Sprintf("%s-%04d-%s.http", time.Now().Format("20060102-150405"), captureCounter.Add(1), r.Method)
+		err = os.WriteFile(filepath.Join(dir, name), dump, 0o644)
+	}
+	if err != nil {
+		s.warnf("Failed to capture %s %s: %v", r.Method, r.URL.Path, err)
+	}
+}
+
+// statusRecorder remembers the status code and counts the body bytes written
+// through it. It passes flushing and hijacking through, which holding and
+// resetting rely on.
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
@@ -0,0 +1,62 @@
+package server_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"variable-debug-web-server/server"
+)
+
+// TestUseOrder checks that middleware added with Use runs in the order it
+// was added, and only for the paths it was added for.
+func TestUseOrder(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	trace := func(name string) server.Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				calls = append(calls, name)
+				mu.Unlock()
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	s := server.NewServer()
+	s.Use("/", trace("first"), trace("second"))
+	s.Use("/api", trace("api"))
+	s.Use("/", trace("last"))
+	s.OnHold = func(req server.HeldRequest) { s.Release(req.ID) }
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/api/orders", "first second api last"},
+		{"/other", "first second last"},
+	} {
+		mu.Lock()
+		calls = nil
+		mu.Unlock()
+		resp, err := http.Get(ts.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		mu.Lock()
+		got := strings.Join(calls, " ")
+		mu.Unlock()
+		if got != tc.want {
+			t.Errorf("GET %s ran %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
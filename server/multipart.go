@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// formPart describes one part of a multipart/form-data body.
+type formPart struct {
+	Name        string `json:"name"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size"`
+	SavedAs     string `json:"saved_as,omitempty"`
+}
+
+// eachFormPart calls fn with every part of req's body if it is
+// multipart/form-data, reporting whether it is. A body truncated by
+// maxCapturedBody ends with an error after the parts that were complete.
+func (req *pendingRequest) eachFormPart(fn func(i int, part *multipart.Part) error) (bool, error) {
+	mediaType, params, err := mime.ParseMediaType(req.header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return false, nil
+	}
+	reader := multipart.NewReader(bytes.NewReader(req.body), params["boundary"])
+	for i := 0; ; i++ {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+		if err != nil {
+			return true, err
+		}
+		err = fn(i, part)
+		part.Close()
+		if err != nil {
+			return true, err
+		}
+	}
+}
+
+// formParts lists the parts of req's body, or returns nil if it is not
+// multipart/form-data.
+func (req *pendingRequest) formParts() ([]formPart, error) {
+	var parts []formPart
+	_, err := req.eachFormPart(func(i int, part *multipart.Part) error {
+		size, err := io.Copy(io.Discard, part)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, formPart{
+			Name:        part.FormName(),
+			Filename:    part.FileName(),
+			ContentType: part.Header.Get("Content-Type"),
+			Size:        size,
+			SavedAs:     req.savedParts[i],
+		})
+		return nil
+	})
+	return parts, err
+}
+
+// saveFormFiles writes the file parts of req's body to MULTIPART_DIR.
+func (s *Server) saveFormFiles(req *pendingRequest) {
+	_, err := req.eachFormPart(func(i int, part *multipart.Part) error {
+		if part.FileName() == "" {
+			return nil
+		}
+		if err := os.MkdirAll(s.multipartDir, 0o755); err != nil {
+			return err
+		}
+		name := fmt.Sprintf("%s-%04d-%s", time.Now().Format("20060102-150405"), captureCounter.Add(1), filepath.Base(part.FileName()))
+		file, err := os.Create(filepath.Join(s.multipartDir, name))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, part)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if req.savedParts == nil {
+			req.savedParts = make(map[int]string)
+		}
+		req.savedParts[i] = file.Name()
+		return nil
+	})
+	if err != nil {
+		s.warnf("Failed to save the uploaded files of %s %s: %v", req.method, req.path, err)
+	}
+}
+
+// printFormParts prints the parts of a multipart/form-data body, if req has
+// one.
+func printFormParts(out io.Writer, req *pendingRequest) {
+	parts, err := req.formParts()
+	if len(parts) == 0 && err == nil {
+		return
+	}
+	fmt.Fprintf(out, "Form parts (%d):\n", len(parts))
+	for _, part := range parts {
+		var details []string
+		if part.Filename != "" {
+			details = append(details, fmt.Sprintf("file %q", part.Filename))
+		}
+		if part.ContentType != "" {
+			details = append(details, part.ContentType)
+		}
+		details = append(details, formatSize(part.Size))
+		if part.SavedAs != "" {
+			details = append(details, "saved as "+part.SavedAs)
+		}
+		fmt.Fprintf(out, "  %s: %s\n", part.Name, strings.Join(details, ", "))
+	}
+	if err != nil {
+		fmt.Fprintf(out, "  (stopped listing parts: %v)\n", err)
+	}
+	fmt.Fprintln(out)
+}
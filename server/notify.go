@@ -0,0 +1,63 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// notifier alerts the user that a request has been put on hold.
+type notifier struct {
+	mode string // "bell" or "desktop"
+
+	// warnOnce reports a failing desktop notifier only once.
+	warnOnce sync.Once
+}
+
+// parseNotifier validates a NOTIFY value.
+func parseNotifier(mode string) (*notifier, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case "bell":
+	case "desktop":
+		if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+			return nil, fmt.Errorf("desktop notifications are not supported on %s", runtime.GOOS)
+		}
+	default:
+		return nil, fmt.Errorf("invalid NOTIFY %q (want bell or desktop)", mode)
+	}
+	return &notifier{mode: mode}, nil
+}
+
+// notify rings the terminal bell or raises a desktop notification for req.
+func (s *Server) notify(req *pendingRequest) {
+	if s.notifier == nil {
+		return
+	}
+	if s.notifier.mode == "bell" {
+		// The bell goes to stderr so it also rings with LOG_FORMAT=json
+		fmt.Fprint(os.Stderr, "\a")
+		return
+	}
+
+	title := fmt.Sprintf("Request #%d held", req.id)
+	message := fmt.Sprintf("%s %s from %s", req.method, req.path, req.remoteAddr)
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("osascript", "-e",
+			fmt.Sprintf("display notification %s with title %s", strconv.Quote(message), strconv.Quote(title)))
+	} else {
+		cmd = exec.Command("notify-send", title, message)
+	}
+	go func() {
+		if err := cmd.Run(); err != nil {
+			s.notifier.warnOnce.Do(func() {
+				s.warnf("Desktop notification failed: %v", err)
+			})
+		}
+	}()
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// option is a setting that can be given as a command-line flag, an
+// environment variable or a -config file entry, in that order of precedence.
+// The rest of the program reads options from the environment only.
+type option struct {
+	flag  string
+	env   string
+	usage string
+
+	// isBool options are switches: "-echo" is the same as ECHO=1.
+	isBool bool
+}
+
+var options = []option{
+	{flag: "port", env: "PORT", usage: "port to listen on (default 8080)"},
+	{flag: "ports", env: "PORTS", usage: "comma-separated ports, each with its own queue"},
+	{flag: "admin-port", env: "ADMIN_PORT", usage: "port for the admin API and dashboard"},
+	{flag: "status", env: "STATUS", usage: "response status code (default 200)"},
+	{flag: "content-type", env: "CONTENT_TYPE", usage: "response Content-Type (default text/plain)"},
+	{flag: "body", env: "BODY_TEMPLATE", usage: "response body template"},
+	{flag: "body-file", env: "BODY_TEMPLATE_FILE", usage: "file containing the response body template"},
+	{flag: "body-size", env: "BODY_SIZE", usage: "generate a body of this size (e.g. 10MB) instead"},
+	{flag: "body-pattern", env: "BODY_PATTERN", usage: "generated body content: repeat or random"},
+	{flag: "routes", env: "ROUTES_FILE", usage: "JSON file of per-path canned responses"},
+	{flag: "fixtures", env: "FIXTURES_DIR", usage: "directory of response bodies laid out by request path"},
+	{flag: "echo", env: "ECHO", usage: "answer with a JSON description of the request", isBool: true},
+	{flag: "auto-release", env: "HOLD_TIMEOUT", usage: "release each request automatically after this long (e.g. 30s)"},
+	{flag: "profile", env: "LATENCY_PROFILE", usage: "latency profile such as fixed:2s or normal:500ms±200ms"},
+	{flag: "session-cookie", env: "SESSION_COOKIE", usage: "cookie identifying clients; set on responses to requests without it"},
+	{flag: "set-cookie", env: "SET_COOKIE", usage: "Set-Cookie values for every response, separated by |"},
+	{flag: "client-header", env: "CLIENT_HEADER", usage: "request header identifying clients (default: remote IP)"},
+	{flag: "release-trigger", env: "RELEASE_TRIGGER", usage: "release all pending requests when this file is touched"},
+	{flag: "release-order", env: "RELEASE_ORDER", usage: "order of batch releases: fifo, lifo or random"},
+	{flag: "hold-rules", env: "HOLD_RULES", usage: `hold only matching requests, e.g. "POST /api, /users/*"`},
+	{flag: "body-rules", env: "BODY_RULES", usage: `decide by JSON body, e.g. ".amount > 1000 => hold; * => pass"`},
+	{flag: "hold-percent", env: "HOLD_PERCENT", usage: "hold only this random percentage of requests (e.g. 20)"},
+	{flag: "hold-every", env: "HOLD_EVERY", usage: "hold only every Nth request"},
+	{flag: "hold-first", env: "HOLD_FIRST", usage: "hold only the first N requests"},
+	{flag: "bypass-paths", env: "BYPASS_PATHS", usage: "paths answered immediately (default /healthz,/readyz)"},
+	{flag: "max-pending", env: "MAX_PENDING", usage: "answer requests beyond this many pending with 503"},
+	{flag: "middleware", env: "MIDDLEWARE", usage: "built-in middleware to apply, e.g. log,capture:<dir>,delay:1s"},
+	{flag: "cors-origins", env: "CORS_ORIGINS", usage: "allowed CORS origins, comma-separated, or *"},
+	{flag: "cors-methods", env: "CORS_METHODS", usage: "preflight Allow-Methods (default: the requested method)"},
+	{flag: "cors-headers", env: "CORS_HEADERS", usage: "preflight Allow-Headers (default: the requested headers)"},
+	{flag: "cors-expose-headers", env: "CORS_EXPOSE_HEADERS", usage: "Access-Control-Expose-Headers for responses"},
+	{flag: "cors-max-age", env: "CORS_MAX_AGE", usage: "preflight Access-Control-Max-Age in seconds"},
+	{flag: "cors-credentials", env: "CORS_CREDENTIALS", usage: "allow credentialed CORS requests", isBool: true},
+	{flag: "cors-preflight", env: "CORS_PREFLIGHT", usage: "answer preflights immediate (default) or after a hold"},
+	{flag: "auth", env: "AUTH", usage: "required credentials: basic:user:password or bearer:token, comma-separated"},
+	{flag: "auth-failure", env: "AUTH_FAILURE", usage: "answer auth failures immediate (default) or after a hold"},
+	{flag: "auth-expire-first", env: "AUTH_EXPIRE_FIRST", usage: "fail each client's first valid request as an expired token", isBool: true},
+	{flag: "expect-continue", env: "EXPECT_CONTINUE", usage: "Expect: 100-continue handling: auto, hold or refuse"},
+	{flag: "hold-body-read", env: "HOLD_BODY_READ", usage: "hold before reading request bodies (before) or after this many bytes"},
+	{flag: "upload-progress", env: "UPLOAD_PROGRESS", usage: "print upload progress of request bodies at this interval"},
+	{flag: "upload-dir", env: "UPLOAD_DIR", usage: "save every request body in full to this directory"},
+	{flag: "proto-descriptors", env: "PROTO_DESCRIPTORS", usage: "FileDescriptorSet for decoding protobuf and gRPC-Web bodies"},
+	{flag: "multipart-dir", env: "MULTIPART_DIR", usage: "save files uploaded as multipart/form-data to this directory"},
+	{flag: "connection-close", env: "CONNECTION_CLOSE", usage: "send Connection: close with every response", isBool: true},
+	{flag: "max-conn-requests", env: "MAX_CONN_REQUESTS", usage: "close connections after this many requests"},
+	{flag: "keep-alive", env: "KEEP_ALIVE", usage: "HTTP keep-alives: 1 (default) or 0"},
+	{flag: "read-header-timeout", env: "READ_HEADER_TIMEOUT", usage: "time allowed for reading request headers"},
+	{flag: "idle-timeout", env: "IDLE_TIMEOUT", usage: "close keep-alive connections idle this long"},
+	{flag: "max-header-bytes", env: "MAX_HEADER_BYTES", usage: "maximum size of request headers, e.g. 16K"},
+	{flag: "rate-limit", env: "RATE_LIMIT", usage: "answer requests with 429: a percentage (20%) or count per window (10/1m)"},
+	{flag: "retry-after", env: "RETRY_AFTER", usage: "Retry-After sent with 429 responses (default: until the window resets)"},
+	{flag: "redirect-depth", env: "REDIRECT_DEPTH", usage: "answer with this many redirects back to the server first"},
+	{flag: "redirect-status", env: "REDIRECT_STATUS", usage: "status of redirects: 301, 302, 303, 307 or 308 (default 302)"},
+	{flag: "malformed", env: "MALFORMED", usage: "malformed responses: content-length, chunking, garbage or truncate"},
+	{flag: "compression", env: "COMPRESSION", usage: "compress bodies: auto, gzip, deflate or none"},
+	{flag: "content-encoding", env: "CONTENT_ENCODING", usage: "Content-Encoding to announce instead of the one applied"},
+	{flag: "trailers", env: "TRAILERS", usage: "trailers sent after the body, as Name=value,... (values are templates)"},
+	{flag: "chunk-size", env: "CHUNK_SIZE", usage: "send one chunk of this many body bytes per release"},
+	{flag: "hold-headers", env: "HOLD_HEADERS", usage: "hold the status line and headers until release too", isBool: true},
+	{flag: "partial-bytes", env: "PARTIAL_BYTES", usage: "send only this many body bytes on release, then hang"},
+	{flag: "drip-rate", env: "DRIP_RATE", usage: "stream released bodies at this rate per second (e.g. 1KB)"},
+	{flag: "control-headers", env: "CONTROL_HEADERS", usage: "honor X-Debug-* request headers: 1 or 0 (default 1)"},
+	{flag: "chaos", env: "CHAOS", usage: `weighted fault mix, e.g. "hold=10,delay:2s=20,500=10,reset=5,slow-body=10,pass=45"`},
+	{flag: "decide-script", env: "DECIDE_SCRIPT", usage: "command deciding per request how to handle it"},
+	{flag: "scenario", env: "SCENARIO_FILE", usage: "JSON file of scenario steps to play back"},
+	{flag: "history-file", env: "HISTORY_FILE", usage: "save the history to this JSON Lines file and reload it on restart; export sql turns all of it into SQL for sqlite3, in place of a SQLite database"},
+	{flag: "history-size", env: "HISTORY_SIZE", usage: "completed requests to keep (default 100, 0 disables)"},
+	{flag: "stats-on-exit", env: "STATS_ON_EXIT", usage: "print session statistics on shutdown: 1 or 0 (default 1)"},
+	{flag: "duplicate-window", env: "DUPLICATE_WINDOW", usage: "flag repeats of requests pending or answered this recently (off by default)"},
+	{flag: "idempotency", env: "IDEMPOTENCY", usage: "Idempotency-Key handling: warn (default), replay the first response, or off"},
+	{flag: "access-log", env: "ACCESS_LOG", usage: "append an access log line with the hold time for every request to this file"},
+	{flag: "access-log-format", env: "ACCESS_LOG_FORMAT", usage: "access log format: combined or json"},
+	{flag: "access-log-max-size", env: "ACCESS_LOG_MAX_SIZE", usage: "rotate the access log when it would grow past this size (e.g. 10MB)"},
+	{flag: "access-log-rotate", env: "ACCESS_LOG_ROTATE", usage: "rotate the access log when it is this old (e.g. 24h)"},
+	{flag: "upstream", env: "UPSTREAM", usage: "proxy released requests to this URL"},
+	{flag: "proxy-hold", env: "PROXY_HOLD", usage: "proxy hold point: request or response"},
+	{flag: "vcr-dir", env: "VCR_DIR", usage: "directory of recorded upstream responses"},
+	{flag: "vcr-mode", env: "VCR_MODE", usage: "record (default, needs UPSTREAM) or replay the VCR_DIR responses"},
+	{flag: "replay-upstream", env: "REPLAY_UPSTREAM", usage: "where the replay command sends requests (default -upstream)"},
+	{flag: "websocket-hold", env: "WEBSOCKET_HOLD", usage: "WebSocket hold point: message or handshake"},
+	{flag: "sse", env: "SSE", usage: "serve Server-Sent Events on /sse", isBool: true},
+	{flag: "tcp-port", env: "TCP_PORT", usage: "also hold replies to raw TCP clients on this port"},
+	{flag: "tcp-reply", env: "TCP_REPLY", usage: "bytes sent to TCP clients on release (default echo)"},
+	{flag: "tls", env: "TLS", usage: "serve HTTPS with a generated self-signed certificate", isBool: true},
+	{flag: "tls-cert", env: "TLS_CERT", usage: "TLS certificate file"},
+	{flag: "tls-key", env: "TLS_KEY", usage: "TLS key file"},
+	{flag: "tls-client-ca", env: "TLS_CLIENT_CA", usage: "CA file for verifying client certificates"},
+	{flag: "tls-client-auth", env: "TLS_CLIENT_AUTH", usage: "client certificates: require or optional"},
+	{flag: "log-format", env: "LOG_FORMAT", usage: "console output: text or json"},
+	{flag: "output", env: "OUTPUT", usage: "stdout format: text, or ndjson for one JSON event per line and nothing else (overrides LOG_FORMAT)"},
+	{flag: "notify", env: "NOTIFY", usage: "alert on each held request: bell or desktop"},
+	{flag: "webhook-url", env: "WEBHOOK_URL", usage: "POST a JSON event to this URL for every request event"},
+	{flag: "otlp-endpoint", env: "OTEL_EXPORTER_OTLP_ENDPOINT", usage: "OTLP/HTTP collector to export hold spans to"},
+	{flag: "status-line", env: "STATUS_LINE", usage: "show a live pending/oldest/served line", isBool: true},
+	{flag: "color", env: "COLOR", usage: "color console output: auto (a terminal without NO_COLOR), always or never"},
+	{flag: "tui", env: "TUI", usage: "show a full-screen live queue with single-key commands", isBool: true},
+	{flag: "quiet", env: "QUIET", usage: "print only warnings and command output", isBool: true},
+	{flag: "verbose-body", env: "VERBOSE_BODY", usage: "print request headers and body on arrival", isBool: true},
+	{flag: "mask-secrets", env: "MASK_SECRETS", usage: "mask Authorization and Cookie values", isBool: true},
+	{flag: "no-stdin", env: "NO_STDIN", usage: "ignore standard input", isBool: true},
+	{flag: "control-socket", env: "CONTROL_SOCKET", usage: "Unix socket for commands from the ctl subcommand, or off (default one in the temporary directory named after the port)"},
+	{flag: "shutdown-mode", env: "SHUTDOWN_MODE", usage: "on SIGTERM: release or drop held requests"},
+	{flag: "shutdown-status", env: "SHUTDOWN_STATUS", usage: "status for held requests answered on shutdown"},
+	{flag: "shutdown-timeout", env: "SHUTDOWN_TIMEOUT", usage: "how long to wait for responses on shutdown (default 10s)"},
+}
+
+// registerOptions defines a flag for every option.
+func registerOptions(fs *flag.FlagSet) {
+	for _, opt := range options {
+		usage := fmt.Sprintf("%s (env %s)", opt.usage, opt.env)
+		if opt.isBool {
+			fs.Bool(opt.flag, false, usage)
+		} else {
+			fs.String(opt.flag, "", usage)
+		}
+	}
+}
+
+// applyOptions exports the flags that were set on the command line into the
+// environment, overriding it, and fills still-unset variables from the
+// -config file if one was given. It returns the variables that were set by
+// flags or the environment rather than the config file.
+func applyOptions(fs *flag.FlagSet, configFile string) (map[string]bool, error) {
+	byFlag := make(map[string]option, len(options))
+	for _, opt := range options {
+		byFlag[opt.flag] = opt
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		opt, ok := byFlag[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		value := f.Value.String()
+		if opt.isBool {
+			// Switches are off when the variable is empty
+			value = map[string]string{"true": "1", "false": ""}[value]
+		}
+		err = os.Setenv(opt.env, value)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fixed := make(map[string]bool)
+	for _, opt := range options {
+		if _, set := os.LookupEnv(opt.env); set {
+			fixed[opt.env] = true
+		}
+	}
+	if configFile == "" {
+		return fixed, nil
+	}
+
+	config, err := readConfigOptions(configFile)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range config {
+		opt, ok := byFlag[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown option %q", configFile, name)
+		}
+		if !fixed[opt.env] {
+			os.Setenv(opt.env, value)
+		}
+	}
+	return fixed, nil
+}
+
+// readConfigOptions reads a JSON object of option names (as used for flags)
+// to values. Strings, numbers and booleans are accepted.
+func readConfigOptions(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", file, err)
+	}
+
+	config := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch v := value.(type) {
+		case string:
+			config[name] = v
+		case float64:
+			config[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			if v {
+				config[name] = "1"
+			} else {
+				config[name] = ""
+			}
+		default:
+			return nil, fmt.Errorf("%s: option %q must be a string, number or boolean", file, name)
+		}
+	}
+	return config, nil
+}
+
+// usage prints the flags together with a note on environment variables.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags]\n\n", os.Args[0])
+	fmt.Fprintf(out, "Every flag can also be set with the environment variable shown, or in\n")
+	fmt.Fprintf(out, "a -config JSON file such as {\"port\": 3000, \"auto-release\": \"30s\"}.\n")
+	fmt.Fprintf(out, "Flags take precedence over the environment, which takes precedence over\n")
+	fmt.Fprintf(out, "the config file.\n\n")
+	flag.PrintDefaults()
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Path patterns may capture segments by name: "/users/{id}/orders/{oid}"
+// matches /users/42/orders/7 with id=42 and oid=7. A final {name...}
+// captures the rest of the path, and {name:glob} only matches segments that
+// match the glob, e.g. "/users/{id:4*}". Other segments may be globs too.
+// Unlike plain patterns, these match the whole path rather than a prefix.
+
+// isParamPattern reports whether pattern captures path parameters.
+func isParamPattern(pattern string) bool {
+	return strings.Contains(pattern, "{")
+}
+
+// checkPathPattern reports a malformed path parameter in pattern.
+func checkPathPattern(pattern string) error {
+	if !isParamPattern(pattern) {
+		return nil
+	}
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		name, glob, isParam := parseParamSegment(segment)
+		switch {
+		case !isParam && strings.ContainsAny(segment, "{}"):
+			return fmt.Errorf("pattern %q: a parameter must be a whole segment, as in /users/{id}", pattern)
+		case isParam && name == "":
+			return fmt.Errorf("pattern %q: empty parameter name", pattern)
+		case isParam && strings.HasSuffix(name, "...") && i != len(segments)-1:
+			return fmt.Errorf("pattern %q: {%s} must be the last segment", pattern, name)
+		case isParam && glob != "":
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("pattern %q: invalid glob %q", pattern, glob)
+			}
+		}
+	}
+	return nil
+}
+
+// parseParamSegment splits a "{name}" or "{name:glob}" segment.
+func parseParamSegment(segment string) (name, glob string, ok bool) {
+	if len(segment) < 2 || segment[0] != '{' || segment[len(segment)-1] != '}' {
+		return "", "", false
+	}
+	name, glob, _ = strings.Cut(segment[1:len(segment)-1], ":")
+	return name, glob, true
+}
+
+// matchParams matches p against a pattern with path parameters and returns
+// the captured values.
+func matchParams(pattern, p string) (map[string]string, bool) {
+	patternSegments := strings.Split(pattern, "/")
+	pathSegments := strings.Split(p, "/")
+	params := make(map[string]string)
+	for i, segment := range patternSegments {
+		name, glob, isParam := parseParamSegment(segment)
+		if isParam && strings.HasSuffix(name, "...") && i == len(patternSegments)-1 {
+			if i > len(pathSegments) {
+				return nil, false
+			}
+			params[strings.TrimSuffix(name, "...")] = strings.Join(pathSegments[i:], "/")
+			return params, true
+		}
+		if i >= len(pathSegments) {
+			return nil, false
+		}
+		value := pathSegments[i]
+		switch {
+		case isParam:
+			if value == "" {
+				return nil, false
+			}
+			if glob != "" {
+				if ok, err := path.Match(glob, value); err != nil || !ok {
+					return nil, false
+				}
+			}
+			params[name] = value
+		case strings.ContainsAny(segment, "*?["):
+			if ok, err := path.Match(segment, value); err != nil || !ok {
+				return nil, false
+			}
+		case segment != value:
+			return nil, false
+		}
+	}
+	if len(pathSegments) != len(patternSegments) {
+		return nil, false
+	}
+	return params, true
+}
+
+// routeParams returns the path parameters p captures from rt's pattern, if
+// any.
+func routeParams(rt *route, p string) map[string]string {
+	if rt == nil || !isParamPattern(rt.Path) {
+		return nil
+	}
+	params, _ := matchParams(rt.Path, p)
+	return params
+}
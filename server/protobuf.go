@@ -0,0 +1,648 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Protobuf bodies are decoded without generated code: PROTO_DESCRIPTORS
+// names a FileDescriptorSet (protoc --include_imports --descriptor_set_out)
+// that supplies field names and types. Without one, or for unknown types,
+// fields are shown by number with their wire values.
+
+// protoField is a field of a protoMessage, from a FieldDescriptorProto.
+type protoField struct {
+	name     string
+	jsonName string
+	number   int
+	repeated bool
+	kind     int
+	typeName string
+}
+
+// Field types of FieldDescriptorProto.
+const (
+	protoDouble   = 1
+	protoFloat    = 2
+	protoInt64    = 3
+	protoUint64   = 4
+	protoInt32    = 5
+	protoFixed64  = 6
+	protoFixed32  = 7
+	protoBool     = 8
+	protoString   = 9
+	protoGroup    = 10
+	protoMessage  = 11
+	protoBytes    = 12
+	protoUint32   = 13
+	protoEnum     = 14
+	protoSfixed32 = 15
+	protoSfixed64 = 16
+	protoSint32   = 17
+	protoSint64   = 18
+)
+
+// Wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoMessageType is a message type from a DescriptorProto.
+type protoMessageType struct {
+	fields   map[int]*protoField
+	mapEntry bool
+}
+
+// protoSchema holds the message, enum and method types of a descriptor set,
+// keyed by fully qualified name with a leading dot (".pkg.Message") and, for
+// methods, by gRPC path ("/pkg.Service/Method").
+type protoSchema struct {
+	messages map[string]*protoMessageType
+	enums    map[string]map[int32]string
+	methods  map[string]string
+}
+
+// loadProtoSchema reads the FileDescriptorSet in file.
+func loadProtoSchema(file string) (*protoSchema, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s := &protoSchema{
+		messages: make(map[string]*protoMessageType),
+		enums:    make(map[string]map[int32]string),
+		methods:  make(map[string]string),
+	}
+	err = protoWalk(data, func(num, wire int, _ uint64, b []byte) error {
+		if num == 1 && wire == wireBytes {
+			return s.addFile(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a FileDescriptorSet: %v", file, err)
+	}
+	if len(s.messages) == 0 {
+		return nil, fmt.Errorf("%s contains no message types", file)
+	}
+	return s, nil
+}
+
+// addFile adds the types of a FileDescriptorProto.
+func (s *protoSchema) addFile(data []byte) error {
+	var pkg string
+	var messages, enums, services [][]byte
+	err := protoWalk(data, func(num, wire int, _ uint64, b []byte) error {
+		if wire != wireBytes {
+			return nil
+		}
+		switch num {
+		case 2:
+			pkg = string(b)
+		case 4:
+			messages = append(messages, b)
+		case 5:
+			enums = append(enums, b)
+		case 6:
+			services = append(services, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	scope := ""
+	if pkg != "" {
+		scope = "." + pkg
+	}
+	for _, b := range messages {
+		if err := s.addMessage(scope, b); err != nil {
+			return err
+		}
+	}
+	for _, b := range enums {
+		if err := s.addEnum(scope, b); err != nil {
+			return err
+		}
+	}
+	for _, b := range services {
+		if err := s.addService(pkg, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMessage adds a DescriptorProto and its nested types.
+func (s *protoSchema) addMessage(scope string, data []byte) error {
+	msg := &protoMessageType{fields: make(map[int]*protoField)}
+	var name string
+	var nested, enums [][]byte
+	err := protoWalk(data, func(num, wire int, _ uint64, b []byte) error {
+		if wire != wireBytes {
+			return nil
+		}
+		switch num {
+		case 1:
+			name = string(b)
+		case 2:
+			field, err := parseProtoField(b)
+			if err != nil {
+				return err
+			}
+			msg.fields[field.number] = field
+		case 3:
+			nested = append(nested, b)
+		case 4:
+			enums = append(enums, b)
+		case 7:
+			// MessageOptions.map_entry
+			return protoWalk(b, func(num, wire int, v uint64, _ []byte) error {
+				if num == 7 && wire == wireVarint {
+					msg.mapEntry = v != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	full := scope + "." + name
+	s.messages[full] = msg
+	for _, b := range nested {
+		if err := s.addMessage(full, b); err != nil {
+			return err
+		}
+	}
+	for _, b := range enums {
+		if err := s.addEnum(full, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseProtoField parses a FieldDescriptorProto.
+func parseProtoField(data []byte) (*protoField, error) {
+	field := &protoField{}
+	err := protoWalk(data, func(num, wire int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && wire == wireBytes:
+			field.name = string(b)
+		case num == 3 && wire == wireVarint:
+			field.number = int(v)
+		case num == 4 && wire == wireVarint:
+			field.repeated = v == 3
+		case num == 5 && wire == wireVarint:
+			field.kind = int(v)
+		case num == 6 && wire == wireBytes:
+			field.typeName = string(b)
+		case num == 10 && wire == wireBytes:
+			field.jsonName = string(b)
+		}
+		return nil
+	})
+	if field.jsonName == "" {
+		field.jsonName = field.name
+	}
+	return field, err
+}
+
+// addEnum adds an EnumDescriptorProto.
+func (s *protoSchema) addEnum(scope string, data []byte) error {
+	var name string
+	values := make(map[int32]string)
+	err := protoWalk(data, func(num, wire int, _ uint64, b []byte) error {
+		switch {
+		case num == 1 && wire == wireBytes:
+			name = string(b)
+		case num == 2 && wire == wireBytes:
+			var valueName string
+			var number int32
+			err := protoWalk(b, func(num, wire int, v uint64, b []byte) error {
+				if num == 1 && wire == wireBytes {
+					valueName = string(b)
+				} else if num == 2 && wire == wireVarint {
+					number = int32(v)
+				}
+				return nil
+			})
+			values[number] = valueName
+			return err
+		}
+		return nil
+	})
+	s.enums[scope+"."+name] = values
+	return err
+}
+
+// addService adds the methods of a ServiceDescriptorProto.
+func (s *protoSchema) addService(pkg string, data []byte) error {
+	var name string
+	methods := make(map[string]string)
+	err := protoWalk(data, func(num, wire int, _ uint64, b []byte) error {
+		switch {
+		case num == 1 && wire == wireBytes:
+			name = string(b)
+		case num == 2 && wire == wireBytes:
+			var method, input string
+			err := protoWalk(b, func(num, wire int, _ uint64, b []byte) error {
+				if num == 1 && wire == wireBytes {
+					method = string(b)
+				} else if num == 2 && wire == wireBytes {
+					input = string(b)
+				}
+				return nil
+			})
+			methods[method] = input
+			return err
+		}
+		return nil
+	})
+	if pkg != "" {
+		name = pkg + "." + name
+	}
+	for method, input := range methods {
+		s.methods["/"+name+"/"+method] = input
+	}
+	return err
+}
+
+// protoWalk calls fn for each field of a protobuf message: v holds varint
+// and fixed-size values, b the contents of length-delimited ones.
+func protoWalk(data []byte, fn func(num, wire int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid field key")
+		}
+		data = data[n:]
+		num, wire := int(key>>3), int(key&7)
+		if num == 0 {
+			return errors.New("invalid field number 0")
+		}
+
+		var v uint64
+		var b []byte
+		switch wire {
+		case wireVarint:
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("field %d: invalid varint", num)
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return fmt.Errorf("field %d: truncated", num)
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return fmt.Errorf("field %d: truncated", num)
+			}
+			v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return fmt.Errorf("field %d: truncated", num)
+			}
+			b, data = data[n:n+int(size)], data[n+int(size):]
+		default:
+			return fmt.Errorf("field %d: unsupported wire type %d", num, wire)
+		}
+		if err := fn(num, wire, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decode converts a message of the named type to a JSON-friendly map, using
+// the proto3 JSON names and mapping. Fields missing from the schema are
+// keyed by number.
+func (s *protoSchema) decode(typeName string, data []byte) (map[string]interface{}, error) {
+	msg := s.messages[typeName]
+	if msg == nil {
+		return nil, fmt.Errorf("unknown message type %s", strings.TrimPrefix(typeName, "."))
+	}
+	out := make(map[string]interface{})
+	err := protoWalk(data, func(num, wire int, v uint64, b []byte) error {
+		field := msg.fields[num]
+		if field == nil {
+			addRawValue(out, strconv.Itoa(num), rawProtoValue(wire, v, b))
+			return nil
+		}
+
+		// Repeated scalars are usually packed into one length-delimited field
+		if wire == wireBytes && field.repeated && packable(field.kind) {
+			values, err := s.unpack(field, b)
+			if err != nil {
+				return err
+			}
+			for _, value := range values {
+				addProtoValue(out, field.jsonName, value, true)
+			}
+			return nil
+		}
+
+		value, err := s.value(field, wire, v, b)
+		if err != nil {
+			return fmt.Errorf("%s: %v", field.name, err)
+		}
+		if entry := s.messages[field.typeName]; entry != nil && entry.mapEntry {
+			object, _ := out[field.jsonName].(map[string]interface{})
+			if object == nil {
+				object = make(map[string]interface{})
+				out[field.jsonName] = object
+			}
+			pair := value.(map[string]interface{})
+			object[fmt.Sprint(pair["key"])] = pair["value"]
+			return nil
+		}
+		addProtoValue(out, field.jsonName, value, field.repeated)
+		return nil
+	})
+	return out, err
+}
+
+// addProtoValue sets out[key] to value, collecting values of repeated
+// fields in a list.
+func addProtoValue(out map[string]interface{}, key string, value interface{}, repeated bool) {
+	if !repeated {
+		out[key] = value
+		return
+	}
+	list, _ := out[key].([]interface{})
+	out[key] = append(list, value)
+}
+
+// packable reports whether fields of kind can be packed.
+func packable(kind int) bool {
+	return kind != protoString && kind != protoBytes && kind != protoMessage && kind != protoGroup
+}
+
+// unpack decodes a packed repeated field.
+func (s *protoSchema) unpack(field *protoField, data []byte) ([]interface{}, error) {
+	var values []interface{}
+	for len(data) > 0 {
+		var v uint64
+		var wire int
+		switch field.kind {
+		case protoDouble, protoFixed64, protoSfixed64:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("%s: truncated", field.name)
+			}
+			v, data, wire = binary.LittleEndian.Uint64(data), data[8:], wireFixed64
+		case protoFloat, protoFixed32, protoSfixed32:
+			if len(data) < 4 {
+				return nil, fmt.Errorf("%s: truncated", field.name)
+			}
+			v, data, wire = uint64(binary.LittleEndian.Uint32(data)), data[4:], wireFixed32
+		default:
+			var n int
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return nil, fmt.Errorf("%s: invalid varint", field.name)
+			}
+			data, wire = data[n:], wireVarint
+		}
+		value, err := s.value(field, wire, v, nil)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// value converts one field value. 64-bit integers become strings, as in
+// the proto3 JSON mapping, and enums their value names.
+func (s *protoSchema) value(field *protoField, wire int, v uint64, b []byte) (interface{}, error) {
+	switch field.kind {
+	case protoString:
+		return string(b), nil
+	case protoBytes:
+		return base64.StdEncoding.EncodeToString(b), nil
+	case protoMessage:
+		if wire != wireBytes {
+			return nil, fmt.Errorf("wire type %d for a message", wire)
+		}
+		return s.decode(field.typeName, b)
+	case protoDouble:
+		return math.Float64frombits(v), nil
+	case protoFloat:
+		return math.Float32frombits(uint32(v)), nil
+	case protoInt64, protoSfixed64:
+		return strconv.FormatInt(int64(v), 10), nil
+	case protoUint64, protoFixed64:
+		return strconv.FormatUint(v, 10), nil
+	case protoSint64:
+		return strconv.FormatInt(int64(v>>1)^-int64(v&1), 10), nil
+	case protoInt32, protoSfixed32:
+		return int32(v), nil
+	case protoSint32:
+		return int32(uint32(v)>>1) ^ -int32(v&1), nil
+	case protoUint32, protoFixed32:
+		return uint32(v), nil
+	case protoBool:
+		return v != 0, nil
+	case protoEnum:
+		if name, ok := s.enums[field.typeName][int32(v)]; ok {
+			return name, nil
+		}
+		return int32(v), nil
+	}
+	return rawProtoValue(wire, v, b), nil
+}
+
+// rawProto decodes a message without a schema, keying fields by number.
+func rawProto(data []byte) (map[string]interface{}, error) {
+	out := make(map[string]interface{})
+	err := protoWalk(data, func(num, wire int, v uint64, b []byte) error {
+		addRawValue(out, strconv.Itoa(num), rawProtoValue(wire, v, b))
+		return nil
+	})
+	return out, err
+}
+
+// addRawValue sets out[key] to value for a field without a schema, turning
+// it into a list if the field repeats.
+func addRawValue(out map[string]interface{}, key string, value interface{}) {
+	previous, ok := out[key]
+	if !ok {
+		out[key] = value
+		return
+	}
+	list, isList := previous.([]interface{})
+	if !isList {
+		list = []interface{}{previous}
+	}
+	out[key] = append(list, value)
+}
+
+// rawProtoValue guesses at a field value without a schema: numbers stay
+// numbers, and length-delimited values are shown as text if printable, as
+// a nested message if they parse as one, and as base64 otherwise.
+func rawProtoValue(wire int, v uint64, b []byte) interface{} {
+	if wire != wireBytes {
+		return v
+	}
+	if utf8.Valid(b) && strings.IndexFunc(string(b), func(r rune) bool {
+		return !unicode.IsPrint(r) && !unicode.IsSpace(r)
+	}) < 0 {
+		return string(b)
+	}
+	if nested, err := rawProto(b); err == nil && len(nested) > 0 {
+		return nested
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// protoBody is the decoded protobuf body of a request.
+type protoBody struct {
+	// Type is the message type, if known.
+	Type string `json:"type,omitempty"`
+
+	// Messages are the decoded messages: one for plain protobuf bodies,
+	// one per data frame for gRPC and gRPC-Web.
+	Messages []map[string]interface{} `json:"messages"`
+}
+
+// decodeProtoBody decodes req's body if it is protobuf, gRPC or gRPC-Web,
+// returning nil if it is none of those. The message type comes from the gRPC
+// method in the path or, for plain protobuf, from a messageType or proto
+// parameter of the Content-Type.
+func (s *Server) decodeProtoBody(req *pendingRequest) (*protoBody, error) {
+	mediaType, params, _ := mime.ParseMediaType(req.header.Get("Content-Type"))
+	base, _, _ := strings.Cut(mediaType, "+")
+
+	var typeName string
+	var messages [][]byte
+	switch base {
+	case "application/x-protobuf", "application/protobuf", "application/vnd.google.protobuf":
+		typeName = params["messagetype"]
+		if typeName == "" {
+			typeName = params["proto"]
+		}
+		messages = [][]byte{req.body}
+	case "application/grpc", "application/grpc-web", "application/grpc-web-text":
+		body := req.body
+		if base == "application/grpc-web-text" {
+			decoded, err := decodeGRPCWebText(body)
+			if err != nil {
+				return nil, err
+			}
+			body = decoded
+		}
+		frames, err := grpcFrames(body, req.header.Get("Grpc-Encoding"))
+		if err != nil {
+			return nil, err
+		}
+		messages = frames
+		if s.protoSchema != nil {
+			typeName = s.protoSchema.methods[req.path]
+		}
+	default:
+		return nil, nil
+	}
+	if int64(len(req.body)) < req.bodySize {
+		return nil, fmt.Errorf("the body was truncated at %d bytes", len(req.body))
+	}
+
+	if typeName != "" && !strings.HasPrefix(typeName, ".") {
+		typeName = "." + typeName
+	}
+	decoded := &protoBody{}
+	for _, data := range messages {
+		var message map[string]interface{}
+		var err error
+		if s.protoSchema != nil && s.protoSchema.messages[typeName] != nil {
+			decoded.Type = strings.TrimPrefix(typeName, ".")
+			message, err = s.protoSchema.decode(typeName, data)
+		} else {
+			message, err = rawProto(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		decoded.Messages = append(decoded.Messages, message)
+	}
+	return decoded, nil
+}
+
+// decodeGRPCWebText decodes a grpc-web-text body, which may be several
+// base64 chunks, each with its own padding, one after another.
+func decodeGRPCWebText(body []byte) ([]byte, error) {
+	var out []byte
+	text := string(bytes.TrimSpace(body))
+	for text != "" {
+		end := len(text)
+		if i := strings.Index(text, "="); i >= 0 {
+			end = i
+			for end < len(text) && text[end] == '=' {
+				end++
+			}
+		}
+		chunk, err := base64.StdEncoding.DecodeString(text[:end])
+		if err != nil {
+			return nil, fmt.Errorf("invalid grpc-web-text body: %v", err)
+		}
+		out = append(out, chunk...)
+		text = text[end:]
+	}
+	return out, nil
+}
+
+// grpcFrames splits a gRPC or gRPC-Web body into its data frames,
+// decompressing gzip frames and skipping trailer frames.
+func grpcFrames(body []byte, encoding string) ([][]byte, error) {
+	var frames [][]byte
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return nil, errors.New("truncated gRPC frame header")
+		}
+		flags, size := body[0], binary.BigEndian.Uint32(body[1:5])
+		if uint64(len(body)-5) < uint64(size) {
+			return nil, errors.New("truncated gRPC frame")
+		}
+		frame := body[5 : 5+size]
+		body = body[5+size:]
+
+		if flags&0x80 != 0 {
+			continue
+		}
+		if flags&0x01 != 0 {
+			if encoding != "gzip" {
+				return nil, fmt.Errorf("unsupported grpc-encoding %q", encoding)
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(frame))
+			if err != nil {
+				return nil, err
+			}
+			if frame, err = io.ReadAll(zr); err != nil {
+				return nil, err
+			}
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
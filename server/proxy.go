@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+)
+
+// proxyHoldKey is the request context key carrying a *responseHold.
+type proxyHoldKey struct{}
+
+// responseHold links a proxied request to its client connection so the
+// upstream response body can be held after the headers have been relayed.
+type responseHold struct {
+	s   *Server
+	req *pendingRequest
+	w   http.ResponseWriter
+	ctx context.Context
+}
+
+// newUpstreamProxy returns a reverse proxy that forwards requests to upstream,
+// reporting failed upstream requests with warnf.
+func newUpstreamProxy(upstream string, warnf func(string, ...interface{})) (*httputil.ReverseProxy, error) {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("upstream %q must be an absolute URL such as http://localhost:3000", upstream)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		if id := requestID(r); id != "" {
+			r.Header.Set(requestIDHeader, id)
+		}
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		warnf("Upstream request for %s %s failed: %v", r.Method, r.URL.Path, err)
+		http.Error(w, "upstream request failed", http.StatusBadGateway)
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if hold, ok := resp.Request.Context().Value(proxyHoldKey{}).(*responseHold); ok {
+			resp.Body = &heldBody{ReadCloser: resp.Body, hold: hold}
+		}
+		return nil
+	}
+	return proxy, nil
+}
+
+// heldBody wraps an upstream response body. Its first Read flushes the
+// already-written response headers to the client and then blocks until the
+// request is released.
+type heldBody struct {
+	io.ReadCloser
+	hold *responseHold
+	once sync.Once
+	err  error
+}
+
+func (b *heldBody) Read(p []byte) (int, error) {
+	b.once.Do(func() { b.err = b.hold.wait() })
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// wait flushes the relayed headers, holds the request and returns an error
+// if it was dropped instead of released.
+func (h *responseHold) wait() error {
+	if flusher, ok := h.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	stopTimeout := h.s.hold(h.req)
+	defer stopTimeout()
+	h.s.printf("Request #%d: Upstream responded; holding the response body\n", h.req.id)
+
+	if !h.s.waitForRelease(h.ctx, h.req) {
+		return h.ctx.Err()
+	}
+
+	if h.req.dropped {
+		h.s.logDropped(h.req)
+		if h.req.reset {
+			resetResponse(h.w)
+		}
+		return errDropped
+	}
+
+	h.s.logReleased(h.req, "Relaying upstream body")
+	return nil
+}
+
+// errDropped aborts a proxied response whose request was dropped.
+var errDropped = errors.New("request dropped")
+
+// handleProxy forwards req to the upstream. By default it is held before
+// forwarding and nothing is written to the client until release; with the
+// "response" hold point it is forwarded immediately and only the upstream
+// response body is held.
+func (s *Server) handleProxy(w http.ResponseWriter, r *http.Request, req *pendingRequest) {
+	if s.vcr != nil {
+		recorded, err := s.withRecording(r)
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r = recorded
+	}
+
+	if !s.shouldHold(r) {
+		s.passThrough(req)
+		s.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	if s.proxyHold == "response" {
+		hold := &responseHold{s: s, req: req, w: w, ctx: r.Context()}
+		s.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyHoldKey{}, hold)))
+		return
+	}
+
+	// Buffer the body so it can be forwarded after the hold
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+	req.body = body
+	req.bodySize = int64(len(body))
+
+	stopTimeout := s.hold(req)
+	defer stopTimeout()
+
+	if !s.waitForRelease(r.Context(), req) {
+		return
+	}
+
+	if req.dropped {
+		s.abortResponse(w, req)
+		return
+	}
+
+	if req.releaseStatus != 0 {
+		s.logReleased(req, fmt.Sprintf("Answered with %d", req.releaseStatus))
+		req.status = req.releaseStatus
+		s.answerStatus(w, req)
+		return
+	}
+
+	s.logReleased(req, "Forwarding to upstream")
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	s.proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter answers some requests with 429 Too Many Requests instead of
+// holding them, either a random percentage or everything beyond limit
+// requests per window.
+type rateLimiter struct {
+	spec string
+
+	percent float64
+
+	limit  int
+	window time.Duration
+
+	// retryAfter, when non-zero, is the Retry-After hint; otherwise the time
+	// until the window resets (or one second in percentage mode) is sent.
+	retryAfter time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	count       int
+}
+
+// parseRateLimit parses RATE_LIMIT: "20%" throttles a random 20% of requests,
+// and "10/1m" throttles everything beyond 10 requests per minute. The window
+// may be a duration or just a unit, as in "5/s".
+func parseRateLimit(spec string) (*rateLimiter, error) {
+	limiter := &rateLimiter{spec: spec}
+	if value, ok := strings.CutSuffix(spec, "%"); ok {
+		percent, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid RATE_LIMIT percentage %q", spec)
+		}
+		limiter.percent = percent
+		return limiter, nil
+	}
+
+	count, window, ok := strings.Cut(spec, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid RATE_LIMIT %q (want e.g. 20%% or 10/1m)", spec)
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || limit < 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT count in %q", spec)
+	}
+	window = strings.TrimSpace(window)
+	if window != "" && strings.Trim(window, "smh") == "" {
+		window = "1" + window
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT window in %q", spec)
+	}
+	limiter.limit, limiter.window = limit, d
+	return limiter, nil
+}
+
+// allow counts a request and reports whether it may proceed. If not, it
+// also returns the Retry-After hint.
+func (l *rateLimiter) allow(now time.Time) (bool, time.Duration) {
+	if l.window == 0 {
+		if rand.Float64()*100 >= l.percent {
+			return true, 0
+		}
+		if l.retryAfter > 0 {
+			return false, l.retryAfter
+		}
+		return false, time.Second
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.windowStart) >= l.window {
+		l.windowStart, l.count = now, 0
+	}
+	l.count++
+	if l.count <= l.limit {
+		return true, 0
+	}
+	if l.retryAfter > 0 {
+		return false, l.retryAfter
+	}
+	return false, l.windowStart.Add(l.window).Sub(now)
+}
+
+// rejectRateLimited answers r with 429 because the rate limiter throttled it.
+func (s *Server) rejectRateLimited(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	s.printf("[%s] Throttled %s %s from %s with 429 (RATE_LIMIT %s)\n",
+		time.Now().Format("15:04:05"), r.Method, r.URL.Path, r.RemoteAddr, s.rateLimiter.spec)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
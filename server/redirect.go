@@ -0,0 +1,47 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// redirectParam carries the number of redirects left in a chain. Every hop
+// points back at the same path with the count decremented, so each one is an
+// ordinary request that is held like any other.
+const redirectParam = "redirects"
+
+// parseRedirectStatus validates REDIRECT_STATUS.
+func parseRedirectStatus(value string) (int, error) {
+	switch value {
+	case "":
+		return http.StatusFound, nil
+	case "301", "302", "303", "307", "308":
+		return strconv.Atoi(value)
+	}
+	return 0, fmt.Errorf("invalid REDIRECT_STATUS %q (want 301, 302, 303, 307 or 308)", value)
+}
+
+// redirectLocation returns where r should be redirected to, if it is part of
+// a redirect chain: REDIRECT_DEPTH starts a chain for every request, and the
+// redirects query parameter (when control headers are enabled) sets the
+// number of hops left.
+func (s *Server) redirectLocation(r *http.Request) (string, bool, error) {
+	query := r.URL.Query()
+	left := s.redirectDepth
+	if value := query.Get(redirectParam); value != "" && (s.controlHeaders || s.redirectDepth > 0) {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return "", false, fmt.Errorf("invalid %s %q", redirectParam, value)
+		}
+		left = n
+	}
+	if left <= 0 {
+		return "", false, nil
+	}
+
+	query.Set(redirectParam, strconv.Itoa(left-1))
+	location := *r.URL
+	location.RawQuery = query.Encode()
+	return location.RequestURI(), true, nil
+}
@@ -0,0 +1,494 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// releaseOptions controls how a batch of selected requests is released.
+type releaseOptions struct {
+	// stagger, when non-zero, releases the requests one at a time with this
+	// delay between consecutive releases instead of all at once.
+	stagger time.Duration
+
+	// jitterMin and jitterMax, when jitterMax is non-zero, delay each request
+	// by a random duration drawn uniformly from [jitterMin, jitterMax].
+	jitterMin time.Duration
+	jitterMax time.Duration
+
+	// cause is recorded on each released request; it defaults to "manual".
+	cause string
+
+	// status, when non-zero, is recorded as each request's releaseStatus.
+	status int
+
+	// order is "fifo", "lifo" or "random"; empty uses the server's
+	// RELEASE_ORDER.
+	order string
+
+	// finish is recorded on each released request; see pendingRequest.finish.
+	finish bool
+}
+
+// delay returns how long after the release command the i-th selected request
+// should be signalled.
+func (o releaseOptions) delay(i int) time.Duration {
+	d := time.Duration(i) * o.stagger
+	if o.jitterMax > 0 {
+		d += o.jitterMin + time.Duration(rand.Int63n(int64(o.jitterMax-o.jitterMin)+1))
+	}
+	return d
+}
+
+// releaseAll releases every pending request and returns how many were released.
+func (s *Server) releaseAll() int {
+	return s.releaseMatching(matchAll, releaseOptions{})
+}
+
+// releaseByID releases the pending request with the given number, reporting
+// whether it was found.
+func (s *Server) releaseByID(id int) bool {
+	return s.releaseMatching(matchID(id), releaseOptions{}) > 0
+}
+
+// releaseMatching releases every pending request for which match returns true,
+// leaving the rest held, and returns how many were selected. With a stagger
+// or jitter the selected requests leave the queue immediately but are
+// signalled in the background once their delay has elapsed.
+func (s *Server) releaseMatching(match func(*pendingRequest) bool, opts releaseOptions) int {
+	released := s.takeMatching(match)
+	count := len(released)
+	if count == 0 {
+		return 0
+	}
+
+	order := opts.order
+	if order == "" {
+		order = s.releaseOrder
+	}
+	orderRequests(released, order)
+	released = s.applySequence(released)
+
+	cause := opts.cause
+	if cause == "" {
+		cause = "manual"
+	}
+	for _, req := range released {
+		req.releaseCause = cause
+		req.releaseStatus = opts.status
+		req.finish = opts.finish
+	}
+
+	if opts.stagger <= 0 && opts.jitterMax <= 0 {
+		s.printf("\nReleasing %d pending request(s)...\n", count)
+
+		// Signal the selected requests to send their responses
+		for _, req := range released {
+			close(req.responseChan)
+		}
+		return count
+	}
+
+	switch {
+	case opts.jitterMax > 0 && opts.stagger > 0:
+		s.printf("\nReleasing %d pending request(s) every %s with %s-%s jitter...\n",
+			count, opts.stagger, opts.jitterMin, opts.jitterMax)
+	case opts.jitterMax > 0:
+		s.printf("\nReleasing %d pending request(s) with %s-%s jitter...\n", count, opts.jitterMin, opts.jitterMax)
+	default:
+		s.printf("\nReleasing %d pending request(s) every %s...\n", count, opts.stagger)
+	}
+	for i, req := range released {
+		req := req
+		time.AfterFunc(opts.delay(i), func() { close(req.responseChan) })
+	}
+	return count
+}
+
+// orderRequests rearranges reqs, which are in arrival order, into the given
+// release order.
+func orderRequests(reqs []*pendingRequest, order string) {
+	switch order {
+	case "lifo":
+		for i, j := 0, len(reqs)-1; i < j; i, j = i+1, j-1 {
+			reqs[i], reqs[j] = reqs[j], reqs[i]
+		}
+	case "random":
+		rand.Shuffle(len(reqs), func(i, j int) { reqs[i], reqs[j] = reqs[j], reqs[i] })
+	}
+}
+
+// parseReleaseOrder validates a release order.
+func parseReleaseOrder(value string) (string, error) {
+	switch value {
+	case "fifo", "lifo", "random":
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid release order %q (want fifo, lifo or random)", value)
+}
+
+// waitForRelease blocks until req is released or dropped, or until ctx is
+// done because the client gave up. In the latter case req is removed from
+// the queue and waitForRelease returns false.
+func (s *Server) waitForRelease(ctx context.Context, req *pendingRequest) bool {
+	select {
+	case <-req.responseChan:
+		if req.after != nil {
+			select {
+			case <-req.after:
+				req.after = nil
+			case <-ctx.Done():
+				return false
+			}
+		}
+		return true
+	case <-ctx.Done():
+		// If a release already took it off the queue there is nothing to
+		// clean up, but there is also nobody left to answer
+		if len(s.takeMatching(matchID(req.id))) > 0 {
+			s.logAbandoned(req)
+		}
+		return false
+	}
+}
+
+// dropByID removes the pending request with the given number and closes its
+// connection without writing a body, reporting whether it was found.
+func (s *Server) dropByID(id int) bool {
+	return s.dropMatching(matchID(id), false) > 0
+}
+
+// resetByID removes the pending request with the given number and aborts its
+// connection with a TCP reset, reporting whether it was found.
+func (s *Server) resetByID(id int) bool {
+	return s.dropMatching(matchID(id), true) > 0
+}
+
+// dropMatching aborts every pending request for which match returns true and
+// returns how many were dropped. With reset, connections are closed with a
+// TCP RST instead of a FIN where possible.
+func (s *Server) dropMatching(match func(*pendingRequest) bool, reset bool) int {
+	dropped := s.takeMatching(match)
+	if len(dropped) == 0 {
+		return 0
+	}
+
+	if reset {
+		s.printf("\nResetting %d pending request(s)...\n", len(dropped))
+	} else {
+		s.printf("\nDropping %d pending request(s)...\n", len(dropped))
+	}
+	for _, req := range dropped {
+		req.dropped = true
+		req.reset = reset
+		close(req.responseChan)
+	}
+	return len(dropped)
+}
+
+// abortResponse ends the response to a dropped request without completing
+// it. Requests marked for reset have their connection hijacked and closed
+// with SO_LINGER=0 so the client sees a TCP RST; otherwise, or if the
+// connection can't be hijacked (HTTP/2), the handler is aborted and net/http
+// closes the connection.
+func (s *Server) abortResponse(w http.ResponseWriter, req *pendingRequest) {
+	s.logDropped(req)
+	if req.reset && resetResponse(w) {
+		return
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// resetResponse hijacks the connection behind w and resets it, reporting
+// whether that was possible.
+func resetResponse(w http.ResponseWriter) bool {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return false
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return false
+	}
+	resetConn(conn)
+	return true
+}
+
+// resetConn closes conn so that the peer receives a TCP RST.
+func resetConn(conn net.Conn) {
+	raw := conn
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		raw = tlsConn.NetConn()
+	}
+	if tcpConn, ok := raw.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	raw.Close()
+}
+
+// takeMatching removes and returns every pending request for which match
+// returns true, preserving arrival order.
+func (s *Server) takeMatching(match func(*pendingRequest) bool) []*pendingRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var taken []*pendingRequest
+	remaining := make([]*pendingRequest, 0, len(s.pendingRequests))
+	for _, req := range s.pendingRequests {
+		if match(req) {
+			taken = append(taken, req)
+		} else {
+			remaining = append(remaining, req)
+		}
+	}
+	s.pendingRequests = remaining
+	if len(taken) > 0 {
+		s.notifyQueueChangedLocked()
+	}
+	return taken
+}
+
+// notifyQueueChangedLocked wakes everyone waiting on the current
+// queueChanged channel. s.mu must be held.
+func (s *Server) notifyQueueChangedLocked() {
+	close(s.queueChanged)
+	s.queueChanged = make(chan struct{})
+}
+
+// watchQueue returns the pending requests together with a channel that is
+// closed the next time the queue changes.
+func (s *Server) watchQueue() ([]*pendingRequest, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*pendingRequest(nil), s.pendingRequests...), s.queueChanged
+}
+
+// snapshot returns a copy of the current pending requests in arrival order.
+func (s *Server) snapshot() []*pendingRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*pendingRequest(nil), s.pendingRequests...)
+}
+
+// findPending returns the pending request with the given number, or nil.
+func (s *Server) findPending(id int) *pendingRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, req := range s.pendingRequests {
+		if req.id == id {
+			return req
+		}
+	}
+	return nil
+}
+
+// countPending returns how many pending requests match.
+func (s *Server) countPending(match func(*pendingRequest) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, req := range s.pendingRequests {
+		if match(req) {
+			count++
+		}
+	}
+	return count
+}
+
+func matchAll(*pendingRequest) bool { return true }
+
+func matchID(id int) func(*pendingRequest) bool {
+	return func(req *pendingRequest) bool { return req.id == id }
+}
+
+// matchPort selects requests received on the given listener port.
+func matchPort(port string) func(*pendingRequest) bool {
+	return func(req *pendingRequest) bool { return req.port == port }
+}
+
+// matchClient selects requests from the given client.
+func matchClient(client string) func(*pendingRequest) bool {
+	return func(req *pendingRequest) bool { return req.client == client }
+}
+
+// matchGroup selects requests tagged with the given release group.
+func matchGroup(group string) func(*pendingRequest) bool {
+	return func(req *pendingRequest) bool { return req.group == group }
+}
+
+// matchRouteQueue selects requests answered by the route whose path pattern
+// is exactly pattern, e.g. "/payments" or "/users/{id}".
+func matchRouteQueue(pattern string) func(*pendingRequest) bool {
+	return func(req *pendingRequest) bool { return req.route != nil && req.route.Path == pattern }
+}
+
+// matchTrace selects requests whose trace ID starts with prefix. Padded
+// 64-bit B3 trace IDs also match by their original 16 digits.
+func matchTrace(prefix string) func(*pendingRequest) bool {
+	prefix = strings.ToLower(prefix)
+	return func(req *pendingRequest) bool {
+		if req.traceID == "" {
+			return false
+		}
+		return strings.HasPrefix(req.traceID, prefix) ||
+			strings.HasPrefix(strings.TrimPrefix(req.traceID, strings.Repeat("0", 16)), prefix)
+	}
+}
+
+// parseTargetArgs selects requests by the words following a command: nothing
+// or "all", a request number, ":<port>", "client <id>", "trace <id prefix>",
+// "group <name>", "op <GraphQL operation name>", "route <route path>" or a
+// path pattern.
+func parseTargetArgs(args []string) (func(*pendingRequest) bool, error) {
+	switch {
+	case len(args) == 0:
+		return matchAll, nil
+	case args[0] == "client":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected client <address or id>")
+		}
+		return matchClient(args[1]), nil
+	case args[0] == "trace":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected trace <trace ID or prefix>")
+		}
+		return matchTrace(args[1]), nil
+	case args[0] == "group":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected group <name>")
+		}
+		return matchGroup(args[1]), nil
+	case args[0] == "op":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected op <GraphQL operation name>")
+		}
+		return matchOperation(args[1]), nil
+	case args[0] == "route":
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected route <path as in ROUTES_FILE>")
+		}
+		return matchRouteQueue(args[1]), nil
+	case len(args) > 1:
+		return nil, fmt.Errorf("expected at most one target, got %q", strings.Join(args, " "))
+	}
+	return parseTarget(args[0]), nil
+}
+
+// parseTarget selects requests by "all", a request number, ":<port>" or a
+// path pattern.
+func parseTarget(target string) func(*pendingRequest) bool {
+	if target == "all" {
+		return matchAll
+	}
+	if id, err := strconv.Atoi(target); err == nil {
+		return matchID(id)
+	}
+	if strings.HasPrefix(target, ":") {
+		return matchPort(target[1:])
+	}
+	return matchPathPattern(target)
+}
+
+// matchPathPattern selects requests whose path matches pattern. Patterns
+// containing glob metacharacters are matched with path.Match; anything else
+// is treated as a path prefix.
+func matchPathPattern(pattern string) func(*pendingRequest) bool {
+	return func(req *pendingRequest) bool { return matchPath(pattern, req.path) }
+}
+
+// matchPath reports whether p matches pattern: one with path parameters
+// (see matchParams) exactly, a glob, or a prefix.
+func matchPath(pattern, p string) bool {
+	if isParamPattern(pattern) {
+		_, ok := matchParams(pattern, p)
+		return ok
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, err := path.Match(pattern, p)
+		return err == nil && ok
+	}
+	return strings.HasPrefix(p, pattern)
+}
+
+// parseReleaseArgs parses the arguments of a release command:
+//
+//	release [--stagger <duration>] [--jitter <min>-<max>] [--order fifo|lifo|random]
+//	        [all|<n>|:<port>|client <id>|trace <id>|group <name>|op <name>|
+//	         route <route>|<path>]
+//
+// An omitted target selects all pending requests.
+func parseReleaseArgs(args []string) (func(*pendingRequest) bool, releaseOptions, error) {
+	var opts releaseOptions
+	var targets []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--stagger":
+			if i+1 >= len(args) {
+				return nil, opts, fmt.Errorf("--stagger requires a duration")
+			}
+			i++
+			d, err := time.ParseDuration(args[i])
+			if err == nil && d < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+			if err != nil {
+				return nil, opts, fmt.Errorf("invalid stagger %q: %v", args[i], err)
+			}
+			opts.stagger = d
+		case "--jitter":
+			if i+1 >= len(args) {
+				return nil, opts, fmt.Errorf("--jitter requires a range such as 100ms-2s")
+			}
+			i++
+			lo, hi, err := parseDurationRange(args[i])
+			if err != nil {
+				return nil, opts, fmt.Errorf("invalid jitter %q: %v", args[i], err)
+			}
+			opts.jitterMin, opts.jitterMax = lo, hi
+		case "--order":
+			if i+1 >= len(args) {
+				return nil, opts, fmt.Errorf("--order requires fifo, lifo or random")
+			}
+			i++
+			order, err := parseReleaseOrder(args[i])
+			if err != nil {
+				return nil, opts, err
+			}
+			opts.order = order
+		default:
+			targets = append(targets, args[i])
+		}
+	}
+
+	match, err := parseTargetArgs(targets)
+	return match, opts, err
+}
+
+// parseDurationRange parses "<min>-<max>" (e.g. "100ms-2s"). A single
+// duration is treated as a range starting at zero.
+func parseDurationRange(value string) (time.Duration, time.Duration, error) {
+	minText, maxText, found := strings.Cut(value, "-")
+	if !found {
+		minText, maxText = "0s", value
+	}
+	min, err := time.ParseDuration(minText)
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := time.ParseDuration(maxText)
+	if err != nil {
+		return 0, 0, err
+	}
+	if min < 0 || max < min {
+		return 0, 0, fmt.Errorf("range must satisfy 0 <= min <= max")
+	}
+	return min, max, nil
+}
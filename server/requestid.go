@@ -0,0 +1,34 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// requestIDHeader carries a request's ID: an incoming value is kept, and
+// otherwise one is generated. It is echoed on every response and sent on to
+// the upstream, so that client, server and upstream logs can be correlated.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds incoming IDs, which end up in every log line.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// withRequestID attaches r's request ID to its context and to the response
+// headers.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := strings.TrimSpace(r.Header.Get(requestIDHeader))
+	if id == "" || len(id) > maxRequestIDLength || strings.ContainsAny(id, "\r\n") {
+		id = newUUID()
+	}
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// requestID returns the request ID attached by withRequestID, if any.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateData is the data available to response body templates, e.g.
+// {"id":{{.ID}},"path":"{{.Path}}","waited":"{{.HeldFor}}"}.
+type templateData struct {
+	ID         int
+	Method     string
+	Path       string
+	Query      url.Values
+	RemoteAddr string
+	ReceivedAt time.Time
+	HeldFor    time.Duration
+	Timestamp  string
+
+	// Segments are the parts of the path, e.g. ["users", "42"], and Params
+	// the path parameters captured by the route, e.g. {{.Params.id}}.
+	Segments []string
+	Params   map[string]string
+
+	// Fake generates fake data; see fakeData.
+	Fake fakeData
+}
+
+// echoResponse is the response body written in echo mode.
+type echoResponse struct {
+	ID         int         `json:"id"`
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Query      url.Values  `json:"query"`
+	Headers    http.Header `json:"headers"`
+	Body       string      `json:"body"`
+	RemoteAddr string      `json:"remote_addr"`
+	HeldFor    string      `json:"held_for"`
+	Timestamp  string      `json:"timestamp"`
+}
+
+// dripInterval is how often drip writes a chunk.
+const dripInterval = 100 * time.Millisecond
+
+// drip writes body to w at roughly rate bytes per second, flushing after
+// each chunk so the client sees the data trickle in.
+func drip(w io.Writer, body []byte, rate int64) error {
+	chunk := int(rate * int64(dripInterval) / int64(time.Second))
+	if chunk < 1 {
+		chunk = 1
+	}
+	interval := time.Duration(int64(chunk) * int64(time.Second) / rate)
+	flusher, _ := w.(http.Flusher)
+
+	for len(body) > 0 {
+		n := chunk
+		if n > len(body) {
+			n = len(body)
+		}
+		if _, err := w.Write(body[:n]); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		body = body[n:]
+		if len(body) > 0 {
+			time.Sleep(interval)
+		}
+	}
+	return nil
+}
+
+// stepChunks writes body in chunks of s.chunkSize bytes, putting req back on
+// hold after each one so that every release flushes the next chunk. A
+// release from the end command writes the rest and finishes the response.
+func (s *Server) stepChunks(w http.ResponseWriter, r *http.Request, req *pendingRequest, body []byte) {
+	flusher, _ := w.(http.Flusher)
+	for sent := 1; len(body) > 0; sent++ {
+		n := s.chunkSize
+		if n > len(body) || req.finish {
+			n = len(body)
+		}
+		if err := s.writeChunk(w, body[:n]); err != nil {
+			s.printf("Request #%d: Client went away during chunked body: %v\n", req.id, err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		body = body[n:]
+		if len(body) == 0 {
+			break
+		}
+
+		s.holdAgain(req, fmt.Sprintf("Sent chunk %d (%d byte(s), %d left)", sent, n, len(body)))
+		if !s.waitForRelease(r.Context(), req) {
+			return
+		}
+		if req.dropped {
+			s.abortResponse(w, req)
+			return
+		}
+	}
+	s.logRequest(req, "finished", "Chunked body finished")
+}
+
+// writeChunk writes one chunk of a stepped body, at DRIP_RATE if set.
+func (s *Server) writeChunk(w io.Writer, chunk []byte) error {
+	if s.dripRate > 0 {
+		return drip(w, chunk, s.dripRate)
+	}
+	_, err := w.Write(chunk)
+	return err
+}
+
+// parseByteSize parses a size such as "512", "64KB" or "10MB". Units are
+// powers of 1024 and case-insensitive; the trailing B is optional.
+func parseByteSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(s, "B")
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSuffix(s, unit.suffix)
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// bodyPattern is repeated to fill generated bodies.
+const bodyPattern = "abcdefghijklmnopqrstuvwxyz0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ\n"
+
+// generateBody writes size bytes to w: random bytes if random is set,
+// otherwise bodyPattern repeated.
+func generateBody(w io.Writer, size int64, random bool) {
+	chunk := make([]byte, 32<<10)
+	if !random {
+		for i := range chunk {
+			chunk[i] = bodyPattern[i%len(bodyPattern)]
+		}
+	}
+	for size > 0 {
+		n := int64(len(chunk))
+		if size < n {
+			n = size
+		}
+		if random {
+			rand.Read(chunk[:n])
+		}
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return
+		}
+		size -= n
+	}
+}
+
+// loadBodyTemplate parses the response body template from BODY_TEMPLATE_FILE
+// or, failing that, the inline BODY_TEMPLATE. It returns nil if neither is set.
+func loadBodyTemplate() (*template.Template, error) {
+	if file := os.Getenv("BODY_TEMPLATE_FILE"); file != "" {
+		text, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return newTemplate(file).Parse(string(text))
+	}
+	if text := os.Getenv("BODY_TEMPLATE"); text != "" {
+		return newTemplate("BODY_TEMPLATE").Parse(text)
+	}
+	return nil, nil
+}
+
+// writeBody writes the released response body for req.
+func (s *Server) writeBody(w io.Writer, r *http.Request, req *pendingRequest, responseTime time.Time) {
+	// Write the current timestamp in ISO-8601 format (UTC)
+	timestamp := responseTime.UTC().Format(time.RFC3339)
+
+	if req.bodyOverride != nil {
+		w.Write(req.bodyOverride)
+		return
+	}
+
+	if size := req.generatedSize; size > 0 {
+		generateBody(w, size, s.randomBody)
+		return
+	}
+
+	if req.fixture != "" {
+		data, err := os.ReadFile(req.fixture)
+		if err != nil {
+			// Headers are already sent, so the best we can do is report it
+			s.warnf("Request #%d: Failed to read fixture: %v", req.id, err)
+			return
+		}
+		w.Write(data)
+		return
+	}
+
+	if s.echo {
+		response := echoResponse{
+			ID:         req.id,
+			Method:     req.method,
+			Path:       req.path,
+			Query:      r.URL.Query(),
+			Headers:    req.header,
+			Body:       string(req.body),
+			RemoteAddr: req.remoteAddr,
+			HeldFor:    responseTime.Sub(req.requestTime).String(),
+			Timestamp:  timestamp,
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(response)
+		return
+	}
+
+	s.configMu.RLock()
+	tmpl := s.bodyTemplate
+	s.configMu.RUnlock()
+	if req.route != nil && req.route.rawBody != nil {
+		w.Write(req.route.rawBody)
+		return
+	}
+	if req.route != nil && req.route.body != nil {
+		tmpl = req.route.body
+	}
+	if tmpl == nil {
+		response := map[string]string{
+			"timestamp": timestamp,
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	data := templateData{
+		ID:         req.id,
+		Method:     req.method,
+		Path:       req.path,
+		Query:      r.URL.Query(),
+		RemoteAddr: req.remoteAddr,
+		ReceivedAt: req.requestTime,
+		HeldFor:    responseTime.Sub(req.requestTime),
+		Timestamp:  timestamp,
+		Segments:   strings.FieldsFunc(req.path, func(r rune) bool { return r == '/' }),
+		Params:     req.params,
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		// Headers are already sent, so the best we can do is report it
+		s.warnf("Request #%d: Failed to render body template: %v", req.id, err)
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// route is a canned response for requests whose path matches Path, loaded
+// from the ROUTES_FILE JSON file:
+//
+//	[
+//	  {"path": "/users", "status": 200, "body": {"users": []}},
+//	  {"path": "/orders/*", "method": "POST", "status": 201,
+//	   "headers": {"X-Mock": "orders"}, "body": "{\"id\":{{.ID}}}"},
+//	  {"path": "/grpc/*", "trailers": {"Grpc-Status": "0"}},
+//	  {"path": "/admin/*", "middleware": ["log", "auth:bearer:s3cret"]},
+//	  {"path": "/slow", "deadline": "30s", "deadline_status": 504},
+//	  {"path": "/users/{id}/orders/{oid}", "body": "{\"order\":\"{{.Params.oid}}\"}"}
+//	]
+//
+// Path uses the same prefix-or-glob matching as the release command, or
+// captures path parameters such as {id} (see matchParams). Body may be a
+// JSON value, which is sent verbatim, or a string, which is rendered as a
+// text/template with the same data as BODY_TEMPLATE plus the parameters in
+// .Params. Trailers take the same form as TRAILERS values and replace them
+// for the route. Middleware names built-in middleware (see middlewareSpec)
+// run after MIDDLEWARE.
+//
+// A request held on a route with a deadline that is still pending when the
+// deadline passes is answered with DeadlineStatus (504 by default). Such
+// requests send nothing until they are released, so that the status can
+// still change.
+type route struct {
+	Path        string            `json:"path"`
+	Method      string            `json:"method,omitempty"`
+	Status      int               `json:"status,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Trailers    map[string]string `json:"trailers,omitempty"`
+	Middleware  []string          `json:"middleware,omitempty"`
+	Body        json.RawMessage   `json:"body,omitempty"`
+
+	Deadline       string `json:"deadline,omitempty"`
+	DeadlineStatus int    `json:"deadline_status,omitempty"`
+
+	body       *template.Template
+	rawBody    []byte
+	trailers   []trailer
+	middleware []middlewareSpec
+	deadline   time.Duration
+}
+
+// loadRoutes reads and validates the routes in file.
+func loadRoutes(file string) ([]*route, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []*route
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", file, err)
+	}
+
+	for i, rt := range routes {
+		if rt.Path == "" {
+			return nil, fmt.Errorf("route %d: path is required", i)
+		}
+		if err := checkPathPattern(rt.Path); err != nil {
+			return nil, fmt.Errorf("route %d: %v", i, err)
+		}
+		if rt.Status != 0 && (rt.Status < 100 || rt.Status > 599) {
+			return nil, fmt.Errorf("route %d (%s): invalid status %d", i, rt.Path, rt.Status)
+		}
+		if rt.trailers, err = trailersFromMap(rt.Trailers); err != nil {
+			return nil, fmt.Errorf("route %d (%s): %v", i, rt.Path, err)
+		}
+		if rt.middleware, err = parseMiddlewareSpecs(rt.Middleware); err != nil {
+			return nil, fmt.Errorf("route %d (%s): %v", i, rt.Path, err)
+		}
+		if rt.Deadline != "" {
+			if rt.deadline, err = parseDelay(rt.Deadline); err != nil || rt.deadline == 0 {
+				return nil, fmt.Errorf("route %d (%s): invalid deadline %q", i, rt.Path, rt.Deadline)
+			}
+		}
+		if rt.DeadlineStatus == 0 {
+			rt.DeadlineStatus = http.StatusGatewayTimeout
+		} else if rt.DeadlineStatus < 100 || rt.DeadlineStatus > 599 {
+			return nil, fmt.Errorf("route %d (%s): invalid deadline_status %d", i, rt.Path, rt.DeadlineStatus)
+		}
+		if len(rt.Body) == 0 {
+			continue
+		}
+
+		// A JSON string is a template; any other JSON value is the body itself
+		var text string
+		if json.Unmarshal(rt.Body, &text) != nil {
+			rt.rawBody = rt.Body
+			continue
+		}
+		rt.body, err = newTemplate(rt.Path).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("route %d (%s): %v", i, rt.Path, err)
+		}
+	}
+	return routes, nil
+}
+
+// armDeadline starts the timer that answers req with its route's deadline
+// status if it is still held when the deadline passes. The returned function
+// stops it.
+func (s *Server) armDeadline(req *pendingRequest) (stop func()) {
+	rt := req.route
+	if rt == nil || rt.deadline <= 0 {
+		return func() {}
+	}
+	id := req.id
+	timer := time.AfterFunc(rt.deadline, func() {
+		if s.releaseMatching(matchID(id), releaseOptions{cause: "deadline", status: rt.DeadlineStatus}) > 0 {
+			s.warnf("Request #%d: Hold deadline of %s passed; answering %d", id, rt.deadline, rt.DeadlineStatus)
+		}
+	})
+	return func() { timer.Stop() }
+}
+
+// routePath returns the path pattern of rt, which names its queue, or "" for
+// requests without a route.
+func routePath(rt *route) string {
+	if rt == nil {
+		return ""
+	}
+	return rt.Path
+}
+
+// matchRoute returns the first route matching r, or nil if none does.
+func (s *Server) matchRoute(r *http.Request) *route {
+	s.configMu.RLock()
+	routes := s.routes
+	s.configMu.RUnlock()
+
+	for _, rt := range routes {
+		if rt.Method != "" && !strings.EqualFold(rt.Method, r.Method) {
+			continue
+		}
+		if matchPath(rt.Path, r.URL.Path) {
+			return rt
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+// holdRule selects requests to hold by optional method and path pattern.
+type holdRule struct {
+	method  string
+	pattern string
+}
+
+// parseHoldRules parses a comma-separated HOLD_RULES list. Each entry is a
+// path pattern (prefix, glob or path parameters, as for routes), optionally
+// preceded by a method: "POST /api/orders, /users/*, /users/{id:4*}".
+func parseHoldRules(spec string) ([]holdRule, error) {
+	var rules []holdRule
+	for _, entry := range strings.Split(spec, ",") {
+		fields := strings.Fields(entry)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			rules = append(rules, holdRule{pattern: fields[0]})
+		case 2:
+			rules = append(rules, holdRule{method: strings.ToUpper(fields[0]), pattern: fields[1]})
+		default:
+			return nil, fmt.Errorf("invalid hold rule %q (want \"[METHOD] /path\")", strings.TrimSpace(entry))
+		}
+	}
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule.pattern, "/") && !strings.HasPrefix(rule.pattern, "*") {
+			return nil, fmt.Errorf("invalid hold rule pattern %q (must start with /)", rule.pattern)
+		}
+		if err := checkPathPattern(rule.pattern); err != nil {
+			return nil, fmt.Errorf("invalid hold rule: %v", err)
+		}
+	}
+	return rules, nil
+}
+
+func (rule holdRule) matches(r *http.Request) bool {
+	if rule.method != "" && rule.method != r.Method {
+		return false
+	}
+	return matchPath(rule.pattern, r.URL.Path)
+}
+
+// defaultBypassPaths are answered immediately unless BYPASS_PATHS overrides
+// them, so health probes never end up in the pending queue.
+const defaultBypassPaths = "/healthz,/readyz"
+
+// parseBypassPaths parses a comma-separated list of exact paths.
+func parseBypassPaths(spec string) map[string]bool {
+	paths := make(map[string]bool)
+	for _, p := range strings.Split(spec, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths[p] = true
+		}
+	}
+	return paths
+}
+
+// handleBypass answers a health check path immediately without numbering,
+// logging or holding it.
+func handleBypass(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// shouldHold reports whether r should be held: whether it matches the hold
+// rules and is picked by HOLD_FIRST, HOLD_EVERY and HOLD_PERCENT. It is
+// called once per request, as those count and sample matching requests.
+func (s *Server) shouldHold(r *http.Request) bool {
+	if !s.matchesHoldRules(r) {
+		return false
+	}
+	n := s.holdCandidates.Add(1)
+	if s.holdFirst > 0 && n > s.holdFirst {
+		return false
+	}
+	if s.holdEvery > 0 && n%s.holdEvery != 0 {
+		return false
+	}
+	return s.holdPercent >= 100 || rand.Float64()*100 < s.holdPercent
+}
+
+// matchesHoldRules reports whether r matches the hold rules. Without hold
+// rules every request does; otherwise only requests matching at least one
+// rule do.
+func (s *Server) matchesHoldRules(r *http.Request) bool {
+	s.configMu.RLock()
+	rules := s.holdRules
+	s.configMu.RUnlock()
+
+	if len(rules) == 0 {
+		return true
+	}
+	for _, rule := range rules {
+		if rule.matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// ordinal formats n as "1st", "2nd", "3rd", "4th" and so on.
+func ordinal(n int64) string {
+	suffix := "th"
+	switch n % 10 {
+	case 1:
+		suffix = "st"
+	case 2:
+		suffix = "nd"
+	case 3:
+		suffix = "rd"
+	}
+	if n%100 >= 11 && n%100 <= 13 {
+		suffix = "th"
+	}
+	return fmt.Sprintf("%d%s", n, suffix)
+}
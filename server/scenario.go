@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// scenarioStep is one stage of a scenario, loaded from the SCENARIO_FILE JSON
+// file:
+//
+//	[
+//	  {"count": 3, "action": "hold"},
+//	  {"count": 2, "action": "delay", "delay": "1s", "status": 500},
+//	  {"action": "respond"}
+//	]
+//
+// Each step applies to the next Count requests and accepts the same fields
+// as a DECIDE_SCRIPT decision. A step without a count applies to every
+// remaining request; once all counted steps are used up the server returns
+// to its default behavior.
+type scenarioStep struct {
+	scriptDecision
+	Count int `json:"count,omitempty"`
+}
+
+// describe summarizes the step for the console.
+func (step scenarioStep) describe() string {
+	parts := []string{step.Action}
+	if step.Action == "" {
+		parts[0] = "default"
+	}
+	if step.Action == "delay" {
+		parts = append(parts, step.Delay)
+	}
+	if step.Status != 0 {
+		parts = append(parts, fmt.Sprintf("with %d", step.Status))
+	}
+	if step.Count > 0 {
+		parts = append(parts, fmt.Sprintf("(%d request(s))", step.Count))
+	} else {
+		parts = append(parts, "(all remaining requests)")
+	}
+	return strings.Join(parts, " ")
+}
+
+// scenario plays back its steps in order, one request at a time.
+type scenario struct {
+	mu    sync.Mutex
+	steps []scenarioStep
+	step  int // index of the current step
+	used  int // requests handled by the current step
+}
+
+// loadScenario reads and validates the steps in file.
+func loadScenario(file string) (*scenario, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []scenarioStep
+	if err := json.Unmarshal(data, &steps); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", file, err)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%s has no steps", file)
+	}
+	for i, step := range steps {
+		if step.Count < 0 {
+			return nil, fmt.Errorf("step %d: count must not be negative", i+1)
+		}
+		if err := step.validate(); err != nil {
+			return nil, fmt.Errorf("step %d: %v", i+1, err)
+		}
+	}
+	return &scenario{steps: steps}, nil
+}
+
+// next returns the decision for the next request and, when that request
+// starts a new step, a description of the step to announce. It returns
+// false once the scenario is over.
+func (sc *scenario) next() (decision scriptDecision, announce string, ok bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.step < len(sc.steps) && sc.steps[sc.step].Count > 0 && sc.used >= sc.steps[sc.step].Count {
+		sc.step++
+		sc.used = 0
+	}
+	if sc.step >= len(sc.steps) {
+		if sc.used == 0 {
+			sc.used = 1
+			return decision, "Scenario finished; back to the default behavior", false
+		}
+		return decision, "", false
+	}
+
+	step := sc.steps[sc.step]
+	if sc.used == 0 {
+		announce = fmt.Sprintf("Scenario step %d/%d: %s", sc.step+1, len(sc.steps), step.describe())
+	}
+	sc.used++
+	return step.scriptDecision, announce, true
+}
+
+// status describes the current position in the scenario.
+func (sc *scenario) status() string {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.step >= len(sc.steps) {
+		return "Scenario finished"
+	}
+	step := sc.steps[sc.step]
+	return fmt.Sprintf("Scenario step %d/%d: %s, %d request(s) handled so far",
+		sc.step+1, len(sc.steps), step.describe(), sc.used)
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// scriptTimeout bounds how long a decision script may run per request.
+const scriptTimeout = 5 * time.Second
+
+// scriptInput is what a decision script receives as JSON on stdin.
+type scriptInput struct {
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Query      map[string][]string `json:"query"`
+	Headers    http.Header         `json:"headers"`
+	Body       string              `json:"body"`
+	RemoteAddr string              `json:"remote_addr"`
+	Pending    int                 `json:"pending"`
+	Params     map[string]string   `json:"params,omitempty"`
+}
+
+// scriptDecision is what a decision script prints as JSON on stdout. Every
+// field is optional; empty output keeps the default behavior.
+type scriptDecision struct {
+	// Action is "hold" (wait for manual release), "delay" (release after
+	// Delay), "respond" (answer immediately), "drop" or "reset".
+	Action string  `json:"action"`
+	Delay  string  `json:"delay"`
+	Status int     `json:"status"`
+	Body   *string `json:"body"`
+
+	// DripRate, e.g. "100" or "1KB", streams the body at this many bytes
+	// per second.
+	DripRate string `json:"drip_rate"`
+}
+
+// runScript asks the DECIDE_SCRIPT command how to handle r.
+func (s *Server) runScript(r *http.Request, req *pendingRequest) (scriptDecision, error) {
+	var decision scriptDecision
+	input, err := json.Marshal(scriptInput{
+		Method:     req.method,
+		Path:       req.path,
+		Query:      r.URL.Query(),
+		Headers:    req.header,
+		Body:       string(req.body),
+		RemoteAddr: req.remoteAddr,
+		Pending:    len(s.snapshot()),
+		Params:     req.params,
+	})
+	if err != nil {
+		return decision, err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), scriptTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.script[0], s.script[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return decision, fmt.Errorf("%v: %s", err, msg)
+		}
+		return decision, err
+	}
+
+	if len(bytes.TrimSpace(output)) == 0 {
+		return decision, nil
+	}
+	if err := json.Unmarshal(output, &decision); err != nil {
+		return decision, fmt.Errorf("invalid decision %q: %v", bytes.TrimSpace(output), err)
+	}
+	return decision, decision.validate()
+}
+
+func (d scriptDecision) validate() error {
+	switch d.Action {
+	case "", "hold", "respond", "drop", "reset":
+	case "delay":
+		if _, err := parseDelay(d.Delay); err != nil {
+			return fmt.Errorf("delay action needs a delay such as \"2s\"")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", d.Action)
+	}
+	if d.Status != 0 && (d.Status < 100 || d.Status > 599) {
+		return fmt.Errorf("invalid status %d", d.Status)
+	}
+	if d.DripRate != "" {
+		if rate, err := parseByteSize(d.DripRate); err != nil || rate <= 0 {
+			return fmt.Errorf("invalid drip_rate %q", d.DripRate)
+		}
+	}
+	return nil
+}
+
+// decide asks the scenario, or else the body rules, the chaos mix or the
+// decision script how to handle r and reports whether any had a decision.
+func (s *Server) decide(r *http.Request, req *pendingRequest) (scriptDecision, bool) {
+	if s.scenario != nil {
+		decision, announce, ok := s.scenario.next()
+		if announce != "" {
+			s.printf("%s\n", announce)
+		}
+		if ok {
+			return decision, true
+		}
+	}
+
+	if rule, ok := s.matchBodyRule(req); ok {
+		s.printf("%s %s from %s matched body rule: %s\n", req.method, req.path, req.remoteAddr, rule.spec)
+		return rule.decision, true
+	}
+
+	if s.chaos != nil {
+		fault := s.chaos.draw()
+		s.printf("%s %s from %s drew chaos fault: %s\n", req.method, req.path, req.remoteAddr, fault.name)
+		return fault.decision, true
+	}
+
+	if len(s.script) == 0 {
+		return scriptDecision{}, false
+	}
+	decision, err := s.runScript(r, req)
+	if err != nil {
+		s.warnf("Decision script failed for %s %s: %v", req.method, req.path, err)
+		return scriptDecision{}, false
+	}
+	return decision, true
+}
+
+// applyDecision applies the scenario or decision script verdict for r, if
+// any, to req. It returns the possibly changed hold decision and status, and
+// reports false if the request was dropped and needs no further handling.
+func (s *Server) applyDecision(w http.ResponseWriter, r *http.Request, req *pendingRequest, held bool, status int) (bool, int, bool) {
+	decision, ok := s.decide(r, req)
+	if !ok {
+		return held, status, true
+	}
+
+	if decision.Status != 0 {
+		status = decision.Status
+	}
+	if decision.Body != nil {
+		req.bodyOverride = []byte(*decision.Body)
+	}
+	if decision.DripRate != "" {
+		req.dripRate, _ = parseByteSize(decision.DripRate)
+	}
+	switch decision.Action {
+	case "hold":
+		held = true
+	case "delay":
+		held = true
+		req.delay, _ = parseDelay(decision.Delay)
+	case "respond":
+		held = false
+	case "drop", "reset":
+		// Numbered and recorded before the connection goes, so that history,
+		// statistics and the access log account for it
+		s.numberRequest(req)
+		req.dropped, req.releaseCause = true, "decided"
+		if decision.Action == "reset" {
+			_, req.reset = w.(http.Hijacker)
+		}
+		s.logDropped(req)
+		if req.reset && resetResponse(w) {
+			return held, status, false
+		}
+		panic(http.ErrAbortHandler)
+	}
+	return held, status, true
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// setSequence sets the order in which the next release that includes any of
+// ids emits their responses. Every id must be pending.
+func (s *Server) setSequence(ids []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[int]bool)
+	for _, id := range ids {
+		if seen[id] {
+			return fmt.Errorf("request #%d is listed twice", id)
+		}
+		seen[id] = true
+		found := false
+		for _, req := range s.pendingRequests {
+			if req.id == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("request #%d is not pending", id)
+		}
+	}
+	s.sequence = ids
+	return nil
+}
+
+// applySequence moves the released requests named by the pending sequence to
+// the front, in that order, and chains them so that each one's response is
+// only sent once the previous one has finished. The sequence is used up by
+// the first release that includes any of its requests.
+func (s *Server) applySequence(released []*pendingRequest) []*pendingRequest {
+	s.mu.Lock()
+	sequence := s.sequence
+	byID := make(map[int]*pendingRequest, len(released))
+	for _, req := range released {
+		byID[req.id] = req
+	}
+	var ordered []*pendingRequest
+	var missing []string
+	for _, id := range sequence {
+		if req, ok := byID[id]; ok {
+			ordered = append(ordered, req)
+		} else {
+			missing = append(missing, "#"+strconv.Itoa(id))
+		}
+	}
+	if len(ordered) == 0 {
+		s.mu.Unlock()
+		return released
+	}
+	s.sequence = nil
+	s.mu.Unlock()
+
+	names := make([]string, len(ordered))
+	inSequence := make(map[*pendingRequest]bool, len(ordered))
+	var previous *pendingRequest
+	for i, req := range ordered {
+		names[i] = "#" + strconv.Itoa(req.id)
+		inSequence[req] = true
+		req.sent = make(chan struct{})
+		if previous != nil {
+			req.after = previous.sent
+		}
+		previous = req
+	}
+	s.printf("Sending responses in order %s\n", strings.Join(names, ", "))
+	if len(missing) > 0 {
+		s.printf("Not part of this release, so left out of the order: %s\n", strings.Join(missing, ", "))
+	}
+
+	for _, req := range released {
+		if !inSequence[req] {
+			ordered = append(ordered, req)
+		}
+	}
+	return ordered
+}
+
+// markSent lets the request after req in a sequence send its response.
+func markSent(req *pendingRequest) {
+	if req.sent != nil {
+		close(req.sent)
+		req.sent = nil
+	}
+}
+
+// printSequence prints the order set with the order command, if any.
+func (s *Server) printSequence(out io.Writer) {
+	s.mu.Lock()
+	sequence := s.sequence
+	s.mu.Unlock()
+	if len(sequence) == 0 {
+		fmt.Fprintln(out, "No response order set")
+		return
+	}
+	names := make([]string, len(sequence))
+	for i, id := range sequence {
+		names[i] = "#" + strconv.Itoa(id)
+	}
+	fmt.Fprintf(out, "The next release sends responses in order %s\n", strings.Join(names, ", "))
+}
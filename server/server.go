@@ -0,0 +1,1726 @@
+// Package server implements the variable debug web server: an HTTP server
+// that holds incoming requests until they are released from the console, the
+// admin API or embedding code. Main runs it as the command-line tool, set up
+// from flags and the environment; NewServer, OnHold, Use and Handler let
+// other code, such as integration tests, run it with a gating policy of its
+// own.
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+type pendingRequest struct {
+	id           int
+	requestTime  time.Time
+	responseChan chan struct{}
+	dropped      bool
+	reset        bool
+	remoteAddr   string
+	port         string
+	client       string
+	traceID      string
+	group        string
+	scheme       string
+	host         string
+	proto        string
+	path         string
+	rawQuery     string
+	method       string
+	header       http.Header
+	body         []byte
+	bodySize     int64
+	route        *route
+	clientCert   string
+
+	// status is the response status code, once known.
+	status int
+
+	// delay and bodyOverride are per-request overrides from the X-Debug-Delay
+	// and X-Debug-Body control headers or the decision script.
+	delay        time.Duration
+	bodyOverride []byte
+
+	// dripRate, when non-zero, streams this request's body at this many
+	// bytes per second instead of DRIP_RATE.
+	dripRate int64
+
+	// generatedSize, when non-zero, replaces the body with this many
+	// generated bytes (BODY_SIZE or the size query parameter).
+	generatedSize int64
+
+	// awaitingContinue is set while the request is held before 100 Continue
+	// has been sent (EXPECT_CONTINUE=hold or refuse).
+	awaitingContinue bool
+
+	// awaitingBody is set while the request is held part-way into reading
+	// its body (HOLD_BODY_READ), after bodyRead bytes.
+	awaitingBody bool
+	bodyRead     int64
+
+	// graphQL lists the operations of a GraphQL POST.
+	graphQL []graphQLOperation
+
+	// params are the path parameters captured by the route's path pattern.
+	params map[string]string
+
+	// access collects the request's outcome for ACCESS_LOG.
+	access *accessRecord
+
+	// stats is what the request last contributed to the session statistics.
+	stats *statsEntry
+
+	// requestID is the X-Request-Id the request arrived with, or the one
+	// generated for it (see withRequestID).
+	requestID string
+
+	// fixture is the FIXTURES_DIR file the response body is read from on
+	// release.
+	fixture string
+
+	// soapAction is the action of a SOAP request.
+	soapAction string
+
+	// fingerprint identifies the request by method, path, query and body
+	// once its body has been read; duplicateOf is the number of an identical
+	// request still pending or answered recently, described by
+	// duplicateNote (see duplicateDetector).
+	fingerprint   string
+	duplicateOf   int
+	duplicateNote string
+
+	// idempotencyKey is the Idempotency-Key header. idempotentRepeatOf is the
+	// number of the first request sent with the same key, if this is a
+	// repeat, and idempotencyConflict is set when the two differ.
+	idempotencyKey      string
+	idempotentRepeatOf  int
+	idempotencyConflict bool
+
+	// savedParts maps the index of each multipart file part saved to
+	// MULTIPART_DIR to its file.
+	savedParts map[int]string
+
+	// malformed, when set, is how the response deliberately violates HTTP
+	// (MALFORMED or X-Debug-Malformed); see malformedModes.
+	malformed string
+
+	// releaseCause records why the request was released, e.g. "manual" or
+	// "timeout", or why it never was held: "passthrough", "idempotent" or
+	// "decided" (dropped by a decision).
+	releaseCause string
+
+	// partial is set once part of the body has been sent and the request
+	// has been put back on hold.
+	partial bool
+
+	// releaseStatus, when non-zero, replaces the normal response of a
+	// request whose status line has not been sent yet.
+	releaseStatus int
+
+	// finish is set by the end command: a request being stepped through
+	// chunk by chunk sends the rest of its body at once.
+	finish bool
+
+	// after and sent chain requests released in an order set with the order
+	// command: the response waits for after to be closed, and sent is closed
+	// once the request has finished.
+	after <-chan struct{}
+	sent  chan struct{}
+}
+
+type Server struct {
+	// OnHold, if set, is called each time a request is put on hold, after it
+	// has been added to the pending queue. It runs on the request's own
+	// goroutine, so it may call Release or Drop but should not block for long.
+	OnHold func(HeldRequest)
+
+	// middleware is added with Use; builtinMiddleware comes from MIDDLEWARE.
+	middleware        []registeredMiddleware
+	builtinMiddleware []middlewareSpec
+
+	mu              sync.Mutex
+	pendingRequests []*pendingRequest
+	requestCounter  int
+
+	// sequence is the response order set with the order command for the
+	// next release that includes any of these requests.
+	sequence []int
+
+	// queueChanged is closed and replaced whenever pendingRequests changes.
+	queueChanged chan struct{}
+
+	// configMu guards the settings that are reloaded when the -config file
+	// changes: status, bodyTemplate, holdRules, bodyRules, routes,
+	// latencyProfile and holdTimeout.
+	configMu sync.RWMutex
+
+	// status is the response status code used unless a request overrides it.
+	status int
+
+	// contentType is sent with every held response.
+	contentType string
+
+	// echo makes the response body describe the original request.
+	echo bool
+
+	// logger, when set, receives one structured record per request event
+	// in place of the human-readable console output.
+	logger *slog.Logger
+
+	// verbose prints every request's headers on arrival, and verboseBody its
+	// body too. maskSecrets hides credential headers in console output.
+	verbose     bool
+	verboseBody bool
+	maskSecrets bool
+
+	// consoleMu keeps console output from interleaving (see writeConsole),
+	// and color enables ANSI colors in it.
+	consoleMu sync.Mutex
+	color     bool
+
+	// accessLog, when set, records every request with its hold time.
+	accessLog *accessLog
+
+	// stdoutReserved keeps everything but JSON event records off standard
+	// output (OUTPUT=ndjson); console output goes to standard error instead.
+	stdoutReserved bool
+
+	// bodyTemplate, when set, renders the response body instead of the
+	// default timestamp JSON.
+	bodyTemplate *template.Template
+
+	// webSocketHold is what is withheld from WebSocket clients until release:
+	// "message" (the first server message) or "handshake" (the 101 response).
+	webSocketHold string
+
+	// sse, when enabled, receives an event on every Enter press.
+	sse *sseHub
+
+	// proxy, when set, forwards released requests to an upstream server
+	// instead of answering them locally.
+	proxy *httputil.ReverseProxy
+
+	// vcr, when set, records upstream responses in proxy mode or replays
+	// them without an upstream.
+	vcr *vcr
+
+	// proxyHold is where proxied requests are held: "request" (before
+	// forwarding) or "response" (after the upstream's headers are relayed).
+	proxyHold string
+
+	// maxPending, when non-zero, caps the pending queue; requests beyond it
+	// are rejected with 503 instead of being held.
+	maxPending int
+
+	// bypassPaths are answered immediately and never held or logged.
+	bypassPaths map[string]bool
+
+	// holdRules, when non-empty, limit holding to matching requests; all
+	// other requests are answered immediately.
+	holdRules []holdRule
+
+	// holdPercent is the share of requests matching the hold rules that is
+	// held, picked at random; the rest are answered immediately.
+	holdPercent float64
+
+	// holdFirst, when non-zero, holds only the first this many requests
+	// matching the hold rules; holdEvery, when non-zero, only every this
+	// many-th one. holdCandidates counts the matching requests.
+	holdFirst      int64
+	holdEvery      int64
+	holdCandidates atomic.Int64
+
+	// bodyRules, when non-empty, decide how to handle requests by the
+	// content of their JSON body, ahead of the decision script.
+	bodyRules []bodyRule
+
+	// routes are canned responses selected by request path.
+	routes []*route
+
+	// fixturesDir, when set, holds response bodies laid out by request
+	// path; see findFixture.
+	fixturesDir string
+
+	// holdHeaders withholds the status line and headers of held requests
+	// until release instead of flushing them on arrival.
+	holdHeaders bool
+
+	// partialBytes, when non-zero, sends only this many bytes of the body on
+	// release and then holds the connection until a second release.
+	partialBytes int
+
+	// cors, when set, adds Access-Control-* headers and answers preflights.
+	cors *corsPolicy
+
+	// auth, when set, requires Basic or Bearer credentials.
+	auth *authConfig
+
+	// expectContinue is "hold" or "refuse" to hold requests sent with
+	// Expect: 100-continue before their body is read, or "" to continue
+	// at once.
+	expectContinue string
+
+	// holdBodyAfter, when not negative, holds requests with a body once this
+	// many bytes of it have been read, before holding them for the response.
+	holdBodyAfter int64
+
+	// protoSchema, when set, names the fields of protobuf, gRPC and gRPC-Web
+	// bodies (PROTO_DESCRIPTORS).
+	protoSchema *protoSchema
+
+	// multipartDir, when set, receives the files uploaded in
+	// multipart/form-data bodies.
+	multipartDir string
+
+	// uploadProgress, when non-zero, prints the progress of request bodies
+	// at this interval while they stream in; uploadDir, when set, saves
+	// each body to a file there.
+	uploadProgress time.Duration
+	uploadDir      string
+
+	// connectionClose sends Connection: close with every HTTP/1.x response;
+	// maxConnRequests, when non-zero, does so once a connection has carried
+	// that many requests.
+	connectionClose bool
+	maxConnRequests int
+
+	// rateLimiter, when set, answers some requests with 429 instead of
+	// holding them.
+	rateLimiter *rateLimiter
+
+	// redirectDepth, when non-zero, answers each request with a chain of
+	// this many redirects back to itself; redirectStatus is their status.
+	redirectDepth  int
+	redirectStatus int
+
+	// malformed, when set, makes every response deliberately malformed in
+	// this way; see malformedModes.
+	malformed string
+
+	// compression is "auto", "gzip", "deflate" or "" for none.
+	// contentEncoding, when set, is announced in place of the encoding
+	// actually applied, to test clients against a mismatch.
+	compression     string
+	contentEncoding string
+
+	// trailers are sent after every response body unless its route has
+	// its own.
+	trailers []trailer
+
+	// chunkSize, when non-zero, sends released bodies one chunk of this many
+	// bytes per release, holding the connection between chunks.
+	chunkSize int
+
+	// bodySize, when non-zero, replaces response bodies with this many
+	// generated bytes; randomBody makes them random instead of a repeating
+	// pattern.
+	bodySize   int64
+	randomBody bool
+
+	// dripRate, when non-zero, limits released bodies to this many bytes
+	// per second, written in small flushed chunks.
+	dripRate int64
+
+	// history keeps recently completed requests; replayUpstream is where the
+	// replay command sends them.
+	history        *requestHistory
+	replayUpstream string
+
+	// script, when set, is the DECIDE_SCRIPT command and its arguments.
+	script []string
+
+	// chaos, when set, draws a fault for every request from the CHAOS mix,
+	// ahead of the decision script.
+	chaos *chaosMix
+
+	// ports lists the HTTP listener ports. With more than one, each port's
+	// requests form their own queue, selected with ":<port>" in commands.
+	ports []string
+
+	// tcpReply is written to raw TCP clients on release; nil echoes what
+	// they sent.
+	tcpReply []byte
+
+	// scenario, when set, is played back from SCENARIO_FILE and takes
+	// precedence over the script until it is finished.
+	scenario *scenario
+
+	// eventSubs are the admin /events streams.
+	eventSubs eventSubscribers
+
+	// tracer, when set, exports a span for each hold to an OTLP collector.
+	tracer *tracer
+
+	// webhook, when set, receives a JSON event for every request event.
+	webhook *webhook
+
+	// notifier, when set, alerts the user to each newly held request.
+	notifier *notifier
+
+	// served counts answered requests.
+	served atomic.Int64
+
+	// startTime is when the server was created.
+	startTime time.Time
+
+	// stats tallies request outcomes for the stats command.
+	stats *sessionStats
+
+	// duplicates, when set, flags requests identical to a recent one.
+	duplicates *duplicateDetector
+
+	// idempotency, when set, tracks Idempotency-Key headers (IDEMPOTENCY).
+	idempotency *idempotencyTracker
+
+	// clientHeader, when set, names the request header identifying clients
+	// for per-client commands instead of the remote IP address.
+	clientHeader string
+
+	// sessionCookie, when set, names the cookie identifying clients (after
+	// CLIENT_HEADER); responses to requests without it set a new one.
+	// setCookie are Set-Cookie values added to every response.
+	sessionCookie string
+	setCookie     []string
+
+	// releaseOrder is the default order in which a batch of requests is
+	// released: "fifo", "lifo" or "random".
+	releaseOrder string
+
+	// controlHeaders enables per-request X-Debug-* overrides.
+	controlHeaders bool
+
+	// latencyProfile, when set, releases each held request automatically
+	// after a delay sampled from it. Manual release still works meanwhile.
+	latencyProfile *latencyProfile
+
+	// holdTimeout, when non-zero, automatically releases each request after
+	// it has been held for that long.
+	holdTimeout time.Duration
+}
+
+func NewServer() *Server {
+	return &Server{
+		pendingRequests: make([]*pendingRequest, 0),
+		queueChanged:    make(chan struct{}),
+		status:          http.StatusOK,
+		contentType:     "text/plain",
+		webSocketHold:   "message",
+		proxyHold:       "request",
+		controlHeaders:  true,
+		releaseOrder:    "fifo",
+		redirectStatus:  http.StatusFound,
+		holdPercent:     100,
+		startTime:       time.Now(),
+		stats:           newSessionStats(),
+		idempotency:     newIdempotencyTracker(false),
+	}
+}
+
+// maxCapturedBody is how much of each request body is kept for inspection.
+const maxCapturedBody = 10 << 20
+
+// captureBody reads the request body, keeping up to maxCapturedBody bytes
+// and discarding the rest.
+func (req *pendingRequest) captureBody(body io.Reader) error {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(body, maxCapturedBody))
+	if err != nil {
+		return err
+	}
+	rest, err := io.Copy(io.Discard, body)
+	req.body = buf.Bytes()
+	req.bodySize = n + rest
+	return err
+}
+
+func newPendingRequest(r *http.Request, requestTime time.Time, rt *route) *pendingRequest {
+	return &pendingRequest{
+		requestTime:    requestTime,
+		responseChan:   make(chan struct{}),
+		remoteAddr:     r.RemoteAddr,
+		port:           requestPort(r),
+		scheme:         requestScheme(r),
+		host:           r.Host,
+		proto:          r.Proto,
+		path:           r.URL.Path,
+		rawQuery:       r.URL.RawQuery,
+		method:         r.Method,
+		header:         r.Header,
+		route:          rt,
+		clientCert:     clientSubject(r),
+		traceID:        requestTraceID(r),
+		group:          requestGroup(r),
+		params:         routeParams(rt, r.URL.Path),
+		access:         requestAccessRecord(r),
+		requestID:      requestID(r),
+		idempotencyKey: r.Header.Get("Idempotency-Key"),
+	}
+}
+
+// requestGroup returns the release group r was tagged with by the group query
+// parameter or the X-Debug-Group header, if any.
+func requestGroup(r *http.Request) string {
+	if group := r.URL.Query().Get("group"); group != "" {
+		return group
+	}
+	return r.Header.Get("X-Debug-Group")
+}
+
+// requestTraceID returns the trace ID r was sent with, if any.
+func requestTraceID(r *http.Request) string {
+	tc, _ := requestTraceContext(r.Header)
+	return tc.traceID
+}
+
+// hold numbers req, adds it to the pending queue and announces it. If a hold
+// timeout, latency profile or route deadline is configured it also arms the
+// auto-release timers; the returned function disarms them.
+func (s *Server) hold(req *pendingRequest) (stopTimeout func()) {
+	req.client = s.clientID(req)
+	s.mu.Lock()
+	// A request held for 100 Continue keeps its number for the second hold
+	if req.id == 0 {
+		s.requestCounter++
+		req.id = s.requestCounter
+	}
+	s.checkRepeatsLocked(req)
+	s.pendingRequests = append(s.pendingRequests, req)
+	pendingCount := len(s.pendingRequests)
+	s.notifyQueueChangedLocked()
+	s.mu.Unlock()
+	s.stats.notePending(pendingCount)
+
+	s.logReceived(req, pendingCount)
+	s.notify(req)
+	if s.OnHold != nil {
+		s.OnHold(newHeldRequest(req))
+	}
+
+	s.configMu.RLock()
+	holdTimeout, profile := s.holdTimeout, s.latencyProfile
+	s.configMu.RUnlock()
+
+	delay, cause := holdTimeout, "timeout"
+	if req.delay > 0 {
+		delay, cause = req.delay, "header"
+	} else if profile != nil {
+		if d := profile.delay(); delay <= 0 || d < delay {
+			delay, cause = d, "profile"
+		}
+	}
+	stopDeadline := s.armDeadline(req)
+	if delay <= 0 && profile == nil {
+		return func() {
+			stopDeadline()
+			markSent(req)
+		}
+	}
+
+	// Release automatically if nobody does so first
+	id := req.id
+	timer := time.AfterFunc(delay, func() {
+		if s.releaseMatching(matchID(id), releaseOptions{cause: cause}) > 0 {
+			switch cause {
+			case "header":
+				s.printf("Request #%d auto-released after %s (per-request delay)\n", id, delay)
+			case "profile":
+				s.printf("Request #%d auto-released after %s (%s profile)\n", id, delay, profile.spec)
+			default:
+				s.printf("Request #%d auto-released after hold timeout of %s\n", id, delay)
+			}
+		}
+	})
+	return func() {
+		timer.Stop()
+		stopDeadline()
+		markSent(req)
+	}
+}
+
+// clientID identifies the client that sent req: the CLIENT_HEADER value or
+// SESSION_COOKIE cookie if configured and present, otherwise the remote IP
+// address.
+func (s *Server) clientID(req *pendingRequest) string {
+	if s.clientHeader != "" {
+		if id := req.header.Get(s.clientHeader); id != "" {
+			return id
+		}
+	}
+	if id := s.sessionID(req.header); id != "" {
+		return s.sessionCookie + "=" + id
+	}
+	host, _, err := net.SplitHostPort(req.remoteAddr)
+	if err != nil {
+		return req.remoteAddr
+	}
+	return host
+}
+
+// holdAgain puts an already released request back on the pending queue under
+// its existing number, e.g. after a partial response. It is not subject to
+// the hold timeout.
+func (s *Server) holdAgain(req *pendingRequest, reason string) {
+	req.responseChan = make(chan struct{})
+	req.partial = true
+
+	s.mu.Lock()
+	s.pendingRequests = append(s.pendingRequests, req)
+	s.notifyQueueChangedLocked()
+	s.mu.Unlock()
+
+	s.logRequest(req, "partial", "%s; holding the connection until released again", reason)
+}
+
+// passThrough numbers req and announces that it is being answered without
+// a hold.
+func (s *Server) passThrough(req *pendingRequest) {
+	s.numberRequest(req)
+	req.releaseCause = "passthrough"
+	s.logPassed(req)
+}
+
+// numberRequest gives req, which is not going to be held (again), the next
+// request number unless an earlier hold gave it one, and checks it against
+// earlier requests.
+func (s *Server) numberRequest(req *pendingRequest) {
+	req.client = s.clientID(req)
+	s.mu.Lock()
+	if req.id == 0 {
+		s.requestCounter++
+		req.id = s.requestCounter
+	}
+	s.checkRepeatsLocked(req)
+	s.mu.Unlock()
+}
+
+// answerStatus answers req with a plain-text error for req.status, as
+// http.Error does, and records the response.
+func (s *Server) answerStatus(w http.ResponseWriter, req *pendingRequest) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	body := []byte(http.StatusText(req.status) + "\n")
+	s.recordResponse(req, req.status, w.Header(), body)
+	w.WriteHeader(req.status)
+	w.Write(body)
+}
+
+// rejectOverflow answers r with 503 because the pending queue is full. The
+// Retry-After hint is the hold timeout if one is set.
+func (s *Server) rejectOverflow(w http.ResponseWriter, r *http.Request) {
+	retryAfter := 5 * time.Second
+	s.configMu.RLock()
+	if s.holdTimeout > 0 {
+		retryAfter = s.holdTimeout
+	}
+	s.configMu.RUnlock()
+	s.warnf("Rejected %s %s from %s: %d requests already pending", r.Method, r.URL.Path, r.RemoteAddr, s.maxPending)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "too many pending requests", http.StatusServiceUnavailable)
+}
+
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	requestTime := time.Now()
+
+	if s.bypassPaths[r.URL.Path] {
+		handleBypass(w, r)
+		return
+	}
+
+	preflight := s.cors != nil && isPreflight(r)
+	if s.cors != nil {
+		s.cors.setHeaders(w.Header(), r, preflight)
+		if preflight && !s.cors.holdPreflight {
+			s.printf("[%s] Answered CORS preflight for %s %s from %s\n",
+				requestTime.Format("15:04:05"), r.Header.Get("Access-Control-Request-Method"), r.URL.Path, r.Header.Get("Origin"))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	if s.rateLimiter != nil {
+		if ok, retryAfter := s.rateLimiter.allow(requestTime); !ok {
+			s.rejectRateLimited(w, r, retryAfter)
+			return
+		}
+	}
+
+	// Each listener port has its own queue limit
+	if s.maxPending > 0 && s.matchesHoldRules(r) && s.countPending(matchPort(requestPort(r))) >= s.maxPending {
+		s.rejectOverflow(w, r)
+		return
+	}
+
+	// AUTH covers every kind of request. Only plain requests can hold a
+	// failure (AUTH_FAILURE=hold); the rest are answered at once
+	var authFailed *authFailure
+	if !preflight && s.auth != nil {
+		client := s.clientID(&pendingRequest{header: r.Header, remoteAddr: r.RemoteAddr})
+		if authFailed = s.auth.check(r, client); authFailed != nil {
+			if authFailed.challenge != "" {
+				w.Header().Set("WWW-Authenticate", authFailed.challenge)
+			}
+			if !s.auth.hold || isWebSocketUpgrade(r) || s.vcr != nil && s.vcr.replay || s.proxy != nil {
+				s.printf("[%s] Rejected %s %s from %s with %d (%s)\n",
+					requestTime.Format("15:04:05"), r.Method, r.URL.Path, r.RemoteAddr, authFailed.status, authFailed.message)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(authFailed.status)
+				w.Write(authFailed.body())
+				return
+			}
+		}
+	}
+
+	if isWebSocketUpgrade(r) {
+		s.handleWebSocket(w, r, requestTime)
+		return
+	}
+
+	if s.vcr != nil && s.vcr.replay {
+		s.handleReplay(w, r, newPendingRequest(r, requestTime, nil))
+		return
+	}
+
+	if s.proxy != nil {
+		s.handleProxy(w, r, newPendingRequest(r, requestTime, nil))
+		return
+	}
+
+	rt := s.matchRoute(r)
+	status, err := s.responseStatus(r, rt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	location, redirect, err := s.redirectLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if redirect {
+		status = s.redirectStatus
+	}
+
+	// Create a pending request
+	req := newPendingRequest(r, requestTime, rt)
+	req.generatedSize = s.bodySize
+	req.malformed = s.malformed
+	if err := s.applyControlHeaders(r, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Routes take precedence over fixtures; requests without either get a
+	// 404, still held
+	var fixtureType string
+	if s.fixturesDir != "" && rt == nil {
+		req.fixture, fixtureType = s.findFixture(r.Method, r.URL.Path)
+		if req.fixture == "" && !redirect && req.bodyOverride == nil {
+			if !s.controlHeaders || r.Header.Get("X-Debug-Status") == "" && r.URL.Query().Get("status") == "" {
+				status = http.StatusNotFound
+			}
+			req.bodyOverride = []byte(fmt.Sprintf("{\"error\":\"no fixture for %s %s\"}\n", r.Method, r.URL.Path))
+			fixtureType = "application/json"
+		}
+	}
+
+	if authFailed != nil {
+		status = authFailed.status
+		req.bodyOverride = authFailed.body()
+	}
+
+	// Decided once, as sampling picks requests at random
+	shouldHold := s.shouldHold(r)
+
+	// Reading the body sends 100 Continue, so hold before it if requested
+	if s.expectContinue != "" && shouldHold && expectsContinue(r) && !s.holdContinue(w, r, req) {
+		return
+	}
+
+	// UPLOAD_PROGRESS and UPLOAD_DIR follow the body as it streams in, and
+	// HOLD_BODY_READ stalls it before or part-way into the body
+	var upload io.Reader = r.Body
+	finishUpload := func() {}
+	if (s.uploadProgress > 0 || s.uploadDir != "") && r.ContentLength != 0 {
+		upload, finishUpload = s.watchUpload(req, upload, r.ContentLength)
+		defer finishUpload()
+	}
+	if s.holdBodyAfter >= 0 && r.ContentLength != 0 && shouldHold {
+		var ok bool
+		if upload, ok = s.holdBodyRead(w, r, req, upload); !ok {
+			return
+		}
+	}
+
+	// The body has to be read before any part of the response is written
+	err = req.captureBody(upload)
+	finishUpload()
+	if err != nil {
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if s.multipartDir != "" {
+		s.saveFormFiles(req)
+	}
+	req.fingerprint = requestFingerprint(req)
+	if s.serveIdempotent(w, req) {
+		return
+	}
+	req.graphQL = parseGraphQL(req.method, req.header, req.body)
+	req.soapAction = soapAction(req.header, req.body)
+
+	// Add to pending requests unless the hold rules, sampling, scenario or
+	// decision script exempt it
+	held, status, ok := s.applyDecision(w, r, req, shouldHold, status)
+	if !ok {
+		return
+	}
+	if held {
+		stopTimeout := s.hold(req)
+		defer stopTimeout()
+		// A request released in an order has to have its body out before
+		// the next one starts
+		defer func() {
+			if flusher, ok := w.(http.Flusher); ok && req.sent != nil {
+				flusher.Flush()
+			}
+		}()
+	} else {
+		s.passThrough(req)
+		if req.delay > 0 && !sleepContext(r.Context(), req.delay) {
+			// The client gave up, so a retry with its Idempotency-Key is
+			// handled afresh
+			if s.idempotency != nil {
+				s.idempotency.forget(req)
+			}
+			return
+		}
+	}
+
+	if req.malformed != "" {
+		s.serveMalformed(w, r, req, held, status)
+		return
+	}
+
+	// A 204 ends the response as soon as its status line is sent, so a held
+	// preflight has to wait before writing anything
+	if preflight {
+		if held {
+			if !s.waitForRelease(r.Context(), req) {
+				return
+			}
+			if req.dropped {
+				s.abortResponse(w, req)
+				return
+			}
+			s.logReleased(req, "Preflight answered")
+		}
+		req.status = http.StatusNoContent
+		s.recordResponse(req, req.status, w.Header(), nil)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Send response headers immediately
+	w.Header().Set("Content-Type", s.contentType)
+	if rt != nil {
+		if rt.ContentType != "" {
+			w.Header().Set("Content-Type", rt.ContentType)
+		}
+		for name, value := range rt.Headers {
+			w.Header().Set(name, value)
+		}
+	}
+	if fixtureType != "" {
+		w.Header().Set("Content-Type", fixtureType)
+	}
+	if redirect {
+		w.Header().Set("Location", location)
+	}
+	s.setCookies(w.Header(), req)
+	encoding, encodingHeader := s.responseEncoding(r)
+	if encodingHeader != "" {
+		w.Header().Set("Content-Encoding", encodingHeader)
+	}
+	if s.compression == "auto" {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	trailers := s.responseTrailers(req)
+	announceTrailers(w.Header(), trailers)
+
+	// With HOLD_HEADERS nothing is sent before the release, and a route with
+	// a hold deadline may still have to answer with an error, so in both
+	// cases the status line waits
+	deferHeaders := held && (s.holdHeaders || rt != nil && rt.deadline > 0)
+	if !deferHeaders {
+		w.WriteHeader(status)
+		req.status = status
+	}
+
+	if held {
+		// Flush headers if possible
+		if flusher, ok := w.(http.Flusher); ok && !deferHeaders {
+			flusher.Flush()
+		}
+
+		// Wait for the signal to send response
+		if !s.waitForRelease(r.Context(), req) {
+			return
+		}
+
+		if req.dropped {
+			// Abort the response so the client sees the connection close mid-body
+			s.abortResponse(w, req)
+			return
+		}
+
+		if deferHeaders && req.releaseStatus != 0 {
+			s.logReleased(req, fmt.Sprintf("Answered with %d", req.releaseStatus))
+			for _, name := range []string{"Content-Encoding", "Trailer", "Location"} {
+				w.Header().Del(name)
+			}
+			req.status = req.releaseStatus
+			s.answerStatus(w, req)
+			return
+		}
+
+		s.logReleased(req, "Response body sent")
+	}
+	if deferHeaders {
+		w.WriteHeader(status)
+		req.status = status
+	}
+
+	var rendered bytes.Buffer
+	s.writeBody(&rendered, r, req, time.Now())
+	body := rendered.Bytes()
+	s.recordResponse(req, status, w.Header(), body)
+	if compressed, err := compressBody(body, encoding); err != nil {
+		s.warnf("Request #%d: Failed to compress body: %v", req.id, err)
+	} else {
+		body = compressed
+	}
+	s.setTrailers(w.Header(), req, trailers, body)
+
+	if held && s.chunkSize > 0 {
+		s.stepChunks(w, r, req, body)
+		return
+	}
+
+	dripRate := s.dripRate
+	if req.dripRate > 0 {
+		dripRate = req.dripRate
+	}
+	if dripRate <= 0 && (s.partialBytes <= 0 || !held) {
+		w.Write(body)
+		return
+	}
+
+	if held && s.partialBytes > 0 && len(body) > s.partialBytes {
+		// Send the start of the body, then hang until released again
+		w.Write(body[:s.partialBytes])
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		body = body[s.partialBytes:]
+
+		s.holdAgain(req, fmt.Sprintf("Sent %d byte(s) of the body", s.partialBytes))
+		if !s.waitForRelease(r.Context(), req) {
+			return
+		}
+		if req.dropped {
+			s.abortResponse(w, req)
+			return
+		}
+		s.logReleased(req, "Rest of body sent")
+	}
+
+	if dripRate <= 0 {
+		w.Write(body)
+		return
+	}
+	if err := drip(w, body, dripRate); err != nil {
+		s.printf("Request #%d: Client went away during slow body: %v\n", req.id, err)
+	}
+}
+
+// requestPort returns the local port r arrived on.
+func requestPort(r *http.Request) string {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// requestScheme returns "https" for requests received over TLS and "http"
+// otherwise.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// responseStatus returns the status code for r: the X-Debug-Status header or
+// status query parameter if present and control headers are enabled,
+// otherwise the matched route's status, otherwise the server default.
+func (s *Server) responseStatus(r *http.Request, rt *route) (int, error) {
+	var value string
+	if s.controlHeaders {
+		value = r.Header.Get("X-Debug-Status")
+		if value == "" {
+			value = r.URL.Query().Get("status")
+		}
+	}
+	if value == "" {
+		if rt != nil && rt.Status != 0 {
+			return rt.Status, nil
+		}
+		s.configMu.RLock()
+		defer s.configMu.RUnlock()
+		return s.status, nil
+	}
+	return parseStatus(value)
+}
+
+// applyControlHeaders records the X-Debug-Delay and X-Debug-Body headers and
+// the size query parameter of r on req, unless control headers are disabled.
+func (s *Server) applyControlHeaders(r *http.Request, req *pendingRequest) error {
+	if !s.controlHeaders {
+		return nil
+	}
+	if value := r.Header.Get("X-Debug-Delay"); value != "" {
+		delay, err := parseDelay(value)
+		if err != nil {
+			return fmt.Errorf("invalid X-Debug-Delay %q", value)
+		}
+		req.delay = delay
+	}
+	if values := r.Header.Values("X-Debug-Body"); len(values) > 0 {
+		req.bodyOverride = []byte(values[0])
+	}
+	if value := r.URL.Query().Get("size"); value != "" {
+		size, err := parseByteSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid size %q", value)
+		}
+		req.generatedSize = size
+	}
+	if value := r.Header.Get("X-Debug-Malformed"); value != "" {
+		mode, err := parseMalformed(value)
+		if err != nil {
+			return err
+		}
+		req.malformed = mode
+	}
+	return nil
+}
+
+// parseDelay parses a duration, treating plain numbers as seconds.
+func parseDelay(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+// sleepContext waits for d, returning false early if ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// parseStatus parses an HTTP status code, rejecting values outside 100-599.
+func parseStatus(value string) (int, error) {
+	status, err := strconv.Atoi(value)
+	if err != nil || status < 100 || status > 599 {
+		return 0, fmt.Errorf("invalid status code %q", value)
+	}
+	return status, nil
+}
+
+func (s *Server) waitForEnter() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		// Command output is written in one piece, like log lines
+		var out consoleBuffer
+		s.execute(&out, scanner.Text())
+		s.writeConsole(out.String())
+	}
+	s.printf("Standard input closed; use ctl, the admin API, signals or HOLD_TIMEOUT to release requests\n")
+}
+
+// durationEnv reads a duration from the named environment variable. Plain
+// numbers are interpreted as seconds; anything else must be a Go duration
+// string such as "1m30s". An unset variable yields zero.
+func durationEnv(name string) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0, nil
+	}
+	return parseDelay(value)
+}
+
+// Main runs the command-line server, configured from flags, the environment
+// and the -config file as described in the command's documentation. It
+// returns only when the server stops.
+func Main() {
+	if len(os.Args) > 1 && (os.Args[1] == "ctl" || os.Args[1] == "client") {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+
+	verbose := flag.Bool("v", false, "print all request headers on arrival (same as VERBOSE=1)")
+	var listenFlags listenAddrs
+	flag.Var(&listenFlags, "listen", "address to listen on: a port, host:port or unix:/path/to.sock; repeatable (same as LISTEN=a,b)")
+	configFile := flag.String("config", "", "JSON file of option values, used where neither a flag nor the environment sets them")
+	registerOptions(flag.CommandLine)
+	flag.Usage = usage
+	flag.Parse()
+	fixedOptions, err := applyOptions(flag.CommandLine, *configFile)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	server := NewServer()
+	server.verboseBody = os.Getenv("VERBOSE_BODY") != ""
+	server.verbose = *verbose || os.Getenv("VERBOSE") != "" || server.verboseBody
+	server.maskSecrets = os.Getenv("MASK_SECRETS") != ""
+	// Set up before any goroutine that can publish events or run commands
+	if os.Getenv("SSE") != "" {
+		server.sse = newSSEHub()
+	}
+
+	logFormat := os.Getenv("LOG_FORMAT")
+	switch output := os.Getenv("OUTPUT"); output {
+	case "":
+	case "text":
+		logFormat = "text"
+	case "ndjson", "json":
+		logFormat = "json"
+		server.stdoutReserved = true
+	default:
+		log.Fatalf("Invalid OUTPUT %q (want text or ndjson)", output)
+	}
+	logger, err := newLogger(logFormat, os.Getenv("QUIET") != "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.logger = logger
+	if server.color, err = parseColor(os.Getenv("COLOR")); err != nil {
+		log.Fatal(err)
+	}
+
+	stopStatusLine := func() {}
+	useTUI := os.Getenv("TUI") != "" && logger == nil
+	if useTUI {
+		stopStatusLine, err = server.startTUI()
+		if err != nil {
+			log.Fatalf("Failed to start the TUI: %v", err)
+		}
+	} else if os.Getenv("STATUS_LINE") != "" && logger == nil {
+		stopStatusLine, err = server.startStatusLine()
+		if err != nil {
+			log.Fatalf("Failed to start the status line: %v", err)
+		}
+	}
+
+	if err := server.loadSettings(); err != nil {
+		log.Fatal(err)
+	}
+
+	server.clientHeader = os.Getenv("CLIENT_HEADER")
+	server.sessionCookie = os.Getenv("SESSION_COOKIE")
+	server.setCookie = parseSetCookies(os.Getenv("SET_COOKIE"))
+
+	server.notifier, err = parseNotifier(os.Getenv("NOTIFY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	endpoint, tracesURL := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint != "" || tracesURL != "" {
+		server.tracer = newTracer(endpoint, tracesURL)
+		go server.runTracer()
+	}
+
+	if target := os.Getenv("WEBHOOK_URL"); target != "" {
+		server.webhook, err = newWebhook(target)
+		if err != nil {
+			log.Fatalf("Invalid WEBHOOK_URL: %v", err)
+		}
+		go server.webhook.run(server)
+	}
+
+	if value := os.Getenv("RELEASE_ORDER"); value != "" {
+		server.releaseOrder, err = parseReleaseOrder(value)
+		if err != nil {
+			log.Fatalf("Invalid RELEASE_ORDER: %v", err)
+		}
+	}
+
+	switch value := os.Getenv("CONTROL_HEADERS"); value {
+	case "", "1", "true", "on":
+	case "0", "false", "off":
+		server.controlHeaders = false
+	default:
+		log.Fatalf("Invalid CONTROL_HEADERS %q (expected 1 or 0)", value)
+	}
+
+	server.script = strings.Fields(os.Getenv("DECIDE_SCRIPT"))
+	if spec := os.Getenv("CHAOS"); spec != "" {
+		if server.chaos, err = parseChaos(spec); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if file := os.Getenv("SCENARIO_FILE"); file != "" {
+		server.scenario, err = loadScenario(file)
+		if err != nil {
+			log.Fatalf("Invalid scenario file: %v", err)
+		}
+	}
+
+	server.echo = os.Getenv("ECHO") != ""
+	if server.echo {
+		server.contentType = "application/json"
+	}
+
+	if contentType := os.Getenv("CONTENT_TYPE"); contentType != "" {
+		server.contentType = contentType
+	}
+
+	switch hold := os.Getenv("WEBSOCKET_HOLD"); hold {
+	case "":
+	case "message", "handshake":
+		server.webSocketHold = hold
+	default:
+		log.Fatalf("Invalid WEBSOCKET_HOLD %q (want message or handshake)", hold)
+	}
+
+	if value := os.Getenv("MAX_PENDING"); value != "" {
+		maxPending, err := strconv.Atoi(value)
+		if err != nil || maxPending < 0 {
+			log.Fatalf("Invalid MAX_PENDING %q", value)
+		}
+		server.maxPending = maxPending
+	}
+
+	if value := os.Getenv("HOLD_PERCENT"); value != "" {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			log.Fatalf("Invalid HOLD_PERCENT %q (want 0-100)", value)
+		}
+		server.holdPercent = percent
+	}
+
+	for _, policy := range []struct {
+		env   string
+		value *int64
+	}{{"HOLD_FIRST", &server.holdFirst}, {"HOLD_EVERY", &server.holdEvery}} {
+		if value := os.Getenv(policy.env); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				log.Fatalf("Invalid %s %q", policy.env, value)
+			}
+			*policy.value = n
+		}
+	}
+
+	bypassPaths, ok := os.LookupEnv("BYPASS_PATHS")
+	if !ok {
+		bypassPaths = defaultBypassPaths
+	}
+	server.bypassPaths = parseBypassPaths(bypassPaths)
+
+	server.holdHeaders = os.Getenv("HOLD_HEADERS") != ""
+
+	if value := os.Getenv("PARTIAL_BYTES"); value != "" {
+		partial, err := parseByteSize(value)
+		if err != nil || partial <= 0 {
+			log.Fatalf("Invalid PARTIAL_BYTES %q", value)
+		}
+		server.partialBytes = int(partial)
+	}
+
+	if server.builtinMiddleware, err = parseMiddlewareSpecs(strings.Split(os.Getenv("MIDDLEWARE"), ",")); err != nil {
+		log.Fatalf("Invalid MIDDLEWARE: %v", err)
+	}
+
+	if value := os.Getenv("CORS_ORIGINS"); value != "" {
+		cors := &corsPolicy{
+			methods:     os.Getenv("CORS_METHODS"),
+			headers:     os.Getenv("CORS_HEADERS"),
+			expose:      os.Getenv("CORS_EXPOSE_HEADERS"),
+			maxAge:      os.Getenv("CORS_MAX_AGE"),
+			credentials: os.Getenv("CORS_CREDENTIALS") != "",
+		}
+		for _, origin := range strings.Split(value, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				cors.origins = append(cors.origins, origin)
+			}
+		}
+		switch preflight := os.Getenv("CORS_PREFLIGHT"); preflight {
+		case "", "immediate":
+		case "hold":
+			cors.holdPreflight = true
+		default:
+			log.Fatalf("Invalid CORS_PREFLIGHT %q (want immediate or hold)", preflight)
+		}
+		server.cors = cors
+	}
+
+	if value := os.Getenv("AUTH"); value != "" {
+		auth, err := parseAuth(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		switch failure := os.Getenv("AUTH_FAILURE"); failure {
+		case "", "immediate":
+		case "hold":
+			auth.hold = true
+		default:
+			log.Fatalf("Invalid AUTH_FAILURE %q (want immediate or hold)", failure)
+		}
+		auth.expireFirst = os.Getenv("AUTH_EXPIRE_FIRST") != ""
+		server.auth = auth
+	}
+
+	if server.expectContinue, err = parseExpectContinue(os.Getenv("EXPECT_CONTINUE")); err != nil {
+		log.Fatal(err)
+	}
+
+	if server.holdBodyAfter, err = parseBodyHold(os.Getenv("HOLD_BODY_READ")); err != nil {
+		log.Fatal(err)
+	}
+
+	if server.uploadProgress, err = durationEnv("UPLOAD_PROGRESS"); err != nil {
+		log.Fatalf("Invalid UPLOAD_PROGRESS: %v", err)
+	}
+	server.uploadDir = os.Getenv("UPLOAD_DIR")
+	server.multipartDir = os.Getenv("MULTIPART_DIR")
+	if dir := os.Getenv("FIXTURES_DIR"); dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			log.Fatalf("FIXTURES_DIR %q is not a directory", dir)
+		}
+		server.fixturesDir = dir
+	}
+	if file := os.Getenv("PROTO_DESCRIPTORS"); file != "" {
+		if server.protoSchema, err = loadProtoSchema(file); err != nil {
+			log.Fatalf("Failed to load PROTO_DESCRIPTORS: %v", err)
+		}
+	}
+
+	server.connectionClose = os.Getenv("CONNECTION_CLOSE") != ""
+	if value := os.Getenv("MAX_CONN_REQUESTS"); value != "" {
+		max, err := strconv.Atoi(value)
+		if err != nil || max < 1 {
+			log.Fatalf("Invalid MAX_CONN_REQUESTS %q", value)
+		}
+		server.maxConnRequests = max
+	}
+
+	if value := os.Getenv("RATE_LIMIT"); value != "" {
+		limiter, err := parseRateLimit(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if limiter.retryAfter, err = durationEnv("RETRY_AFTER"); err != nil {
+			log.Fatal(err)
+		}
+		server.rateLimiter = limiter
+	}
+
+	if value := os.Getenv("REDIRECT_DEPTH"); value != "" {
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 0 {
+			log.Fatalf("Invalid REDIRECT_DEPTH %q", value)
+		}
+		server.redirectDepth = depth
+	}
+	if server.redirectStatus, err = parseRedirectStatus(os.Getenv("REDIRECT_STATUS")); err != nil {
+		log.Fatal(err)
+	}
+
+	if value := os.Getenv("MALFORMED"); value != "" {
+		mode, err := parseMalformed(value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.malformed = mode
+	}
+
+	compression, err := parseCompression(os.Getenv("COMPRESSION"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.compression = compression
+	server.contentEncoding = os.Getenv("CONTENT_ENCODING")
+
+	if value := os.Getenv("TRAILERS"); value != "" {
+		trailers, err := parseTrailers(value)
+		if err != nil {
+			log.Fatalf("Invalid TRAILERS: %v", err)
+		}
+		server.trailers = trailers
+	}
+
+	if value := os.Getenv("CHUNK_SIZE"); value != "" {
+		chunk, err := parseByteSize(value)
+		if err != nil || chunk <= 0 {
+			log.Fatalf("Invalid CHUNK_SIZE %q", value)
+		}
+		server.chunkSize = int(chunk)
+	}
+
+	if value := os.Getenv("BODY_SIZE"); value != "" {
+		size, err := parseByteSize(value)
+		if err != nil {
+			log.Fatalf("Invalid BODY_SIZE %q", value)
+		}
+		server.bodySize = size
+	}
+	switch pattern := os.Getenv("BODY_PATTERN"); pattern {
+	case "", "repeat":
+	case "random":
+		server.randomBody = true
+	default:
+		log.Fatalf("Invalid BODY_PATTERN %q (want repeat or random)", pattern)
+	}
+
+	if value := os.Getenv("DRIP_RATE"); value != "" {
+		rate, err := parseByteSize(value)
+		if err != nil || rate <= 0 {
+			log.Fatalf("Invalid DRIP_RATE %q", value)
+		}
+		server.dripRate = rate
+	}
+
+	historySize := defaultHistorySize
+	if value := os.Getenv("HISTORY_SIZE"); value != "" {
+		historySize, err = strconv.Atoi(value)
+		if err != nil || historySize < 0 {
+			log.Fatalf("Invalid HISTORY_SIZE %q", value)
+		}
+	}
+	if historySize > 0 {
+		server.history = newRequestHistory(historySize)
+	}
+	if path := os.Getenv("HISTORY_FILE"); path != "" {
+		if server.history == nil {
+			log.Fatal("HISTORY_FILE needs history enabled (HISTORY_SIZE is 0)")
+		}
+		file, entries, err := openHistoryFile(path, server.warnf)
+		if err != nil {
+			log.Fatalf("Failed to open HISTORY_FILE: %v", err)
+		}
+		server.history.load(entries)
+		server.history.file = file
+		// Keep numbering where the previous run left off
+		for _, entry := range entries {
+			if entry.ID > server.requestCounter {
+				server.requestCounter = entry.ID
+			}
+		}
+		if len(entries) > 0 {
+			server.printf("Loaded %d request(s) from %s\n", len(entries), path)
+		}
+	}
+	if value := os.Getenv("DUPLICATE_WINDOW"); value != "" {
+		window, err := parseDelay(value)
+		if err != nil || window < 0 {
+			log.Fatalf("Invalid DUPLICATE_WINDOW %q", value)
+		}
+		if window > 0 {
+			server.duplicates = newDuplicateDetector(window)
+		}
+	}
+	if server.idempotency, err = parseIdempotency(os.Getenv("IDEMPOTENCY")); err != nil {
+		log.Fatal(err)
+	}
+	if path := os.Getenv("ACCESS_LOG"); path != "" {
+		var maxSize int64
+		if value := os.Getenv("ACCESS_LOG_MAX_SIZE"); value != "" {
+			if maxSize, err = parseByteSize(value); err != nil || maxSize <= 0 {
+				log.Fatalf("Invalid ACCESS_LOG_MAX_SIZE %q", value)
+			}
+		}
+		maxAge, err := durationEnv("ACCESS_LOG_ROTATE")
+		if err != nil {
+			log.Fatalf("Invalid ACCESS_LOG_ROTATE: %v", err)
+		}
+		server.accessLog, err = openAccessLog(path, os.Getenv("ACCESS_LOG_FORMAT"), maxSize, maxAge, server.warnf)
+		if err != nil {
+			log.Fatalf("Failed to open ACCESS_LOG: %v", err)
+		}
+	}
+	server.replayUpstream = os.Getenv("REPLAY_UPSTREAM")
+	if server.replayUpstream == "" {
+		server.replayUpstream = os.Getenv("UPSTREAM")
+	}
+
+	if upstream := os.Getenv("UPSTREAM"); upstream != "" {
+		proxy, err := newUpstreamProxy(upstream, server.warnf)
+		if err != nil {
+			log.Fatalf("Invalid UPSTREAM: %v", err)
+		}
+		server.proxy = proxy
+
+		switch hold := os.Getenv("PROXY_HOLD"); hold {
+		case "":
+		case "request", "response":
+			server.proxyHold = hold
+		default:
+			log.Fatalf("Invalid PROXY_HOLD %q (want request or response)", hold)
+		}
+		server.printf("Proxying requests to %s (holding the %s)\n", upstream, server.proxyHold)
+	}
+
+	if dir := os.Getenv("VCR_DIR"); dir != "" {
+		server.vcr = &vcr{dir: dir}
+		switch mode := os.Getenv("VCR_MODE"); mode {
+		case "", "record":
+			if server.proxy == nil {
+				log.Fatal("VCR_MODE=record needs UPSTREAM to record from")
+			}
+			modify := server.proxy.ModifyResponse
+			server.proxy.ModifyResponse = func(resp *http.Response) error {
+				server.recordUpstream(resp)
+				return modify(resp)
+			}
+			server.printf("Recording upstream responses to %s\n", dir)
+		case "replay":
+			server.vcr.replay = true
+			server.printf("Replaying recorded responses from %s\n", dir)
+		default:
+			log.Fatalf("Invalid VCR_MODE %q (want record or replay)", mode)
+		}
+	}
+
+	// Start the goroutine that waits for enter key
+	noStdin := os.Getenv("NO_STDIN") != ""
+	if !noStdin && !useTUI {
+		go server.waitForEnter()
+	}
+	go server.handleControlSignals()
+	stopCommands := func() {}
+	if path := controlSocketPath(port); path != "" {
+		stopCommands, err = server.serveCommands(path)
+		if err != nil {
+			log.Fatalf("Failed to start the command socket: %v", err)
+		}
+		server.printf("Accepting commands on %s (%s ctl <command>)\n", path, os.Args[0])
+	}
+	if file := os.Getenv("RELEASE_TRIGGER"); file != "" {
+		go server.watchTrigger(file)
+	}
+
+	// A private mux keeps handlers registered on http.DefaultServeMux by
+	// imported packages (such as net/http/pprof) off the main listener
+	mux := http.NewServeMux()
+	mux.Handle("/", server.Handler())
+	if server.sse != nil {
+		mux.HandleFunc("/sse", server.handleSSE)
+	}
+
+	limits, err := parseServerLimits()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if adminPort := os.Getenv("ADMIN_PORT"); adminPort != "" {
+		adminAddr := fmt.Sprintf(":%s", adminPort)
+		server.printf("Starting admin API on http://localhost%s\n", adminAddr)
+		adminServer := &http.Server{Addr: adminAddr, Handler: server.adminHandler()}
+		limits.apply(adminServer)
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil {
+				log.Fatalf("Failed to start admin server: %v", err)
+			}
+		}()
+	}
+
+	if *configFile != "" {
+		go server.watchConfig(*configFile, fixedOptions)
+	}
+
+	if tcpPort := os.Getenv("TCP_PORT"); tcpPort != "" {
+		if value := os.Getenv("TCP_REPLY"); value != "" {
+			server.tcpReply, err = parseTCPReply(value)
+			if err != nil {
+				log.Fatalf("Invalid TCP_REPLY %q: %v", value, err)
+			}
+		}
+		listener, err := net.Listen("tcp", ":"+tcpPort)
+		if err != nil {
+			log.Fatalf("Failed to start TCP listener: %v", err)
+		}
+		server.printf("Holding raw TCP replies on localhost:%s\n", tcpPort)
+		go func() {
+			if err := server.serveTCP(listener); err != nil {
+				log.Fatalf("TCP listener failed: %v", err)
+			}
+		}()
+	}
+
+	shutdownConfig, err := parseShutdownConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		log.Fatalf("Failed to set up TLS: %v", err)
+	}
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+
+	// -listen or LISTEN take precedence over PORTS, which takes precedence
+	// over PORT
+	addrs := []string(listenFlags)
+	if len(addrs) == 0 {
+		value := os.Getenv("LISTEN")
+		if value == "" {
+			value = os.Getenv("PORTS")
+		}
+		if value == "" {
+			value = port
+		}
+		addrs = strings.Split(value, ",")
+	}
+	var listeners []net.Listener
+	var shown []string
+	for _, addr := range addrs {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		addr = listenAddress(addr)
+		listener, err := listen(addr)
+		if err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+		listeners = append(listeners, listener)
+		if host, p, err := net.SplitHostPort(addr); err == nil && !strings.HasPrefix(addr, "unix:") {
+			if host == "" {
+				host = "localhost"
+			}
+			server.ports = append(server.ports, p)
+			shown = append(shown, fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, p)))
+		} else {
+			shown = append(shown, addr)
+		}
+	}
+	if len(listeners) == 0 {
+		log.Fatalf("No listen address given")
+	}
+
+	addr := strings.Join(addrs, ",")
+	server.printf("Starting server on %s\n", strings.Join(shown, ", "))
+	server.printf("The server can hold multiple requests.\n")
+	if useTUI {
+		server.printf("Keys: %s\n", tuiKeys)
+	} else if noStdin {
+		server.printf("Standard input is ignored (NO_STDIN); use ctl, the admin API or signals to release requests.\n")
+	} else {
+		server.printf("Press ENTER to release ALL pending requests at once.\n")
+		server.printf("Type \"help\" for commands to list, release or drop individual requests.\n")
+	}
+	if server.scenario != nil {
+		server.printf("Playing a %d-step scenario from %s.\n", len(server.scenario.steps), os.Getenv("SCENARIO_FILE"))
+	}
+	if server.chaos != nil {
+		server.printf("Chaos mode: %s.\n", server.chaos)
+	}
+	if server.latencyProfile != nil {
+		server.printf("Requests are auto-released using the %s latency profile.\n", server.latencyProfile.spec)
+	}
+	if server.holdTimeout > 0 {
+		server.printf("Requests are auto-released after %s.\n", server.holdTimeout)
+	}
+	if server.holdFirst > 0 {
+		server.printf("Holding only the first %d request(s); later ones are answered immediately.\n", server.holdFirst)
+	}
+	if server.holdEvery > 0 {
+		server.printf("Holding every %s request; the others are answered immediately.\n", ordinal(server.holdEvery))
+	}
+	if server.holdPercent < 100 {
+		server.printf("Holding a random %g%% of requests; the rest are answered immediately.\n", server.holdPercent)
+	}
+	server.printf("\n")
+	if server.logger != nil {
+		server.logger.Info("server started", "addr", addr, "scheme", scheme)
+	}
+
+	httpServer := &http.Server{Handler: mux, TLSConfig: tlsConfig, ConnContext: connContext}
+	limits.apply(httpServer)
+	if os.Getenv("KEEP_ALIVE") == "0" {
+		httpServer.SetKeepAlivesEnabled(false)
+	}
+	serve := func() error {
+		errCh := make(chan error, len(listeners))
+		for _, listener := range listeners {
+			listener := listener
+			go func() {
+				if tlsConfig != nil {
+					// The certificate is already in TLSConfig
+					errCh <- httpServer.ServeTLS(listener, "", "")
+					return
+				}
+				errCh <- httpServer.Serve(listener)
+			}()
+		}
+		return <-errCh
+	}
+	err = server.serveUntilSignal(httpServer, serve, shutdownConfig)
+	stopCommands()
+	if server.accessLog != nil {
+		server.accessLog.close()
+	}
+	if server.tracer != nil {
+		server.flushSpans()
+	}
+	stopStatusLine()
+	if err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+	if os.Getenv("STATS_ON_EXIT") != "0" {
+		server.reportStats()
+	}
+}
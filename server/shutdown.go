@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownConfig controls what happens to held requests on SIGINT/SIGTERM.
+type shutdownConfig struct {
+	// mode is "release" (answer every held request) or "drop" (close their
+	// connections without a response).
+	mode string
+
+	// status, when non-zero, is sent instead of the normal response to
+	// released requests whose status line has not been written yet, such as
+	// proxied requests held before forwarding.
+	status int
+
+	// timeout bounds how long to wait for in-flight responses to finish.
+	timeout time.Duration
+}
+
+// serveUntilSignal runs serve until it fails or the process receives SIGINT
+// or SIGTERM, in which case held requests are released or dropped according
+// to cfg and httpServer is shut down gracefully. A second signal during the
+// shutdown terminates the process immediately.
+func (s *Server) serveUntilSignal(httpServer *http.Server, serve func() error, cfg shutdownConfig) error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- serve() }()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-errCh:
+		return err
+	case sig := <-signals:
+		signal.Stop(signals)
+		s.printf("\nReceived %s, shutting down (press Ctrl-C again to force)...\n", sig)
+	}
+
+	switch cfg.mode {
+	case "drop":
+		s.dropMatching(matchAll, false)
+	default:
+		s.releaseMatching(matchAll, releaseOptions{cause: "shutdown", status: cfg.status})
+	}
+
+	if s.sse != nil {
+		s.sse.close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		s.warnf("Graceful shutdown did not finish within %s: %v", cfg.timeout, err)
+		httpServer.Close()
+	}
+	s.printf("Server stopped\n")
+	return nil
+}
+
+// parseShutdownConfig reads SHUTDOWN_MODE, SHUTDOWN_STATUS and
+// SHUTDOWN_TIMEOUT from the environment.
+func parseShutdownConfig() (shutdownConfig, error) {
+	cfg := shutdownConfig{mode: "release", timeout: 10 * time.Second}
+
+	switch mode := os.Getenv("SHUTDOWN_MODE"); mode {
+	case "":
+	case "release", "drop":
+		cfg.mode = mode
+	default:
+		return cfg, fmt.Errorf("invalid SHUTDOWN_MODE %q (want release or drop)", mode)
+	}
+
+	if value := os.Getenv("SHUTDOWN_STATUS"); value != "" {
+		status, err := parseStatus(value)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SHUTDOWN_STATUS: %v", err)
+		}
+		cfg.status = status
+	}
+
+	timeout, err := durationEnv("SHUTDOWN_TIMEOUT")
+	if err != nil {
+		return cfg, fmt.Errorf("invalid SHUTDOWN_TIMEOUT: %v", err)
+	}
+	if timeout > 0 {
+		cfg.timeout = timeout
+	}
+	return cfg, nil
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package server
+
+// handleControlSignals is a no-op on platforms without SIGUSR1/SIGUSR2.
+func (s *Server) handleControlSignals() {}
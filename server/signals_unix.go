@@ -0,0 +1,29 @@
+//go:build unix
+
+package server
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleControlSignals releases all pending requests on SIGUSR1 and prints
+// the pending list on SIGUSR2, so the server can be driven with kill(1).
+func (s *Server) handleControlSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGUSR1:
+			s.printf("\nReceived SIGUSR1\n")
+			if s.releaseAll() == 0 {
+				s.printf("No pending requests\n")
+			}
+		case syscall.SIGUSR2:
+			var out consoleBuffer
+			s.printPending(&out, matchAll)
+			s.writeConsole(out.String())
+		}
+	}
+}
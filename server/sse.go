@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sseHub fans manually triggered events out to every connected Server-Sent
+// Events stream.
+type sseHub struct {
+	mu      sync.Mutex
+	streams map[chan string]struct{}
+	events  int
+
+	// done is closed on shutdown to end all streams.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSSEHub() *sseHub {
+	return &sseHub{
+		streams: make(map[chan string]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// close ends every connected stream.
+func (h *sseHub) close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+// emit sends one event to all connected streams. An empty data string sends
+// the default JSON payload. It returns the event number and how many streams
+// received it.
+func (h *sseHub) emit(data string) (int, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.events++
+	if data == "" {
+		payload, _ := json.Marshal(map[string]interface{}{
+			"event":     h.events,
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+		})
+		data = string(payload)
+	}
+
+	for stream := range h.streams {
+		select {
+		case stream <- data:
+		default:
+			// Slow client; drop the event rather than block the console
+		}
+	}
+	return h.events, len(h.streams)
+}
+
+func (h *sseHub) subscribe() (chan string, int) {
+	stream := make(chan string, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.streams[stream] = struct{}{}
+	return stream, len(h.streams)
+}
+
+func (h *sseHub) unsubscribe(stream chan string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.streams, stream)
+	return len(h.streams)
+}
+
+// handleSSE keeps an event stream open and writes each emitted event to it.
+func (s *Server) handleSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	stream, count := s.sse.subscribe()
+	s.printf("\n[%s] SSE stream opened from %s (%d connected)\n",
+		time.Now().Format("15:04:05"), r.RemoteAddr, count)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case data := <-stream:
+			for _, line := range strings.Split(data, "\n") {
+				fmt.Fprintf(w, "data: %s\n", line)
+			}
+			fmt.Fprint(w, "\n")
+			flusher.Flush()
+		case <-s.sse.done:
+			s.sse.unsubscribe(stream)
+			return
+		case <-r.Context().Done():
+			count := s.sse.unsubscribe(stream)
+			s.printf("[%s] SSE stream from %s closed (%d connected)\n",
+				time.Now().Format("15:04:05"), r.RemoteAddr, count)
+			return
+		}
+	}
+}
+
+// emitEvent sends an event to all SSE streams and reports it on the console.
+func (s *Server) emitEvent(out io.Writer, data string) {
+	event, streams := s.sse.emit(data)
+	fmt.Fprintf(out, "Sent event #%d to %d SSE stream(s)\n", event, streams)
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionStats tallies what happened to every request since the server
+// started, for the stats command and the report printed on shutdown. It keeps
+// running totals rather than the requests themselves, so that it stays small
+// however long the server runs.
+type sessionStats struct {
+	mu          sync.Mutex
+	requests    int
+	held        int
+	duplicates  int
+	outcomes    map[string]int
+	paths       map[string]int
+	peakPending int
+
+	// Hold times: the total, extremes and, for the percentile, the most
+	// recent statsSamples of them in a ring.
+	holdSum time.Duration
+	minHold time.Duration
+	maxHold time.Duration
+	samples []time.Duration
+	next    int
+}
+
+// statsEntry is what a request last contributed to the totals. A request
+// released in stages is counted once, with its final outcome and hold time;
+// the hold extremes may still include an earlier stage.
+type statsEntry struct {
+	outcome string
+	held    time.Duration
+	atOnce  bool
+	sample  int // index of the request's hold time in samples, or -1
+}
+
+// Limits on what sessionStats keeps: hold times sampled for the percentile,
+// and distinct paths counted before the rest are lumped together.
+const (
+	statsSamples  = 1024
+	statsMaxPaths = 1000
+	statsOther    = "(other paths)"
+)
+
+// statsSummary is the JSON form of sessionStats.
+type statsSummary struct {
+	Requests    int            `json:"requests"`
+	Held        int            `json:"held"`
+	Outcomes    map[string]int `json:"outcomes"`
+	MinHold     string         `json:"min_hold,omitempty"`
+	AvgHold     string         `json:"avg_hold,omitempty"`
+	P95Hold     string         `json:"p95_hold,omitempty"`
+	MaxHold     string         `json:"max_hold,omitempty"`
+	Paths       map[string]int `json:"paths"`
+	PeakPending int            `json:"peak_pending"`
+	Duplicates  int            `json:"duplicates"`
+}
+
+func newSessionStats() *sessionStats {
+	return &sessionStats{outcomes: make(map[string]int), paths: make(map[string]int)}
+}
+
+// record notes the outcome of req, replacing what an earlier stage of the
+// same request contributed.
+func (st *sessionStats) record(req *pendingRequest, outcome string) {
+	entry := &statsEntry{outcome: outcome, held: time.Since(req.requestTime), atOnce: answeredAtOnce(req), sample: -1}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if prev := req.stats; prev != nil {
+		st.outcomes[prev.outcome]--
+		if !prev.atOnce {
+			st.held--
+			st.holdSum -= prev.held
+		}
+		if prev.sample >= 0 && st.samples[prev.sample] == prev.held {
+			entry.sample = prev.sample
+		}
+	} else {
+		st.requests++
+		if req.duplicateOf != 0 {
+			st.duplicates++
+		}
+		path := req.path
+		if _, ok := st.paths[path]; !ok && len(st.paths) >= statsMaxPaths {
+			path = statsOther
+		}
+		st.paths[path]++
+	}
+	req.stats = entry
+
+	st.outcomes[outcome]++
+	if entry.atOnce {
+		return
+	}
+	st.held++
+	st.holdSum += entry.held
+	if st.held == 1 || entry.held < st.minHold {
+		st.minHold = entry.held
+	}
+	if entry.held > st.maxHold {
+		st.maxHold = entry.held
+	}
+	if entry.sample < 0 {
+		if len(st.samples) < statsSamples {
+			st.samples = append(st.samples, 0)
+			entry.sample = len(st.samples) - 1
+		} else {
+			entry.sample = st.next
+			st.next = (st.next + 1) % statsSamples
+		}
+	}
+	st.samples[entry.sample] = entry.held
+}
+
+// notePending keeps track of the largest number of requests pending at once.
+func (st *sessionStats) notePending(n int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if n > st.peakPending {
+		st.peakPending = n
+	}
+}
+
+// summary reports the totals and hold times. Requests answered without a
+// hold count towards the totals but not the hold times, and the p95 is taken
+// over the most recent statsSamples holds.
+func (st *sessionStats) summary() statsSummary {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sum := statsSummary{
+		Requests:    st.requests,
+		Held:        st.held,
+		Outcomes:    make(map[string]int, len(st.outcomes)),
+		Paths:       make(map[string]int, len(st.paths)),
+		PeakPending: st.peakPending,
+		Duplicates:  st.duplicates,
+	}
+	for outcome, n := range st.outcomes {
+		if n > 0 {
+			sum.Outcomes[outcome] = n
+		}
+	}
+	for path, n := range st.paths {
+		sum.Paths[path] = n
+	}
+	if st.held > 0 {
+		holds := append([]time.Duration(nil), st.samples...)
+		sort.Slice(holds, func(i, j int) bool { return holds[i] < holds[j] })
+		// Nearest-rank percentile
+		p95 := holds[(len(holds)*95+99)/100-1]
+		sum.MinHold = st.minHold.Round(time.Millisecond).String()
+		sum.AvgHold = (st.holdSum / time.Duration(st.held)).Round(time.Millisecond).String()
+		sum.P95Hold = p95.Round(time.Millisecond).String()
+		sum.MaxHold = st.maxHold.Round(time.Millisecond).String()
+	}
+	return sum
+}
+
+// answeredAtOnce reports whether req was answered (or dropped) without a
+// hold.
+func answeredAtOnce(req *pendingRequest) bool {
+	switch req.releaseCause {
+	case "passthrough", "idempotent", "decided":
+		return true
+	}
+	return false
+}
+
+// statsTopPaths is how many paths the stats report lists.
+const statsTopPaths = 15
+
+// printStats writes the session statistics to out.
+func (s *Server) printStats(out io.Writer) {
+	sum := s.stats.summary()
+	fmt.Fprintf(out, "Session statistics (up %s):\n", time.Since(s.startTime).Round(time.Second))
+	fmt.Fprintf(out, "  Requests:      %d finished (%d held, %d answered at once), %d still pending\n",
+		sum.Requests, sum.Held, sum.Requests-sum.Held, len(s.snapshot()))
+	if sum.Requests == 0 {
+		return
+	}
+
+	outcomes := make([]string, 0, len(sum.Outcomes))
+	for outcome, n := range sum.Outcomes {
+		if outcome != "passthrough" {
+			outcomes = append(outcomes, fmt.Sprintf("%d %s", n, outcome))
+		}
+	}
+	sort.Strings(outcomes)
+	if len(outcomes) > 0 {
+		fmt.Fprintf(out, "  Outcomes:      %s\n", strings.Join(outcomes, ", "))
+	}
+	if sum.Held > 0 {
+		fmt.Fprintf(out, "  Hold time:     min %s, avg %s, p95 %s, max %s\n", sum.MinHold, sum.AvgHold, sum.P95Hold, sum.MaxHold)
+	}
+	fmt.Fprintf(out, "  Peak pending:  %d\n", sum.PeakPending)
+	if sum.Duplicates > 0 {
+		fmt.Fprintf(out, "  Duplicates:    %d (possible client retries)\n", sum.Duplicates)
+	}
+
+	paths := make([]string, 0, len(sum.Paths))
+	for p := range sum.Paths {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if sum.Paths[paths[i]] != sum.Paths[paths[j]] {
+			return sum.Paths[paths[i]] > sum.Paths[paths[j]]
+		}
+		return paths[i] < paths[j]
+	})
+	fmt.Fprintln(out, "  Paths:")
+	for i, p := range paths {
+		if i == statsTopPaths {
+			fmt.Fprintf(out, "    ... %d more\n", len(paths)-i)
+			break
+		}
+		fmt.Fprintf(out, "    %5d  %s\n", sum.Paths[p], p)
+	}
+}
+
+// reportStats prints the session statistics on shutdown, or logs them as a
+// structured record when LOG_FORMAT is set.
+func (s *Server) reportStats() {
+	if s.logger != nil {
+		sum := s.stats.summary()
+		s.logger.Info("session stats",
+			slog.Int("requests", sum.Requests),
+			slog.Int("held", sum.Held),
+			slog.Any("outcomes", sum.Outcomes),
+			slog.String("min_hold", sum.MinHold),
+			slog.String("avg_hold", sum.AvgHold),
+			slog.String("p95_hold", sum.P95Hold),
+			slog.String("max_hold", sum.MaxHold),
+			slog.Any("paths", sum.Paths),
+			slog.Int("peak_pending", sum.PeakPending),
+			slog.Int("duplicates", sum.Duplicates))
+		return
+	}
+	var out consoleBuffer
+	s.printStats(&out)
+	s.writeConsole(out.String())
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"time"
+)
+
+// maxTCPChunk is the most data read from a raw TCP connection per hold.
+const maxTCPChunk = 64 << 10
+
+// serveTCP accepts raw TCP connections from listener and holds the reply to every
+// chunk of data a client sends until it is released.
+func (s *Server) serveTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleTCPConn(conn)
+	}
+}
+
+// handleTCPConn reads from conn one chunk at a time. Each chunk is queued like
+// an HTTP request with method "TCP" and the listener's address as its path;
+// on release the server writes the TCP_REPLY bytes, or echoes the chunk if no
+// reply is configured, and waits for the next chunk.
+func (s *Server) handleTCPConn(conn net.Conn) {
+	defer conn.Close()
+	port := localPort(conn)
+	path := "tcp:" + port
+	reader := bufio.NewReaderSize(conn, maxTCPChunk)
+
+	for {
+		// Wait for the client to send something
+		if _, err := reader.Peek(1); err != nil {
+			return
+		}
+		chunk := make([]byte, reader.Buffered())
+		reader.Read(chunk)
+
+		req := &pendingRequest{
+			requestTime:  time.Now(),
+			responseChan: make(chan struct{}),
+			remoteAddr:   conn.RemoteAddr().String(),
+			port:         port,
+			scheme:       "tcp",
+			path:         path,
+			method:       "TCP",
+			body:         chunk,
+			bodySize:     int64(len(chunk)),
+		}
+
+		stopTimeout := s.hold(req)
+		s.printf("Request #%d: Received %d byte(s): %s\n", req.id, len(chunk), quotePreview(chunk))
+
+		ctx, stopWatching := watchConnClosed(conn, reader)
+		released := s.waitForRelease(ctx, req)
+		stopWatching()
+		stopTimeout()
+		if !released {
+			return
+		}
+
+		if req.dropped {
+			s.logDropped(req)
+			if req.reset {
+				resetConn(conn)
+			}
+			return
+		}
+
+		reply := s.tcpReply
+		if reply == nil {
+			reply = chunk
+		}
+		if req.bodyOverride != nil {
+			reply = req.bodyOverride
+		}
+		s.logReleased(req, "Reply sent")
+		s.recordResponse(req, 0, nil, reply)
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+// localPort returns the port conn was accepted on.
+func localPort(conn net.Conn) string {
+	_, port, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return conn.LocalAddr().String()
+	}
+	return port
+}
+
+// quotePreview quotes up to the first 200 bytes of data for the console.
+func quotePreview(data []byte) string {
+	if len(data) > 200 {
+		return strconv.Quote(string(data[:200])) + "..."
+	}
+	return strconv.Quote(string(data))
+}
+
+// parseTCPReply interprets TCP_REPLY with Go string escapes, so that
+// "+OK\r\n" is sent as a Redis-style status line.
+func parseTCPReply(value string) ([]byte, error) {
+	reply, err := strconv.Unquote(`"` + value + `"`)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(reply), nil
+}
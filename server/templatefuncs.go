@@ -0,0 +1,92 @@
+package server
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"math/rand"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateFuncs are available in every response template:
+//
+//	{{uuid}}                  a random version 4 UUID
+//	{{randInt 1 100}}         a random integer from 1 to 100 inclusive
+//	{{randChoice "a" "b"}}    one of the arguments at random
+//	{{now}}                   the current time; {{now.Unix}}, {{now.Format "..."}}
+//
+// Fake data comes from the .Fake field, e.g. {{.Fake.Name}}.
+var templateFuncs = template.FuncMap{
+	"uuid":       newUUID,
+	"randInt":    randInt,
+	"randChoice": randChoice,
+	"now":        time.Now,
+}
+
+// newTemplate returns an empty template with templateFuncs.
+func newTemplate(name string) *template.Template {
+	return template.New(name).Funcs(templateFuncs)
+}
+
+func newUUID() string {
+	var b [16]byte
+	crand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func randInt(min, max int) (int, error) {
+	if max < min {
+		return 0, fmt.Errorf("randInt: %d is less than %d", max, min)
+	}
+	return min + rand.Intn(max-min+1), nil
+}
+
+func randChoice(choices ...string) (string, error) {
+	if len(choices) == 0 {
+		return "", fmt.Errorf("randChoice: no choices")
+	}
+	return choices[rand.Intn(len(choices))], nil
+}
+
+// fakeData generates realistic-looking values for templates. Each call
+// draws a new value.
+type fakeData struct{}
+
+var (
+	fakeFirstNames = []string{"Ada", "Alan", "Grace", "Linus", "Margaret", "Dennis", "Barbara", "Ken", "Frances", "Edsger", "Radia", "Donald", "Katherine", "Tim", "Hedy", "John"}
+	fakeLastNames  = []string{"Lovelace", "Turing", "Hopper", "Torvalds", "Hamilton", "Ritchie", "Liskov", "Thompson", "Allen", "Dijkstra", "Perlman", "Knuth", "Johnson", "Berners-Lee", "Lamarr", "McCarthy"}
+	fakeCompanies  = []string{"Acme Corp", "Globex", "Initech", "Umbrella", "Hooli", "Stark Industries", "Wayne Enterprises", "Soylent", "Vandelay Industries", "Cyberdyne"}
+	fakeCities     = []string{"Lisbon", "Oslo", "Nairobi", "Osaka", "Toronto", "Melbourne", "Bogotá", "Berlin", "Chennai", "Austin"}
+	fakeWords      = []string{"alpha", "delta", "orbit", "signal", "harbor", "lantern", "quartz", "meadow", "copper", "vector", "summit", "ember", "tidal", "falcon", "prism", "cedar"}
+)
+
+func pick(list []string) string {
+	return list[rand.Intn(len(list))]
+}
+
+func (fakeData) FirstName() string { return pick(fakeFirstNames) }
+func (fakeData) LastName() string  { return pick(fakeLastNames) }
+func (fakeData) Name() string      { return pick(fakeFirstNames) + " " + pick(fakeLastNames) }
+func (fakeData) Company() string   { return pick(fakeCompanies) }
+func (fakeData) City() string      { return pick(fakeCities) }
+func (fakeData) Word() string      { return pick(fakeWords) }
+
+func (fakeData) Email() string {
+	return strings.ToLower(pick(fakeFirstNames)+"."+strings.ReplaceAll(pick(fakeLastNames), "-", "")) + "@example.com"
+}
+
+func (fakeData) Phone() string {
+	return fmt.Sprintf("+1-555-%03d-%04d", rand.Intn(1000), rand.Intn(10000))
+}
+
+func (fakeData) Sentence() string {
+	words := make([]string, 4+rand.Intn(6))
+	for i := range words {
+		words[i] = pick(fakeWords)
+	}
+	sentence := strings.Join(words, " ")
+	return strings.ToUpper(sentence[:1]) + sentence[1:] + "."
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// statusLine keeps a one-line summary at the bottom of the terminal. All
+// other console output is routed through it so the line can be cleared
+// before, and redrawn after, each write.
+type statusLine struct {
+	mu   sync.Mutex
+	out  io.Writer
+	text string
+}
+
+// write prints p above the status line.
+func (l *statusLine) write(p []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprint(l.out, "\r\033[K")
+	l.out.Write(p)
+	if bytes.HasSuffix(p, []byte("\n")) {
+		fmt.Fprint(l.out, l.text)
+	}
+}
+
+// draw replaces the status line with text.
+func (l *statusLine) draw(text string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.text = text
+	fmt.Fprintf(l.out, "\r\033[K%s", text)
+}
+
+// startStatusLine redirects standard output through a status line that is
+// refreshed every second with the pending count, the age of the oldest held
+// request and how many requests have been answered. The returned function
+// flushes pending output and restores standard output.
+func (s *Server) startStatusLine() (stop func(), err error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout := os.Stdout
+	line := &statusLine{out: stdout}
+	os.Stdout = w
+
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				line.write(buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for range time.Tick(time.Second) {
+			pending := s.snapshot()
+			var oldest time.Duration
+			for _, req := range pending {
+				if age := time.Since(req.requestTime); age > oldest {
+					oldest = age
+				}
+			}
+			line.draw(fmt.Sprintf("[%s] pending %d | oldest %s | served %d",
+				time.Now().Format("15:04:05"), len(pending), oldest.Round(time.Second), s.served.Load()))
+		}
+	}()
+
+	return func() {
+		os.Stdout = stdout
+		w.Close()
+		<-copied
+		fmt.Fprint(stdout, "\r\033[K")
+	}, nil
+}
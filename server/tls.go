@@ -0,0 +1,119 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// loadTLSConfig returns the TLS configuration selected by the environment:
+// TLS_CERT and TLS_KEY name PEM files to serve, while TLS=1 on its own
+// generates a throwaway self-signed certificate. TLS_CLIENT_CA additionally
+// enables mutual TLS against the given CA bundle. It returns nil when TLS is
+// not enabled.
+func loadTLSConfig() (*tls.Config, error) {
+	config, err := loadServerCertificate()
+	if err != nil || os.Getenv("TLS_CLIENT_CA") == "" {
+		return config, err
+	}
+	if config == nil {
+		return nil, fmt.Errorf("TLS_CLIENT_CA requires TLS=1 or TLS_CERT/TLS_KEY")
+	}
+
+	pem, err := os.ReadFile(os.Getenv("TLS_CLIENT_CA"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", os.Getenv("TLS_CLIENT_CA"))
+	}
+	config.ClientCAs = pool
+
+	switch mode := os.Getenv("TLS_CLIENT_AUTH"); mode {
+	case "", "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("invalid TLS_CLIENT_AUTH %q (want require or optional)", mode)
+	}
+	return config, nil
+}
+
+// loadServerCertificate returns a TLS configuration holding the server
+// certificate, or nil when TLS is not enabled.
+func loadServerCertificate() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+
+	if os.Getenv("TLS") == "" {
+		return nil, nil
+	}
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// clientSubject returns the subject of the verified client certificate on r,
+// or an empty string if the client did not present one.
+func clientSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.String()
+}
+
+// selfSignedCertificate generates an in-memory certificate valid for
+// localhost and the loopback addresses.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "variable-debug-server"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span batches are sent when this many spans are waiting or this much time
+// has passed, whichever comes first.
+const (
+	traceBatchSize     = 100
+	traceFlushInterval = 2 * time.Second
+)
+
+// tracer exports one span per held request to an OTLP/HTTP collector using
+// the JSON encoding, so hold times show up next to the client's own spans.
+type tracer struct {
+	url    string
+	client *http.Client
+
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+// OTLP JSON types; see opentelemetry-proto's trace.proto. IDs are hex and
+// 64-bit integers are strings, per the OTLP JSON mapping.
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	spanKindServer  = 2
+	spanStatusError = 2
+)
+
+func stringAttr(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttr(key string, value int) otlpAttribute {
+	text := strconv.Itoa(value)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &text}}
+}
+
+// newTracer returns a tracer for the collector at endpoint, the base URL
+// (e.g. http://localhost:4318) to which /v1/traces is appended. A tracesURL
+// is used as is.
+func newTracer(endpoint, tracesURL string) *tracer {
+	if tracesURL == "" {
+		tracesURL = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	return &tracer{url: tracesURL, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// traceContext is the distributed trace a request arrived with.
+type traceContext struct {
+	traceID  string
+	parentID string
+}
+
+// requestTraceContext reads the trace context from a W3C traceparent header,
+// a B3 single "b3" header or the X-B3-TraceId/X-B3-SpanId pair, in that order
+// of preference. 64-bit B3 trace IDs are left-padded to 128 bits.
+func requestTraceContext(h http.Header) (traceContext, bool) {
+	if tc, ok := parseTraceparent(h.Get("Traceparent")); ok {
+		return tc, true
+	}
+	if b3 := h.Get("B3"); b3 != "" {
+		parts := strings.Split(b3, "-")
+		if len(parts) >= 2 {
+			return parseB3(parts[0], parts[1])
+		}
+	}
+	if traceID := h.Get("X-B3-TraceId"); traceID != "" {
+		return parseB3(traceID, h.Get("X-B3-SpanId"))
+	}
+	return traceContext{}, false
+}
+
+func parseB3(traceID, spanID string) (traceContext, bool) {
+	traceID, spanID = strings.ToLower(traceID), strings.ToLower(spanID)
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	if len(traceID) != 32 || len(spanID) != 16 {
+		return traceContext{}, false
+	}
+	if _, err := hex.DecodeString(traceID + spanID); err != nil {
+		return traceContext{}, false
+	}
+	return traceContext{traceID: traceID, parentID: spanID}, true
+}
+
+// parseTraceparent parses a W3C traceparent header
+// ("00-<32 hex trace id>-<16 hex parent id>-<flags>").
+func parseTraceparent(value string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceContext{}, false
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return traceContext{}, false
+	}
+	if parts[1] == strings.Repeat("0", 32) {
+		return traceContext{}, false
+	}
+	return traceContext{traceID: strings.ToLower(parts[1]), parentID: strings.ToLower(parts[2])}, true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// traceHold records a span covering req's hold, ending now. Requests that
+// carried trace context become children of the caller's span.
+func (s *Server) traceHold(req *pendingRequest, outcome string) {
+	if s.tracer == nil {
+		return
+	}
+
+	tc, ok := requestTraceContext(req.header)
+	if !ok {
+		tc = traceContext{traceID: randomHex(16)}
+	}
+	span := otlpSpan{
+		TraceID:           tc.traceID,
+		SpanID:            randomHex(8),
+		ParentSpanID:      tc.parentID,
+		Name:              fmt.Sprintf("hold %s %s", req.method, req.path),
+		Kind:              spanKindServer,
+		StartTimeUnixNano: strconv.FormatInt(req.requestTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes: []otlpAttribute{
+			stringAttr("http.request.method", req.method),
+			stringAttr("url.path", req.path),
+			stringAttr("client.address", req.client),
+			intAttr("debug.request_id", req.id),
+			stringAttr("debug.outcome", outcome),
+		},
+	}
+	if req.releaseCause != "" && outcome == "released" {
+		span.Attributes = append(span.Attributes, stringAttr("debug.release_cause", req.releaseCause))
+	}
+	if outcome != "released" {
+		span.Status = otlpStatus{Code: spanStatusError, Message: "request " + outcome}
+	}
+
+	s.tracer.mu.Lock()
+	s.tracer.spans = append(s.tracer.spans, span)
+	full := len(s.tracer.spans) >= traceBatchSize
+	s.tracer.mu.Unlock()
+	if full {
+		go s.flushSpans()
+	}
+}
+
+// runTracer exports spans periodically until the process exits.
+func (s *Server) runTracer() {
+	for range time.Tick(traceFlushInterval) {
+		s.flushSpans()
+	}
+}
+
+// flushSpans sends all waiting spans to the collector.
+func (s *Server) flushSpans() {
+	s.tracer.mu.Lock()
+	spans := s.tracer.spans
+	s.tracer.spans = nil
+	s.tracer.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{stringAttr("service.name", "variable-debug-web-server")},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "variable-debug-web-server"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, _ := json.Marshal(payload)
+	resp, err := s.tracer.client.Post(s.tracer.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		s.warnf("Exporting %d span(s) failed: %v", len(spans), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		s.warnf("Trace collector answered %s to %d span(s)", resp.Status, len(spans))
+	}
+}
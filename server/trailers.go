@@ -0,0 +1,126 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// trailer is an HTTP trailer sent after the response body. Its value is a
+// text/template rendered with trailerData once the body is known, e.g.
+// "Grpc-Status=0" or "X-Checksum={{.BodySHA256}}".
+type trailer struct {
+	name  string
+	value *template.Template
+}
+
+// trailerData is the data available to trailer value templates.
+type trailerData struct {
+	ID         int
+	Status     int
+	BodyLength int
+	BodySHA256 string // hex
+	BodyMD5    string // base64, as in Content-MD5
+	BodyCRC32  string // hex
+}
+
+// parseTrailers parses TRAILERS, a comma-separated list of Name=value pairs.
+func parseTrailers(spec string) ([]trailer, error) {
+	var trailers []trailer
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid trailer %q (want Name=value)", strings.TrimSpace(pair))
+		}
+		t, err := newTrailer(name, strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		trailers = append(trailers, t)
+	}
+	return trailers, nil
+}
+
+// trailersFromMap builds trailers from a route's "trailers" object, sorted by
+// name so they are always announced in the same order.
+func trailersFromMap(values map[string]string) ([]trailer, error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	trailers := make([]trailer, 0, len(names))
+	for _, name := range names {
+		t, err := newTrailer(name, values[name])
+		if err != nil {
+			return nil, err
+		}
+		trailers = append(trailers, t)
+	}
+	return trailers, nil
+}
+
+func newTrailer(name, value string) (trailer, error) {
+	tmpl, err := newTemplate(name).Parse(value)
+	if err != nil {
+		return trailer{}, fmt.Errorf("trailer %s: %v", name, err)
+	}
+	return trailer{name: http.CanonicalHeaderKey(name), value: tmpl}, nil
+}
+
+// responseTrailers returns the trailers to send for req: the route's if it
+// has any, otherwise TRAILERS.
+func (s *Server) responseTrailers(req *pendingRequest) []trailer {
+	if req.route != nil && len(req.route.trailers) > 0 {
+		return req.route.trailers
+	}
+	return s.trailers
+}
+
+// announceTrailers declares trailers in the Trailer header, which must be
+// sent before the body. This also makes the response chunked.
+func announceTrailers(header http.Header, trailers []trailer) {
+	for _, t := range trailers {
+		header.Add("Trailer", t.name)
+	}
+}
+
+// setTrailers renders the trailer values for body into header. Values set
+// after the status line has been written are sent as trailers once the
+// handler returns.
+func (s *Server) setTrailers(header http.Header, req *pendingRequest, trailers []trailer, body []byte) {
+	if len(trailers) == 0 {
+		return
+	}
+
+	sha := sha256.Sum256(body)
+	sum := md5.Sum(body)
+	data := trailerData{
+		ID:         req.id,
+		Status:     req.status,
+		BodyLength: len(body),
+		BodySHA256: hex.EncodeToString(sha[:]),
+		BodyMD5:    base64.StdEncoding.EncodeToString(sum[:]),
+		BodyCRC32:  fmt.Sprintf("%08x", crc32.ChecksumIEEE(body)),
+	}
+	for _, t := range trailers {
+		var value strings.Builder
+		if err := t.value.Execute(&value, data); err != nil {
+			s.warnf("Request #%d: Failed to render trailer %s: %v", req.id, t.name, err)
+			continue
+		}
+		header.Set(t.name, value.String())
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"os"
+	"time"
+)
+
+// triggerPollInterval is how often the RELEASE_TRIGGER file is checked.
+const triggerPollInterval = 200 * time.Millisecond
+
+// watchTrigger releases all pending requests whenever file is created or
+// its modification time changes, e.g. after "touch /tmp/release". This lets
+// shells, Makefiles and other processes that can't reach stdin or the admin
+// API control the server.
+func (s *Server) watchTrigger(file string) {
+	last := triggerModTime(file)
+	for range time.Tick(triggerPollInterval) {
+		current := triggerModTime(file)
+		if current.Equal(last) {
+			continue
+		}
+		last = current
+		if current.IsZero() {
+			// Deleted; the next touch creates it again
+			continue
+		}
+		released := s.releaseMatching(matchAll, releaseOptions{cause: "trigger"})
+		s.printf("Trigger file %s touched; released %d request(s)\n", file, released)
+	}
+}
+
+// triggerModTime returns file's modification time, or zero if it doesn't
+// exist.
+func triggerModTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tuiLogLines is how many lines of console output the TUI keeps.
+const tuiLogLines = 500
+
+// tuiKeys is the key help shown at the bottom of the TUI.
+const tuiKeys = "↑/↓ select  enter release  a release all  d drop  t auto-release  : command  q quit"
+
+// tui is a full-screen terminal view of the pending queue, started with
+// TUI=1. It shows a live table of pending requests above the most recent
+// console output, and takes single-key commands instead of lines. Raw input
+// is set up with stty(1), so it needs a Unix terminal.
+type tui struct {
+	s *Server
+
+	mu          sync.Mutex
+	logs        []string
+	partial     string
+	selected    int // request number of the selected row
+	autoRelease bool
+	command     *string // the line being typed after ":", if any
+	rows, cols  int
+
+	redraw chan struct{}
+}
+
+// startTUI takes over the terminal and standard output. The returned
+// function restores both.
+func (s *Server) startTUI() (stop func(), err error) {
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil, fmt.Errorf("standard input is not a terminal")
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("stty: %v", err)
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, fmt.Errorf("stty: %v", err)
+	}
+
+	t := &tui{s: s, redraw: make(chan struct{}, 1), rows: 24, cols: 80}
+	t.resize()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		stty(strings.TrimSpace(saved))
+		return nil, err
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				t.appendLog(string(buf[:n]))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	rendered := make(chan struct{})
+	fmt.Fprint(stdout, "\033[?1049h\033[?25l")
+	go t.readKeys()
+	go func() {
+		defer close(rendered)
+		t.run(stdout, done)
+	}()
+
+	return func() {
+		close(done)
+		<-rendered
+		os.Stdout = stdout
+		w.Close()
+		<-copied
+		fmt.Fprint(stdout, "\033[?25h\033[?1049l")
+		stty(strings.TrimSpace(saved))
+
+		// Leave the end of the session on the normal screen
+		t.mu.Lock()
+		logs := t.logs
+		if len(logs) > 20 {
+			logs = logs[len(logs)-20:]
+		}
+		t.mu.Unlock()
+		for _, line := range logs {
+			fmt.Fprintln(stdout, line)
+		}
+	}, nil
+}
+
+// stty runs stty(1) on the terminal and returns its output.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// resize reads the terminal size.
+func (t *tui) resize() {
+	out, err := stty("size")
+	if err != nil {
+		return
+	}
+	var rows, cols int
+	if _, err := fmt.Sscan(out, &rows, &cols); err == nil && rows > 0 && cols > 0 {
+		t.mu.Lock()
+		t.rows, t.cols = rows, cols
+		t.mu.Unlock()
+	}
+}
+
+// appendLog adds console output to the log pane.
+func (t *tui) appendLog(text string) {
+	t.mu.Lock()
+	lines := strings.Split(t.partial+text, "\n")
+	t.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		// Drop the status line and cursor controls some output carries
+		line = strings.TrimPrefix(line, "\r\033[K")
+		t.logs = append(t.logs, strings.TrimRight(line, "\r"))
+	}
+	if len(t.logs) > tuiLogLines {
+		t.logs = t.logs[len(t.logs)-tuiLogLines:]
+	}
+	t.mu.Unlock()
+	t.requestRedraw()
+}
+
+func (t *tui) requestRedraw() {
+	select {
+	case t.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// run redraws the screen whenever the queue, the log or the selection
+// changes, and at least every second so that ages stay current.
+func (t *tui) run(stdout *os.File, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		pending, changed := t.s.watchQueue()
+
+		t.mu.Lock()
+		autoRelease := t.autoRelease
+		t.mu.Unlock()
+		if autoRelease && len(pending) > 0 && t.s.releaseAll() > 0 {
+			continue
+		}
+
+		t.draw(stdout, pending)
+		select {
+		case <-done:
+			return
+		case <-changed:
+		case <-t.redraw:
+		case <-ticker.C:
+			t.resize()
+		}
+	}
+}
+
+// draw renders the whole screen.
+func (t *tui) draw(stdout *os.File, pending []*pendingRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Keep the selection on a pending request
+	selectedRow := -1
+	for i, req := range pending {
+		if req.id == t.selected {
+			selectedRow = i
+		}
+	}
+	if selectedRow < 0 && len(pending) > 0 {
+		selectedRow = 0
+		t.selected = pending[0].id
+	}
+
+	auto := "off"
+	if t.autoRelease {
+		auto = "on"
+	}
+	var lines []string
+	lines = append(lines,
+		fmt.Sprintf("\033[1mvariable-debug-web-server\033[0m  pending %d | served %d | auto-release %s | %s",
+			len(pending), t.s.served.Load(), auto, time.Now().Format("15:04:05")),
+		"",
+		fmt.Sprintf("\033[1m  %-5s %-7s %-7s %-*s %s\033[0m", "#", "AGE", "METHOD", t.pathWidth(), "PATH", "CLIENT"))
+
+	// The table gets up to half the screen, scrolled to the selection
+	tableRows := t.rows/2 - len(lines)
+	if tableRows < 3 {
+		tableRows = 3
+	}
+	first := 0
+	if selectedRow >= tableRows {
+		first = selectedRow - tableRows + 1
+	}
+	now := time.Now()
+	for i := first; i < len(pending) && i < first+tableRows; i++ {
+		req := pending[i]
+		row := fmt.Sprintf("  %-5s %-7s %-7s %-*s %s", "#"+strconv.Itoa(req.id),
+			now.Sub(req.requestTime).Round(time.Second), req.method, t.pathWidth(), req.path, req.client)
+		row = truncate(row, t.cols)
+		if i == selectedRow {
+			row = "\033[7m" + row + strings.Repeat(" ", max(0, t.cols-len([]rune(row)))) + "\033[0m"
+		}
+		lines = append(lines, row)
+	}
+	if len(pending) == 0 {
+		lines = append(lines, "  No pending requests")
+	} else if more := len(pending) - first - tableRows; more > 0 {
+		lines = append(lines, fmt.Sprintf("  ... %d more", more))
+	}
+	lines = append(lines, "", "\033[2m"+strings.Repeat("─", t.cols)+"\033[0m")
+
+	// The log fills the rest, newest at the bottom
+	footer := tuiKeys
+	if t.command != nil {
+		footer = ":" + *t.command + "█"
+	}
+	logRows := t.rows - len(lines) - 1
+	logs := t.logs
+	if logRows < 0 {
+		logRows = 0
+	}
+	if len(logs) > logRows {
+		logs = logs[len(logs)-logRows:]
+	}
+	for _, line := range logs {
+		lines = append(lines, truncate(line, t.cols))
+	}
+	for len(lines) < t.rows-1 {
+		lines = append(lines, "")
+	}
+
+	var screen strings.Builder
+	screen.WriteString("\033[H")
+	for _, line := range lines {
+		screen.WriteString(line + "\033[K\r\n")
+	}
+	screen.WriteString("\033[7m" + truncate(footer, t.cols) + "\033[0m\033[K\033[J")
+	stdout.WriteString(screen.String())
+}
+
+// pathWidth is the width of the path column. t.mu must be held.
+func (t *tui) pathWidth() int {
+	return max(10, min(60, t.cols-40))
+}
+
+// truncate cuts line to width characters, not counting escape sequences.
+func truncate(line string, width int) string {
+	var out strings.Builder
+	visible := 0
+	escape := false
+	for _, r := range line {
+		switch {
+		case escape:
+			escape = r < '@' || r > '~' || r == '['
+		case r == '\033':
+			escape = true
+		case visible >= width:
+			continue
+		default:
+			visible++
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// readKeys handles key presses until standard input closes.
+func (t *tui) readKeys() {
+	in := bufio.NewReader(os.Stdin)
+	for {
+		b, err := in.ReadByte()
+		if err != nil {
+			return
+		}
+		key := string(b)
+		if b == '\033' && in.Buffered() > 0 {
+			// Arrow keys arrive at once as ESC [ A and ESC [ B
+			if next, err := in.ReadByte(); err == nil && next == '[' {
+				if final, err := in.ReadByte(); err == nil {
+					key = "\033[" + string(final)
+				}
+			}
+		}
+		t.handleKey(key)
+		t.requestRedraw()
+	}
+}
+
+// handleKey runs the action bound to key.
+func (t *tui) handleKey(key string) {
+	t.mu.Lock()
+	if t.command != nil {
+		line := *t.command
+		switch key {
+		case "\n", "\r":
+			t.command = nil
+			t.mu.Unlock()
+			t.s.execute(os.Stdout, line)
+			return
+		case "\033":
+			t.command = nil
+		case "\x7f", "\b":
+			if line != "" {
+				runes := []rune(line)
+				line = string(runes[:len(runes)-1])
+			}
+			t.command = &line
+		default:
+			if len(key) == 1 && key[0] >= ' ' {
+				line += key
+			}
+			t.command = &line
+		}
+		t.mu.Unlock()
+		return
+	}
+	selected := t.selected
+	t.mu.Unlock()
+
+	switch key {
+	case "\033[A", "k":
+		t.moveSelection(-1)
+	case "\033[B", "j":
+		t.moveSelection(1)
+	case "\n", "\r", "r":
+		if selected != 0 && !t.s.releaseByID(selected) {
+			fmt.Printf("Request #%d is not pending\n", selected)
+		}
+	case "a":
+		if t.s.releaseAll() == 0 {
+			fmt.Println("No pending requests")
+		}
+	case "d":
+		if selected != 0 && t.s.dropMatching(matchID(selected), false) == 0 {
+			fmt.Printf("Request #%d is not pending\n", selected)
+		}
+	case "t":
+		t.mu.Lock()
+		t.autoRelease = !t.autoRelease
+		on := t.autoRelease
+		t.mu.Unlock()
+		if on {
+			fmt.Println("Auto-release on: requests are released as they arrive")
+		} else {
+			fmt.Println("Auto-release off")
+		}
+	case ":":
+		line := ""
+		t.mu.Lock()
+		t.command = &line
+		t.mu.Unlock()
+	case "q":
+		if p, err := os.FindProcess(os.Getpid()); err == nil {
+			p.Signal(os.Interrupt)
+		}
+	}
+}
+
+// moveSelection selects the request delta rows away from the selected one.
+func (t *tui) moveSelection(delta int) {
+	pending := t.s.snapshot()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, req := range pending {
+		if req.id == t.selected {
+			if j := i + delta; j >= 0 && j < len(pending) {
+				t.selected = pending[j].id
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// watchUpload wraps body so that the upload's progress is printed every
+// UPLOAD_PROGRESS interval while it streams in and, with UPLOAD_DIR, so that
+// the whole body is written to a file. The returned function reports the
+// outcome and must be called once the body has been read; it is safe to call
+// again.
+func (s *Server) watchUpload(req *pendingRequest, body io.Reader, size int64) (io.Reader, func()) {
+	counter := &countingReader{r: body}
+	var reader io.Reader = counter
+
+	var file *os.File
+	if s.uploadDir != "" {
+		var err error
+		if err = os.MkdirAll(s.uploadDir, 0o755); err == nil {
+			name := fmt.Sprintf("%s-%04d-%s.body", req.requestTime.Format("20060102-150405"), captureCounter.Add(1), req.method)
+			file, err = os.Create(filepath.Join(s.uploadDir, name))
+		}
+		if err != nil {
+			s.warnf("Failed to save the body of %s %s: %v", req.method, req.path, err)
+		} else {
+			reader = io.TeeReader(counter, file)
+		}
+	}
+
+	start := time.Now()
+	done := make(chan struct{})
+	if s.uploadProgress > 0 {
+		go func() {
+			ticker := time.NewTicker(s.uploadProgress)
+			defer ticker.Stop()
+			last := int64(-1)
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
+				// Nothing more is printed while the upload is stalled
+				n := counter.n.Load()
+				if n == last {
+					continue
+				}
+				last = n
+				s.logRequest(req, "upload", "%s", uploadStatus(n, size, time.Since(start)))
+			}
+		}()
+	}
+
+	var once sync.Once
+	return reader, func() {
+		once.Do(func() {
+			close(done)
+			n := counter.n.Load()
+			if s.uploadProgress > 0 && time.Since(start) >= s.uploadProgress {
+				s.logRequest(req, "upload", "Upload finished, %s", uploadStatus(n, size, time.Since(start)))
+			}
+			if file != nil {
+				if err := file.Close(); err != nil {
+					s.warnf("Failed to save the body of %s %s: %v", req.method, req.path, err)
+				} else {
+					s.logRequest(req, "upload", "Saved %s of body to %s", formatSize(n), file.Name())
+				}
+			}
+		})
+	}
+}
+
+// uploadStatus describes an upload of size bytes (-1 if unknown) of which n
+// have arrived after elapsed.
+func uploadStatus(n, size int64, elapsed time.Duration) string {
+	rate := ""
+	if elapsed > 0 {
+		rate = fmt.Sprintf(", %s/s", formatSize(int64(float64(n)/elapsed.Seconds())))
+	}
+	if size < 0 {
+		return fmt.Sprintf("%s received in %s%s", formatSize(n), elapsed.Round(time.Millisecond), rate)
+	}
+	percent := 100.0
+	if size > 0 {
+		percent = float64(n) * 100 / float64(size)
+	}
+	return fmt.Sprintf("%s of %s (%.0f%%) received in %s%s", formatSize(n), formatSize(size), percent, elapsed.Round(time.Millisecond), rate)
+}
+
+// formatSize formats a byte count with a binary unit.
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
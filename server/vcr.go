@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// vcr records upstream responses to VCR_DIR in proxy mode, or serves those
+// recordings in place of the upstream. Recordings are keyed by method, path,
+// query and a hash of the request body.
+type vcr struct {
+	dir    string
+	replay bool
+}
+
+// recording is one recorded upstream response, stored as JSON.
+type recording struct {
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Query      string      `json:"query,omitempty"`
+	Status     int         `json:"status"`
+	Header     http.Header `json:"headers"`
+	Body       []byte      `json:"body"`
+	RecordedAt time.Time   `json:"recorded_at"`
+}
+
+// vcrKeyKey is the request context key carrying a proxied request's
+// recording file name in record mode.
+type vcrKeyKey struct{}
+
+// file returns the recording file for a request. The name starts with the
+// method and path so that the directory is easy to browse.
+func (v *vcr) file(method, path, query string, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s?%s\n", method, path, query)
+	h.Write(body)
+	sum := hex.EncodeToString(h.Sum(nil))[:16]
+
+	name := strings.Trim(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, path), "_")
+	if len(name) > 60 {
+		name = name[:60]
+	}
+	if name == "" {
+		name = "root"
+	}
+	return filepath.Join(v.dir, fmt.Sprintf("%s_%s_%s.json", method, name, sum))
+}
+
+// load reads the recording in file.
+func (v *vcr) load(file string) (*recording, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rec recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return &rec, nil
+}
+
+// save writes rec to file, replacing any earlier recording.
+func (v *vcr) save(file string, rec *recording) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(v.dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(data, '\n'), 0o644)
+}
+
+// recordingBody wraps an upstream response body and saves the response once
+// it has been read to the end.
+type recordingBody struct {
+	io.ReadCloser
+	s    *Server
+	file string
+	rec  *recording
+	buf  bytes.Buffer
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.rec.Body = b.buf.Bytes()
+		if saveErr := b.s.vcr.save(b.file, b.rec); saveErr != nil {
+			b.s.warnf("Failed to record %s %s: %v", b.rec.Method, b.rec.Path, saveErr)
+		} else {
+			b.s.printf("Recorded %s %s to %s\n", b.rec.Method, b.rec.Path, b.file)
+		}
+	}
+	return n, err
+}
+
+// recordUpstream wraps resp's body so that it is saved to the recording file
+// named in the request context, if any.
+func (s *Server) recordUpstream(resp *http.Response) {
+	file, ok := resp.Request.Context().Value(vcrKeyKey{}).(string)
+	if !ok {
+		return
+	}
+	header := resp.Header.Clone()
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+	resp.Body = &recordingBody{
+		ReadCloser: resp.Body,
+		s:          s,
+		file:       file,
+		rec: &recording{
+			Method:     resp.Request.Method,
+			Path:       resp.Request.URL.Path,
+			Query:      resp.Request.URL.RawQuery,
+			Status:     resp.StatusCode,
+			Header:     header,
+			RecordedAt: time.Now().UTC(),
+		},
+	}
+}
+
+// withRecording buffers r's body and tags r with its recording file so that
+// the upstream response is recorded.
+func (s *Server) withRecording(r *http.Request) (*http.Request, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	file := s.vcr.file(r.Method, r.URL.Path, r.URL.RawQuery, body)
+	return r.WithContext(context.WithValue(r.Context(), vcrKeyKey{}, file)), nil
+}
+
+// handleReplay answers req from its recording, holding it first like any
+// other request. Requests without a recording get 404.
+func (s *Server) handleReplay(w http.ResponseWriter, r *http.Request, req *pendingRequest) {
+	if err := req.captureBody(r.Body); err != nil {
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+	req.fingerprint = requestFingerprint(req)
+	file := s.vcr.file(r.Method, r.URL.Path, r.URL.RawQuery, req.body)
+	rec, err := s.vcr.load(file)
+	if err != nil {
+		s.warnf("No recording for %s %s: %v", r.Method, r.URL.Path, err)
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no recording for this request"})
+		return
+	}
+
+	if !s.shouldHold(r) {
+		s.passThrough(req)
+	} else {
+		stopTimeout := s.hold(req)
+		defer stopTimeout()
+		if !s.waitForRelease(r.Context(), req) {
+			return
+		}
+		if req.dropped {
+			s.abortResponse(w, req)
+			return
+		}
+		if req.releaseStatus != 0 {
+			s.logReleased(req, fmt.Sprintf("Answered with %d", req.releaseStatus))
+			req.status = req.releaseStatus
+			s.answerStatus(w, req)
+			return
+		}
+		s.logReleased(req, "Recorded response sent")
+	}
+
+	for name, values := range rec.Header {
+		// The length and date are the server's own
+		if name == "Content-Length" || name == "Date" {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	req.status = rec.Status
+	s.recordResponse(req, rec.Status, w.Header(), rec.Body)
+	w.WriteHeader(rec.Status)
+	w.Write(rec.Body)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// requestEvent describes something that happened to a request, as sent to
+// the webhook and admin /events streams.
+type requestEvent struct {
+	Event          string    `json:"event"`
+	Time           time.Time `json:"time"`
+	ID             int       `json:"id"`
+	Method         string    `json:"method"`
+	Path           string    `json:"path"`
+	RemoteAddr     string    `json:"remote_addr"`
+	Client         string    `json:"client,omitempty"`
+	RequestID      string    `json:"request_id,omitempty"`
+	Pending        int       `json:"pending,omitempty"`
+	Cause          string    `json:"cause,omitempty"`
+	HoldMs         float64   `json:"hold_ms,omitempty"`
+	Reset          bool      `json:"reset,omitempty"`
+	DuplicateOf    int       `json:"duplicate_of,omitempty"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+}
+
+func newRequestEvent(event string, req *pendingRequest) requestEvent {
+	now := time.Now()
+	ev := requestEvent{
+		Event:          event,
+		Time:           now.UTC(),
+		ID:             req.id,
+		Method:         req.method,
+		Path:           req.path,
+		RemoteAddr:     req.remoteAddr,
+		Client:         req.client,
+		RequestID:      req.requestID,
+		DuplicateOf:    req.duplicateOf,
+		IdempotencyKey: req.idempotencyKey,
+	}
+	if event != "received" {
+		ev.HoldMs = float64(now.Sub(req.requestTime)) / float64(time.Millisecond)
+	}
+	return ev
+}
+
+// webhookQueueSize is how many events may wait for delivery before new ones
+// are discarded.
+const webhookQueueSize = 256
+
+// webhook POSTs events as JSON to a URL, one at a time and in order, without
+// holding up request handling.
+type webhook struct {
+	url    string
+	events chan requestEvent
+	client *http.Client
+}
+
+func newWebhook(target string) (*webhook, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("webhook URL %q must be http or https", target)
+	}
+	return &webhook{
+		url:    target,
+		events: make(chan requestEvent, webhookQueueSize),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// run delivers queued events until the process exits.
+func (h *webhook) run(s *Server) {
+	for ev := range h.events {
+		body, _ := json.Marshal(ev)
+		resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			s.warnf("Webhook delivery of %s event for request #%d failed: %v", ev.Event, ev.ID, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			s.warnf("Webhook answered %s to %s event for request #%d", resp.Status, ev.Event, ev.ID)
+		}
+	}
+}
+
+// publish hands ev to the admin /events streams and the webhook, if
+// configured. Events are discarded rather than queued without bound if a
+// receiver can't keep up.
+func (s *Server) publish(ev requestEvent) {
+	s.eventSubs.broadcast(ev)
+	if s.webhook == nil {
+		return
+	}
+	select {
+	case s.webhook.events <- ev:
+	default:
+		s.warnf("Webhook queue full; discarding %s event for request #%d", ev.Event, ev.ID)
+	}
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// webSocketGUID is the fixed suffix used to derive Sec-WebSocket-Accept.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes (RFC 6455 section 5.2).
+const (
+	opText   = 0x1
+	opBinary = 0x2
+	opClose  = 0x8
+	opPing   = 0x9
+	opPong   = 0xA
+)
+
+// isWebSocketUpgrade reports whether r asks to switch to the WebSocket protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// headerContainsToken reports whether the comma-separated header name
+// contains token, ignoring case.
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleWebSocket holds a WebSocket upgrade request. Depending on the hold
+// point, either the 101 Switching Protocols response or the first server
+// message is withheld until release. Once released, the server sends the
+// normal response body as a text message and then echoes client messages.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, requestTime time.Time) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "unsupported WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket upgrade not supported on this connection", http.StatusInternalServerError)
+		return
+	}
+
+	req := newPendingRequest(r, requestTime, s.matchRoute(r))
+	held := s.shouldHold(r)
+	holdHandshake := held && s.webSocketHold == "handshake"
+
+	var conn net.Conn
+	var rw *bufio.ReadWriter
+	upgrade := func() error {
+		var err error
+		conn, rw, err = hijacker.Hijack()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n", webSocketAccept(key))
+		return rw.Flush()
+	}
+
+	if !holdHandshake {
+		if err := upgrade(); err != nil {
+			s.warnf("WebSocket upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+	}
+
+	if held {
+		stopTimeout := s.hold(req)
+		defer stopTimeout()
+		s.printf("Request #%d is a WebSocket; holding the %s\n", req.id, map[bool]string{
+			true:  "handshake",
+			false: "first message",
+		}[holdHandshake])
+
+		// Once hijacked, the request context no longer tracks the client
+		ctx, stopWatching := r.Context(), func() {}
+		if conn != nil {
+			ctx, stopWatching = watchConnClosed(conn, rw.Reader)
+		}
+		released := s.waitForRelease(ctx, req)
+		stopWatching()
+		if !released {
+			return
+		}
+
+		if req.dropped {
+			if conn == nil {
+				s.abortResponse(w, req)
+				return
+			}
+			s.logDropped(req)
+			if req.reset {
+				resetConn(conn)
+			}
+			return
+		}
+
+		if holdHandshake {
+			if req.releaseStatus != 0 {
+				s.logReleased(req, fmt.Sprintf("Answered with %d", req.releaseStatus))
+				http.Error(w, http.StatusText(req.releaseStatus), req.releaseStatus)
+				return
+			}
+			if err := upgrade(); err != nil {
+				s.warnf("WebSocket upgrade failed: %v", err)
+				return
+			}
+			defer conn.Close()
+		}
+
+		s.logReleased(req, "WebSocket released")
+	} else {
+		s.passThrough(req)
+	}
+
+	var body bytes.Buffer
+	s.writeBody(&body, r, req, time.Now())
+	if err := writeWebSocketFrame(conn, opText, body.Bytes()); err != nil {
+		return
+	}
+	echoWebSocket(conn, rw.Reader)
+}
+
+// watchConnClosed returns a context that is cancelled if the client closes
+// the hijacked connection. Any data the client sends meanwhile stays
+// buffered in r, and watching stops once some arrives. The returned stop
+// function ends the watch so that r can be used again.
+func watchConnClosed(conn net.Conn, r *bufio.Reader) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	var stopped atomic.Bool
+	go func() {
+		defer close(done)
+		// Peek blocks until data arrives or the connection fails
+		if _, err := r.Peek(1); err != nil && !stopped.Load() {
+			cancel()
+		}
+	}()
+
+	stop := func() {
+		stopped.Store(true)
+		// Unblock the pending Peek, then restore normal reads
+		conn.SetReadDeadline(time.Now())
+		<-done
+		conn.SetReadDeadline(time.Time{})
+		cancel()
+	}
+	return ctx, stop
+}
+
+// echoWebSocket echoes data messages back to the client, answers pings, and
+// returns once the client closes the connection.
+func echoWebSocket(conn net.Conn, r *bufio.Reader) {
+	for {
+		opcode, payload, err := readWebSocketFrame(r)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case opText, opBinary:
+			err = writeWebSocketFrame(conn, opcode, payload)
+		case opPing:
+			err = writeWebSocketFrame(conn, opPong, payload)
+		case opClose:
+			writeWebSocketFrame(conn, opClose, payload)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeWebSocketFrame writes a single unfragmented, unmasked server frame.
+func writeWebSocketFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// readWebSocketFrame reads a single frame and unmasks its payload.
+// Fragmented messages are returned frame by frame.
+func readWebSocketFrame(r *bufio.Reader) (opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode = head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > 16<<20 {
+		return 0, nil, fmt.Errorf("frame too large: %d bytes", length)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// prettyXML indents body if it is well-formed XML, reporting whether it was.
+// Prefixes and namespace declarations are kept exactly as sent, and elements
+// holding only text stay on one line.
+func prettyXML(body []byte) (string, bool) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '<' {
+		return "", false
+	}
+
+	var tokens []xml.Token
+	decoder := xml.NewDecoder(bytes.NewReader(trimmed))
+	decoder.Strict = false
+	for {
+		token, err := decoder.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", false
+		}
+		tokens = append(tokens, xml.CopyToken(token))
+	}
+
+	var out strings.Builder
+	depth := 0
+	newline := func() {
+		if out.Len() > 0 {
+			out.WriteByte('\n')
+		}
+		out.WriteString(strings.Repeat("  ", depth))
+	}
+	for i := 0; i < len(tokens); i++ {
+		switch token := tokens[i].(type) {
+		case xml.StartElement:
+			newline()
+			out.WriteString("<" + xmlName(token.Name))
+			for _, attr := range token.Attr {
+				out.WriteString(" " + xmlName(attr.Name) + `="`)
+				xml.EscapeText(&out, []byte(attr.Value))
+				out.WriteString(`"`)
+			}
+
+			// Keep <a>text</a> and <a></a> on one line
+			j := i + 1
+			var text []byte
+			if j < len(tokens) {
+				if data, ok := tokens[j].(xml.CharData); ok {
+					text = bytes.TrimSpace(data)
+					j++
+				}
+			}
+			if j < len(tokens) {
+				if end, ok := tokens[j].(xml.EndElement); ok && end.Name == token.Name {
+					if len(text) == 0 {
+						out.WriteString("/>")
+					} else {
+						out.WriteString(">")
+						xml.EscapeText(&out, text)
+						out.WriteString("</" + xmlName(end.Name) + ">")
+					}
+					i = j
+					continue
+				}
+			}
+			out.WriteString(">")
+			depth++
+		case xml.EndElement:
+			if depth > 0 {
+				depth--
+			}
+			newline()
+			out.WriteString("</" + xmlName(token.Name) + ">")
+		case xml.CharData:
+			if text := bytes.TrimSpace(token); len(text) > 0 {
+				newline()
+				xml.EscapeText(&out, text)
+			}
+		case xml.Comment:
+			newline()
+			out.WriteString("<!--" + string(token) + "-->")
+		case xml.ProcInst:
+			newline()
+			out.WriteString("<?" + token.Target + " " + string(token.Inst) + "?>")
+		case xml.Directive:
+			newline()
+			out.WriteString("<!" + string(token) + ">")
+		}
+	}
+	return out.String(), true
+}
+
+// xmlName formats a raw token name with its prefix.
+func xmlName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// soapAction returns the action of a SOAP request: the SOAPAction header of
+// SOAP 1.1, the action parameter of a SOAP 1.2 Content-Type or, failing
+// those, the name of the first element in the envelope's Body. Other
+// requests have none.
+func soapAction(header http.Header, body []byte) string {
+	if action := strings.Trim(header.Get("SOAPAction"), `" `); action != "" {
+		return action
+	}
+	mediaType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mediaType == "application/soap+xml" && params["action"] != "" {
+		return params["action"]
+	}
+	if mediaType != "application/soap+xml" && mediaType != "text/xml" && mediaType != "application/xml" {
+		return ""
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	inBody := false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch {
+		case inBody:
+			return start.Name.Local
+		case start.Name.Local == "Envelope":
+		case start.Name.Local == "Body":
+			inBody = true
+		default:
+			// The Header, or a root element that is not an envelope
+			if err := decoder.Skip(); err != nil {
+				return ""
+			}
+		}
+	}
+}